@@ -0,0 +1,207 @@
+package ambex
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/datawire/ambassador/pkg/api/ambex"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+)
+
+// adminServer implements the admin API, which shows what the snapshot cache
+// is serving to each node. It is served over gRPC, and as JSON over HTTP.
+type adminServer struct {
+	config cache.SnapshotCache
+	nodes  *nodeSnapshots
+}
+
+var _ api.AdminServer = adminServer{}
+
+// ListNodes lists the node IDs known to the snapshot cache.
+func (a adminServer) ListNodes(context.Context, *api.ListNodesRequest) (*api.ListNodesResponse, error) {
+	ids := a.config.GetStatusKeys()
+	sort.Strings(ids)
+	return &api.ListNodesResponse{Nodes: ids}, nil
+}
+
+// GetSnapshot returns the current snapshot of a node.
+func (a adminServer) GetSnapshot(_ context.Context, req *api.GetSnapshotRequest) (*api.Snapshot, error) {
+	if req.Node == "" {
+		return nil, status.Error(codes.InvalidArgument, "no node given")
+	}
+	snapshot, err := a.config.GetSnapshot(req.Node)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	out := &api.Snapshot{Node: req.Node}
+	for _, typeURL := range cache.ResponseTypes {
+		if req.TypeUrl != "" && req.TypeUrl != typeURL {
+			continue
+		}
+		resources := &api.Resources{
+			TypeUrl: typeURL,
+			Version: snapshot.GetVersion(typeURL),
+			Items:   make(map[string]*types.Any),
+		}
+		for name, resource := range snapshot.GetResources(typeURL) {
+			any, err := types.MarshalAny(resource)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "%s %s: %v", typeURL, name, err)
+			}
+			resources.Items[name] = any
+		}
+		out.Resources = append(out.Resources, resources)
+	}
+	if len(out.Resources) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown type %q", req.TypeUrl)
+	}
+	return out, nil
+}
+
+// GetWatches returns the open watches and the last request time of each node.
+func (a adminServer) GetWatches(_ context.Context, req *api.GetWatchesRequest) (*api.GetWatchesResponse, error) {
+	ids := []string{req.Node}
+	if req.Node == "" {
+		ids = a.config.GetStatusKeys()
+		sort.Strings(ids)
+	}
+
+	out := &api.GetWatchesResponse{}
+	for _, id := range ids {
+		info := a.config.GetStatusInfo(id)
+		if info == nil {
+			return nil, status.Errorf(codes.NotFound, "unknown node %q", id)
+		}
+		watches := &api.NodeWatches{
+			Node:         id,
+			Watches:      int64(info.GetNumWatches()),
+			DeltaWatches: int64(info.GetNumDeltaWatches()),
+		}
+		if last := info.GetLastWatchRequestTime(); !last.IsZero() {
+			watches.LastRequestTime, _ = types.TimestampProto(last)
+		}
+		out.Nodes = append(out.Nodes, watches)
+	}
+	return out, nil
+}
+
+// Push sends the current snapshot to a node, or to every node, again.
+func (a adminServer) Push(_ context.Context, req *api.PushRequest) (*api.PushResponse, error) {
+	ids, err := a.nodes.Push(req.Node)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &api.PushResponse{Nodes: ids}, nil
+}
+
+// handle serves one admin call as JSON over HTTP. The request fields come
+// from the query parameters.
+func (a adminServer) handle(method string, call func(context.Context, query) (proto.Message, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		res, err := call(r.Context(), r.URL.Query().Get)
+		if err != nil {
+			code := http.StatusInternalServerError
+			switch status.Code(err) {
+			case codes.InvalidArgument:
+				code = http.StatusBadRequest
+			case codes.NotFound:
+				code = http.StatusNotFound
+			}
+			http.Error(w, status.Convert(err).Message(), code)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := (&jsonpb.Marshaler{EmitDefaults: true, Indent: "  "}).Marshal(w, res); err != nil {
+			log.WithError(err).Warn("Error marshalling admin response")
+		}
+	}
+}
+
+// query looks up a query parameter.
+type query func(key string) string
+
+func (a adminServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/nodes", a.handle(http.MethodGet, func(ctx context.Context, _ query) (proto.Message, error) {
+		return a.ListNodes(ctx, &api.ListNodesRequest{})
+	}))
+	mux.Handle("/snapshot", a.handle(http.MethodGet, func(ctx context.Context, get query) (proto.Message, error) {
+		return a.GetSnapshot(ctx, &api.GetSnapshotRequest{Node: get("node"), TypeUrl: get("type")})
+	}))
+	mux.Handle("/watches", a.handle(http.MethodGet, func(ctx context.Context, get query) (proto.Message, error) {
+		return a.GetWatches(ctx, &api.GetWatchesRequest{Node: get("node")})
+	}))
+	mux.Handle("/push", a.handle(http.MethodPost, func(ctx context.Context, get query) (proto.Message, error) {
+		return a.Push(ctx, &api.PushRequest{Node: get("node")})
+	}))
+	return mux
+}
+
+// runAdminServer serves the admin API over gRPC and/or HTTP at the given
+// addresses, whichever are set.
+func runAdminServer(ctx context.Context, admin adminServer, grpcAddr, httpAddr string) {
+	if grpcAddr != "" {
+		grpcServer := grpc.NewServer()
+		api.RegisterAdminServer(grpcServer, admin)
+
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.WithError(err).Fatal("failed to listen")
+		}
+
+		log.WithFields(log.Fields{"addr": grpcAddr}).Info("Serving admin gRPC")
+		go func() {
+			go func() {
+				err := grpcServer.Serve(lis)
+
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Admin gRPC server exited")
+				}
+			}()
+
+			<-ctx.Done()
+			grpcServer.GracefulStop()
+		}()
+	}
+
+	if httpAddr != "" {
+		srv := &http.Server{Handler: admin.mux()}
+
+		lis, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			log.WithError(err).Fatal("failed to listen")
+		}
+
+		log.WithFields(log.Fields{"addr": httpAddr}).Info("Serving admin HTTP")
+		go func() {
+			go func() {
+				err := srv.Serve(lis)
+
+				if err != nil && err != http.ErrServerClosed {
+					log.WithFields(log.Fields{"error": err}).Error("Admin HTTP server exited")
+				}
+			}()
+
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+	}
+}
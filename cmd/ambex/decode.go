@@ -0,0 +1,291 @@
+package ambex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"sigs.k8s.io/yaml"
+)
+
+// unmarshalYAML decodes YAML by converting it to JSON for jsonpb.
+func unmarshalYAML(contents string, m proto.Message) error {
+	js, err := yaml.YAMLToJSON([]byte(contents))
+	if err != nil {
+		return err
+	}
+	return jsonpb.Unmarshal(bytes.NewReader(js), m)
+}
+
+// unmarshalBinary decodes the protobuf wire format.
+func unmarshalBinary(contents string, m proto.Message) error {
+	return proto.Unmarshal([]byte(contents), m)
+}
+
+// decodeError is an error loading a file, along with where in the file it
+// happened as best we can tell.
+type decodeError struct {
+	file string
+	line int
+	path []string
+	err  error
+}
+
+func (e *decodeError) Error() string {
+	where := e.file
+	if e.line > 0 {
+		where = fmt.Sprintf("%s:%d", where, e.line)
+	}
+	if len(e.path) > 0 {
+		return fmt.Sprintf("%s: %s: %v", where, fieldPath(e.path), e.err)
+	}
+	return fmt.Sprintf("%s: %v", where, e.err)
+}
+
+// fieldPath formats a path like "load_assignment.endpoints[0]".
+func fieldPath(path []string) string {
+	var b strings.Builder
+	for _, segment := range path {
+		if b.Len() > 0 && !strings.HasPrefix(segment, "[") {
+			b.WriteByte('.')
+		}
+		b.WriteString(segment)
+	}
+	return b.String()
+}
+
+// newDecodeError works out where an error unmarshalling or validating a
+// file happened. js is the file as JSON, for the formats that have one.
+func newDecodeError(file string, contents, js []byte, m proto.Message, err error) error {
+	e := &decodeError{file: file, err: err}
+
+	if syntax, ok := err.(*json.SyntaxError); ok && js != nil {
+		// YAML always converts to valid JSON, so this is a JSON file
+		e.line = lineOf(js, int(syntax.Offset))
+		return e
+	}
+
+	if cause, ok := err.(validationError); ok {
+		e.path, e.err = validationPath(cause)
+	} else if js != nil {
+		if path, cause := locate(m, js); cause != nil {
+			e.path, e.err = path, cause
+		}
+	}
+	e.line = findLine(contents, e.path)
+	return e
+}
+
+// locate finds the path of the field of a JSON object that m can't be
+// unmarshalled from, by trying to unmarshal each field on its own and
+// descending into the one that fails. It returns a nil error if it can't
+// pin down a field.
+func locate(m proto.Message, js []byte) ([]string, error) {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(js, &obj) != nil {
+		return nil, nil
+	}
+
+	if _, ok := m.(*types.Any); ok {
+		// an Any holds the fields of the message named by its @type
+		var typeURL string
+		if json.Unmarshal(obj["@type"], &typeURL) != nil {
+			return nil, nil
+		}
+		t := proto.MessageType(typeURL[strings.LastIndex(typeURL, "/")+1:])
+		if t == nil {
+			return []string{"@type"}, fmt.Errorf("unknown message type %q", typeURL)
+		}
+		m = reflect.New(t.Elem()).Interface().(proto.Message)
+		delete(obj, "@type")
+	}
+
+	st := reflect.TypeOf(m).Elem()
+	if st.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	props := proto.GetProperties(st)
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var ft reflect.Type
+		for i, prop := range props.Prop {
+			if prop.OrigName != "" && (prop.OrigName == key || prop.JSONName == key) {
+				ft = st.Field(i).Type
+				break
+			}
+		}
+		if ft == nil {
+			for name, oneof := range props.OneofTypes {
+				if name == key || oneof.Prop.JSONName == key {
+					ft = oneof.Type.Elem().Field(0).Type
+					break
+				}
+			}
+		}
+		if ft == nil {
+			return []string{key}, fmt.Errorf("unknown field in %s", proto.MessageName(m))
+		}
+
+		name, _ := json.Marshal(key)
+		single := fmt.Sprintf("{%s:%s}", name, obj[key])
+		err := jsonpb.UnmarshalString(single, reflect.New(st).Interface().(proto.Message))
+		if err == nil {
+			continue
+		}
+		if path, cause := locateValue(ft, obj[key]); cause != nil {
+			return append([]string{key}, path...), cause
+		}
+		return []string{key}, err
+	}
+
+	return nil, nil
+}
+
+// locateValue is locate for a field value of type ft: a message, or a list
+// or map of them.
+func locateValue(ft reflect.Type, js []byte) ([]string, error) {
+	switch ft.Kind() {
+	case reflect.Ptr:
+		if ft.Elem().PkgPath() == reflect.TypeOf(types.Any{}).PkgPath() && ft != reflect.TypeOf(&types.Any{}) {
+			// well known types have their own JSON form
+			return nil, nil
+		}
+		if m, ok := reflect.New(ft.Elem()).Interface().(proto.Message); ok {
+			return locate(m, js)
+		}
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(js, &items) != nil {
+			return nil, nil
+		}
+		for i, item := range items {
+			if path, err := locateValue(ft.Elem(), item); err != nil {
+				return append([]string{fmt.Sprintf("[%d]", i)}, path...), err
+			}
+		}
+	case reflect.Map:
+		var items map[string]json.RawMessage
+		if json.Unmarshal(js, &items) != nil {
+			return nil, nil
+		}
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if path, err := locateValue(ft.Elem(), items[key]); err != nil {
+				return append([]string{"[" + key + "]"}, path...), err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// validationError is implemented by the errors of the generated Validate
+// methods.
+type validationError interface {
+	error
+	Field() string
+	Reason() string
+	Cause() error
+}
+
+var validationIndex = regexp.MustCompile(`^(\w+)((?:\[[^\]]*\])*)$`)
+
+// validationPath follows the causes of a validation error down to the field
+// that failed validation, and returns its path and the reason it failed.
+func validationPath(err validationError) ([]string, error) {
+	var path []string
+	for {
+		field := err.Field()
+		if match := validationIndex.FindStringSubmatch(field); match != nil {
+			path = append(path, snakeCase(match[1]))
+			if match[2] != "" {
+				path = append(path, match[2])
+			}
+		} else {
+			path = append(path, field)
+		}
+
+		cause, ok := err.Cause().(validationError)
+		if !ok {
+			if err.Cause() != nil {
+				return path, fmt.Errorf("%s: %v", err.Reason(), err.Cause())
+			}
+			return path, fmt.Errorf("%s", err.Reason())
+		}
+		err = cause
+	}
+}
+
+// snakeCase turns a generated Go field name back into a proto field name.
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// lowerCamelCase turns a proto field name into its JSON name.
+func lowerCamelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// findLine finds the line of the field at a path in a JSON or YAML file, by
+// looking for each key of the path in turn. It's a best guess: it can't tell
+// list items apart. It returns 0 if it can't find the field.
+func findLine(contents []byte, path []string) int {
+	pos := -1
+	for _, segment := range path {
+		if strings.HasPrefix(segment, "[") {
+			continue
+		}
+		re := regexp.MustCompile(fmt.Sprintf(`(?:^|\W)["']?(?:%s|%s)["']?\s*:`,
+			regexp.QuoteMeta(segment), regexp.QuoteMeta(lowerCamelCase(segment))))
+		loc := re.FindIndex(contents[pos+1:])
+		if loc == nil {
+			return 0
+		}
+		pos += 1 + loc[0]
+	}
+	if pos < 0 {
+		return 0
+	}
+	return lineOf(contents, pos+1)
+}
+
+// lineOf returns the line number of a byte offset.
+func lineOf(contents []byte, offset int) int {
+	if offset > len(contents) {
+		offset = len(contents)
+	}
+	return bytes.Count(contents[:offset], []byte("\n")) + 1
+}
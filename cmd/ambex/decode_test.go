@@ -0,0 +1,156 @@
+package ambex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/require"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+)
+
+const clusterYAML = `"@type": type.googleapis.com/envoy.api.v2.Cluster
+name: foo
+connect_timeout: 1s
+load_assignment:
+  cluster_name: foo
+  endpoints:
+  - lb_endpoints:
+    - endpoint:
+        address:
+          socket_address:
+            address: %s
+            port_value: 80
+    - endpoint:
+        address:
+          socket_address:
+            address: 1.2.3.5
+            %s: 80
+`
+
+func binaryAny(t *testing.T, m proto.Message) string {
+	any, err := types.MarshalAny(m)
+	require.NoError(t, err)
+	bytes, err := proto.Marshal(any)
+	require.NoError(t, err)
+	return string(bytes)
+}
+
+func TestDecode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ambex-decode")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testcases := []struct {
+		name     string
+		contents string
+		// the error, without the file name
+		err string
+	}{
+		{"ok.yaml", fmt.Sprintf(clusterYAML, "1.2.3.4", "port_value"), ""},
+		{"ok.json", "{\"@type\": \"type.googleapis.com/envoy.api.v2.Cluster\", \"name\": \"foo\"}", ""},
+		{"ok.bin", binaryAny(t, &v2.Cluster{Name: "foo"}), ""},
+		{"syntax.json", "{\n  \"@type\": \"type.googleapis.com/envoy.api.v2.Cluster\",\n  \"name\": \"foo\",,\n}\n",
+			":3: invalid character ',' looking for beginning of object key string"},
+		{"unknown.yaml", "\"@type\": type.googleapis.com/envoy.api.v2.Cluster\nname: foo\nnonesuch: 1\n",
+			":3: nonesuch: unknown field in envoy.api.v2.Cluster"},
+		// the unknown field is in the second item of nested lists
+		{"nested.yaml", fmt.Sprintf(clusterYAML, "1.2.3.4", "port_valu"),
+			":17: load_assignment.endpoints[0].lb_endpoints[1].endpoint.address.socket_address.port_valu: " +
+				"unknown field in envoy.api.v2.core.SocketAddress"},
+		{"enum.json", "{\n  \"@type\": \"type.googleapis.com/envoy.api.v2.Cluster\",\n  \"name\": \"foo\",\n  \"lbPolicy\": \"NONESUCH\"\n}\n",
+			":4: lbPolicy: unknown value \"NONESUCH\" for enum envoy.api.v2.Cluster_LbPolicy"},
+		{"type.yaml", "\"@type\": type.googleapis.com/envoy.api.v2.Nonesuch\nname: foo\n",
+			":1: @type: unknown message type \"type.googleapis.com/envoy.api.v2.Nonesuch\""},
+		{"validation.yaml", fmt.Sprintf(clusterYAML, `""`, "port_value"),
+			":11: load_assignment.endpoints[0].lb_endpoints[0].endpoint.address.socket_address.address: " +
+				"value length must be at least 1 bytes"},
+		{"validation.json", "{\n  \"@type\": \"type.googleapis.com/envoy.api.v2.Cluster\",\n  \"name\": \"\"\n}\n",
+			":3: name: value length must be at least 1 bytes"},
+		// binary files have no lines
+		{"garbage.bin", "\xff\xff\xff", ": unexpected EOF"},
+		{"validation.bin", binaryAny(t, &v2.Cluster{}), ": name: value length must be at least 1 bytes"},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			path := filepath.Join(dir, testcase.name)
+			require.NoError(t, ioutil.WriteFile(path, []byte(testcase.contents), 0644))
+			m, err := decode(path)
+			if testcase.err == "" {
+				require.NoError(t, err)
+				require.NotNil(t, m)
+				return
+			}
+			require.EqualError(t, err, path+testcase.err)
+		})
+	}
+}
+
+func TestLocateUnlocatable(t *testing.T) {
+	testcases := []struct {
+		name string
+		m    proto.Message
+		js   string
+	}{
+		{"not an object", &v2.Cluster{}, `[1, 2]`},
+		{"not JSON", &v2.Cluster{}, `{`},
+		{"Any without a type", &types.Any{}, `{"name": "foo"}`},
+		{"Any with a bad type", &types.Any{}, `{"@type": 7}`},
+		{"fine", &v2.Cluster{}, `{"name": "foo"}`},
+		{"list that isn't", &v2.Cluster{}, `{"hosts": {"address": 7}}`},
+		{"map that isn't", &v2.Cluster{}, `{"metadata": {"filterMetadata": []}}`},
+		{"well known type", &v2.Cluster{}, `{"connectTimeout": "forever"}`},
+	}
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			require.NotPanics(t, func() {
+				path, err := locate(testcase.m, []byte(testcase.js))
+				if err == nil {
+					require.Empty(t, path)
+				}
+			})
+		})
+	}
+}
+
+func TestFindLine(t *testing.T) {
+	yaml := []byte("name: foo\nload_assignment:\n  cluster_name: foo\n")
+	json := []byte("{\n  \"name\": \"foo\",\n  \"loadAssignment\": {\n    \"clusterName\": \"foo\"\n  }\n}\n")
+
+	require.Equal(t, 1, findLine(yaml, []string{"name"}))
+	require.Equal(t, 3, findLine(yaml, []string{"load_assignment", "cluster_name"}))
+	require.Equal(t, 4, findLine(json, []string{"load_assignment", "cluster_name"}))
+	require.Equal(t, 4, findLine(json, []string{"load_assignment", "[0]", "cluster_name"}))
+
+	// what isn't there has no line
+	require.Equal(t, 0, findLine(yaml, []string{"nonesuch"}))
+	require.Equal(t, 0, findLine(yaml, []string{"cluster_name", "name"}))
+	require.Equal(t, 0, findLine(yaml, nil))
+	require.Equal(t, 0, findLine(nil, []string{"name"}))
+	require.Equal(t, 0, findLine(yaml, []string{"[0]"}))
+	// keys are quoted for the regexp
+	require.Equal(t, 0, findLine(yaml, []string{"(.*)"}))
+
+	require.Equal(t, 1, lineOf(yaml, 0))
+	require.Equal(t, 2, lineOf(yaml, 10))
+	require.Equal(t, 4, lineOf(yaml, 1000))
+}
+
+func TestValidationPath(t *testing.T) {
+	cluster := &v2.Cluster{Name: "foo", LoadAssignment: &v2.ClusterLoadAssignment{}}
+	err := cluster.Validate()
+	require.Error(t, err)
+	cause, ok := err.(validationError)
+	require.True(t, ok)
+	path, reason := validationPath(cause)
+	require.Equal(t, []string{"load_assignment", "cluster_name"}, path)
+	require.EqualError(t, reason, "value length must be at least 1 bytes")
+}
@@ -16,9 +16,15 @@ package ambex
  *   - A given SnapshotCache can hold configurations for multiple Envoys,
  *     identified by the Envoy 'node ID', which must be configured for the
  *     Envoy.
+ *   - We hand every node its own Snapshot: the one loaded from the
+ *     -node-dir for its node ID, else the one loaded from the -cluster-dir
+ *     for its node cluster, else the default one loaded from the directories
+ *     on the command line. See nodes.go.
  * - The SnapshotCache can only hold go-control-plane configuration objects,
  *   so you have to build these up to hand to the SnapshotCache.
  * - The gRPC stuff is handled by a Server.
+ *   - The Server only speaks xDS v2. v3 clients are served by translating
+ *     their requests to v2 and the responses back. See v3.go.
  *   - import github.com/datawire/ambassador/pkg/envoy-control-plane/server, then refer
  *     to server.Server.
  *   - Our runManagementServer (largely ripped off from the go-control-plane
@@ -32,10 +38,19 @@ package ambex
  *   - Whenever a newer Snapshot is added to the SnapshotCache, that Snapshot
  *     will get sent to the Envoy.
  * - We manage the SnapshotCache by loading envoy configuration from
- *   json and/or protobuf files on disk.
+ *   json, yaml and/or protobuf (text or binary) files on disk, and with
+ *   -recursive from their subdirectories too.
  *   - By default when we get a SIGHUP, we reload configuration.
  *   - When passed the -watch argument we reload whenever any file in
- *     the directory changes.
+ *     the directory changes, once things have been quiet for a while
+ *     (-quiet-period).
+ *   - Snapshot versions are a hash of the configuration, so reloading an
+ *     unchanged configuration doesn't push anything.
+ * - With -metrics we serve Prometheus metrics about streams, snapshots,
+ *   ACKs and NACKs, fed by the same callbacks. See metrics.go.
+ * - Secrets for SDS come from the same files, and with -k8s-secrets also
+ *   from Kubernetes Secrets, which are pushed as soon as they change without
+ *   touching the rest of the snapshot. See secrets.go.
  */
 
 import (
@@ -50,6 +65,7 @@ import (
 	"reflect"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
@@ -59,6 +75,9 @@ import (
 	"github.com/gogo/protobuf/jsonpb"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
+	"sigs.k8s.io/yaml"
+
+	"github.com/datawire/ambassador/pkg/limiter"
 
 	// envoy control plane
 	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
@@ -68,7 +87,7 @@ import (
 	// emits a "@type" of in the generated config, even if that package is otherwise
 	// not used by ambex.
 	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
-	_ "github.com/datawire/ambassador/pkg/api/envoy/api/v2/auth"
+	auth "github.com/datawire/ambassador/pkg/api/envoy/api/v2/auth"
 	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
 	_ "github.com/datawire/ambassador/pkg/api/envoy/config/accesslog/v2"
 	bootstrap "github.com/datawire/ambassador/pkg/api/envoy/config/bootstrap/v2"
@@ -85,6 +104,29 @@ var (
 	adsPort uint
 	watch   bool
 
+	recursive bool
+
+	quietPeriod time.Duration
+	maxDelay    time.Duration
+
+	nodeDirs    = dirMap{}
+	clusterDirs = dirMap{}
+
+	statusAddr string
+	statusFile string
+
+	transactional bool
+	rollback      bool
+
+	adminAddr     string
+	adminHTTPAddr string
+
+	metricsAddr string
+
+	k8sSecrets         bool
+	k8sSecretNamespace string
+	k8sSecretSelector  string
+
 	// Version is inserted at build using --ldflags -X
 	Version = "-no-version-"
 )
@@ -93,6 +135,21 @@ func init() {
 	flag.BoolVar(&debug, "debug", false, "Use debug logging")
 	flag.UintVar(&adsPort, "ads", 18000, "ADS port")
 	flag.BoolVar(&watch, "watch", false, "Watch for file changes")
+	flag.BoolVar(&recursive, "recursive", false, "Load files from subdirectories too")
+	flag.DurationVar(&quietPeriod, "quiet-period", 500*time.Millisecond, "With -watch, reload once no file has changed for `DURATION`")
+	flag.DurationVar(&maxDelay, "max-delay", 5*time.Second, "With -watch, reload at most `DURATION` after a change even if files keep changing")
+	flag.Var(nodeDirs, "node-dir", "Load configuration for the Envoy with node ID `ID=DIR` from DIR (may be repeated)")
+	flag.StringVar(&statusAddr, "status", "", "Serve per-node ACK/NACK status over HTTP at `ADDR`/status")
+	flag.StringVar(&statusFile, "status-file", "", "Write per-node ACK/NACK status to `FILE`")
+	flag.BoolVar(&transactional, "transactional", false, "Keep the previous snapshot if any file fails to load")
+	flag.BoolVar(&rollback, "rollback", false, "Roll back to the last snapshot every node ACKed when a snapshot is NACKed")
+	flag.Var(clusterDirs, "cluster-dir", "Load configuration for Envoys in node cluster `CLUSTER=DIR` from DIR (may be repeated)")
+	flag.StringVar(&adminAddr, "admin", "", "Serve the admin API over gRPC at `ADDR`")
+	flag.StringVar(&adminHTTPAddr, "admin-http", "", "Serve the admin API as JSON over HTTP at `ADDR`")
+	flag.StringVar(&metricsAddr, "metrics", "", "Serve Prometheus metrics over HTTP at `ADDR`/metrics")
+	flag.BoolVar(&k8sSecrets, "k8s-secrets", false, "Serve Kubernetes TLS Secrets over SDS")
+	flag.StringVar(&k8sSecretNamespace, "k8s-secret-namespace", "", "Only serve Kubernetes Secrets from `NAMESPACE` (default all namespaces)")
+	flag.StringVar(&k8sSecretSelector, "k8s-secret-selector", "", "Only serve Kubernetes Secrets matching the label `SELECTOR`")
 }
 
 // Hasher returns node ID as an ID
@@ -121,6 +178,74 @@ func (logger logger) Errorf(format string, args ...interface{}) {
 
 // end logger stuff
 
+// callbacks are the server callbacks; they log everything, register new
+// nodes so that they get their own snapshot, and keep track of what the nodes
+// did with the configuration we sent them.
+type callbacks struct {
+	logger
+	nodes  *nodeSnapshots
+	status *configStatus
+}
+
+// OnStreamClosed is called immediately prior to closing an xDS stream with a stream ID.
+func (c callbacks) OnStreamClosed(sid int64) {
+	c.logger.OnStreamClosed(sid)
+	c.status.Closed(sid)
+	metrics.Closed(sid)
+}
+
+// OnStreamRequest is called once a request is received on a stream.
+func (c callbacks) OnStreamRequest(sid int64, req *v2.DiscoveryRequest) error {
+	c.logger.OnStreamRequest(sid, req)
+	metrics.Requested(sid, req.TypeUrl)
+	c.review(req.Node, c.status.OnStreamRequest(sid, req), req.ErrorDetail != nil)
+	return c.nodes.Add(req.Node)
+}
+
+// OnStreamResponse is called immediately prior to sending a response on a stream.
+func (c callbacks) OnStreamResponse(sid int64, req *v2.DiscoveryRequest, res *v2.DiscoveryResponse) {
+	c.logger.OnStreamResponse(sid, req, res)
+	c.status.OnStreamResponse(sid, req, res)
+}
+
+// OnStreamDeltaRequest is called once an incremental request is received on a stream.
+func (c callbacks) OnStreamDeltaRequest(sid int64, req *v2.DeltaDiscoveryRequest) error {
+	c.logger.OnStreamDeltaRequest(sid, req)
+	metrics.Requested(sid, req.TypeUrl)
+	c.review(req.Node, c.status.OnStreamDeltaRequest(sid, req), req.ErrorDetail != nil)
+	return c.nodes.Add(req.Node)
+}
+
+// review acts on an ACK or NACK of a snapshot version: once every node ACKed
+// a version it becomes the last known good one, and with -rollback a NACK of
+// the current version rolls back to the last known good one.
+func (c callbacks) review(node *core.Node, version string, nacked bool) {
+	if version == "" {
+		return
+	}
+	metrics.Reviewed(Hasher{}.ID(node), nacked)
+	version = snapshotVersion(version)
+	if nacked {
+		if rollback {
+			c.nodes.Rollback(version)
+		}
+	} else if c.status.AckedByAll(version) {
+		c.nodes.MarkGood(version)
+	}
+}
+
+// OnStreamDeltaResponse is called immediately prior to sending an incremental response on a stream.
+func (c callbacks) OnStreamDeltaResponse(sid int64, req *v2.DeltaDiscoveryRequest, res *v2.DeltaDiscoveryResponse) {
+	c.logger.OnStreamDeltaResponse(sid, req, res)
+	c.status.OnStreamDeltaResponse(sid, req, res)
+}
+
+// OnFetchRequest is called for each Fetch request
+func (c callbacks) OnFetchRequest(ctx context.Context, r *v2.DiscoveryRequest) error {
+	c.logger.OnFetchRequest(ctx, r)
+	return c.nodes.Add(r.Node)
+}
+
 // run stuff
 // RunManagementServer starts an xDS server at the given port.
 func runManagementServer(ctx context.Context, server server.Server, port uint) {
@@ -137,6 +262,8 @@ func runManagementServer(ctx context.Context, server server.Server, port uint) {
 	v2.RegisterClusterDiscoveryServiceServer(grpcServer, server)
 	v2.RegisterRouteDiscoveryServiceServer(grpcServer, server)
 	v2.RegisterListenerDiscoveryServiceServer(grpcServer, server)
+	discovery.RegisterSecretDiscoveryServiceServer(grpcServer, server)
+	v3Server{server: server}.register(grpcServer)
 
 	log.WithFields(log.Fields{"port": port}).Info("Listening")
 	go func() {
@@ -156,7 +283,10 @@ func runManagementServer(ctx context.Context, server server.Server, port uint) {
 // Decoders for unmarshalling our config
 var decoders = map[string](func(string, proto.Message) error){
 	".json": jsonpb.UnmarshalString,
+	".yaml": unmarshalYAML,
+	".yml":  unmarshalYAML,
 	".pb":   proto.UnmarshalText,
+	".bin":  unmarshalBinary,
 }
 
 func isDecodable(name string) bool {
@@ -169,6 +299,46 @@ func isDecodable(name string) bool {
 	return ok
 }
 
+// listFiles lists the files in dir we can decode, including the ones in
+// subdirectories with -recursive. Hidden files and directories are skipped.
+func listFiles(dir string) ([]string, error) {
+	var filenames []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && (!recursive || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isDecodable(info.Name()) {
+			filenames = append(filenames, path)
+		}
+		return nil
+	})
+	return filenames, err
+}
+
+// watchDir watches dir, and with -recursive its subdirectories too.
+func watchDir(watcher *fsnotify.Watcher, dir string) {
+	if !recursive {
+		watcher.Add(dir)
+		return
+	}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		warn(watcher.Add(path))
+		return nil
+	})
+}
+
 // Not sure if there is a better way to do this, but we cast to this
 // so we can call the generated Validate method.
 type Validatable interface {
@@ -183,24 +353,36 @@ func decode(name string) (proto.Message, error) {
 		return nil, err
 	}
 
+	// the file as text and as JSON, if it has them, to find out where
+	// errors are
+	text, js := contents, []byte(nil)
 	ext := filepath.Ext(name)
+	switch ext {
+	case ".json":
+		js = contents
+	case ".yaml", ".yml":
+		js, _ = yaml.YAMLToJSON(contents)
+	case ".bin":
+		text = nil
+	}
+
 	decoder := decoders[ext]
 	err = decoder(string(contents), any)
 	if err != nil {
-		return nil, err
+		return nil, newDecodeError(name, text, js, any, err)
 	}
 
 	var m types.DynamicAny
 	err = types.UnmarshalAny(any, &m)
 	if err != nil {
-		return nil, err
+		return nil, newDecodeError(name, text, js, any, err)
 	}
 
 	var v = m.Message.(Validatable)
 
 	err = v.Validate()
 	if err != nil {
-		return nil, err
+		return nil, newDecodeError(name, text, js, any, err)
 	}
 	log.Infof("Loaded file %s", name)
 	return v, nil
@@ -228,34 +410,41 @@ func Clone(src proto.Message) proto.Message {
 	return dst
 }
 
-func update(config cache.SnapshotCache, generation *int, dirs []string) {
+// load builds a snapshot from the files in dirs. Files that can't be loaded
+// are skipped, and counted in the returned number of failures. The snapshot
+// has no version yet.
+func load(dirs []string) (cache.Snapshot, int) {
 	clusters := []cache.Resource{}  // v2.Cluster
 	endpoints := []cache.Resource{} // v2.ClusterLoadAssignment
 	routes := []cache.Resource{}    // v2.RouteConfiguration
 	listeners := []cache.Resource{} // v2.Listener
+	secrets := []cache.Resource{}   // auth.Secret
 
 	var filenames []string
+	failures := 0
 
 	for _, dir := range dirs {
-		files, err := ioutil.ReadDir(dir)
+		files, err := listFiles(dir)
 		if err != nil {
 			log.WithError(err).Warnf("Error listing %v", dir)
+			failures++
 			continue
 		}
-		for _, file := range files {
-			name := file.Name()
-			if isDecodable(name) {
-				filenames = append(filenames, filepath.Join(dir, name))
-			}
-		}
+		filenames = append(filenames, files...)
 	}
 
 	for _, name := range filenames {
 		m, e := decode(name)
+		if e == nil {
+			m, e = fromV3(m)
+		}
 		if e != nil {
-			log.Warnf("%s: %v", name, e)
+			log.Warn(e)
+			metrics.DecodeFailed(name)
+			failures++
 			continue
 		}
+		metrics.Decoded(name)
 		var dst *[]cache.Resource
 		switch m.(type) {
 		case *v2.Cluster:
@@ -266,6 +455,8 @@ func update(config cache.SnapshotCache, generation *int, dirs []string) {
 			dst = &routes
 		case *v2.Listener:
 			dst = &listeners
+		case *auth.Secret:
+			dst = &secrets
 		case *bootstrap.Bootstrap:
 			bs := m.(*bootstrap.Bootstrap)
 			sr := bs.StaticResources
@@ -278,27 +469,83 @@ func update(config cache.SnapshotCache, generation *int, dirs []string) {
 			continue
 		default:
 			log.Warnf("Unrecognized resource %s: %v", name, e)
+			failures++
 			continue
 		}
 		*dst = append(*dst, m.(cache.Resource))
 	}
 
-	version := fmt.Sprintf("v%d", *generation)
-	*generation++
-	snapshot := cache.NewSnapshot(version, endpoints, clusters, routes, listeners)
+	snapshot := cache.NewSnapshot("", endpoints, clusters, routes, listeners)
+	snapshot.Secrets = cache.NewResources("", secrets)
+	return snapshot, failures
+}
+
+// loadConsistent loads a snapshot, and returns false if it isn't consistent,
+// or if any file failed to load in transactional mode.
+func loadConsistent(dirs []string) (cache.Snapshot, bool) {
+	snapshot, failures := load(dirs)
+	if failures > 0 && transactional {
+		log.Errorf("%d file(s) in %v failed to load", failures, dirs)
+		return snapshot, false
+	}
+	if err := snapshot.Consistent(); err != nil {
+		log.Errorf("Snapshot inconsistency: %+v", snapshot)
+		return snapshot, false
+	}
+	return snapshot, true
+}
+
+func update(nodes *nodeSnapshots, dirs []string) {
+	start := time.Now()
+	set := snapshotSet{
+		byNode:    make(map[string]cache.Snapshot, len(nodeDirs)),
+		byCluster: make(map[string]cache.Snapshot, len(clusterDirs)),
+	}
+
+	var ok bool
+	set.fallback, ok = loadConsistent(dirs)
+	if !ok {
+		log.Errorf("Not pushing new snapshot, keeping snapshot %v", nodes.Version())
+		return
+	}
+
+	for _, id := range nodeDirs.keys() {
+		set.byNode[id], ok = loadConsistent(nodeDirs[id])
+		if !ok {
+			log.Errorf("Not pushing new snapshot, keeping snapshot %v", nodes.Version())
+			return
+		}
+	}
 
-	err := snapshot.Consistent()
+	for _, cluster := range clusterDirs.keys() {
+		set.byCluster[cluster], ok = loadConsistent(clusterDirs[cluster])
+		if !ok {
+			log.Errorf("Not pushing new snapshot, keeping snapshot %v", nodes.Version())
+			return
+		}
+	}
 
+	version, err := set.hash()
 	if err != nil {
-		log.Errorf("Snapshot inconsistency: %+v", snapshot)
-	} else {
-		err = config.SetSnapshot("test-id", snapshot)
+		log.Errorf("Snapshot error %q, keeping snapshot %v", err, nodes.Version())
+		return
+	}
+	metrics.Built(time.Since(start), set)
+	if version == nodes.Version() {
+		log.Infof("Snapshot %v unchanged, not pushing", version)
+		return
 	}
+	if nodes.Rejected(version) {
+		log.Errorf("Snapshot %v was rejected before, keeping snapshot %v", version, nodes.Version())
+		return
+	}
+	set.setVersion(version)
+
+	err = nodes.Set(set)
 
 	if err != nil {
-		log.Fatalf("Snapshot error %q for %+v", err, snapshot)
+		log.Errorf("Snapshot error %q for %+v, keeping snapshot %v", err, version, nodes.Version())
 	} else {
-		// log.Infof("Snapshot %+v", snapshot)
 		log.Infof("Pushing snapshot %+v", version)
 	}
 }
@@ -334,6 +581,17 @@ func (l logger) OnStreamResponse(sid int64, req *v2.DiscoveryRequest, res *v2.Di
 	l.Infof("Stream response[%v]: %v -> %v", sid, req, res)
 }
 
+// OnStreamDeltaRequest is called once an incremental request is received on a stream.
+func (l logger) OnStreamDeltaRequest(sid int64, req *v2.DeltaDiscoveryRequest) error {
+	l.Infof("Stream delta request[%v]: %v", sid, req)
+	return nil
+}
+
+// OnStreamDeltaResponse is called immediately prior to sending an incremental response on a stream.
+func (l logger) OnStreamDeltaResponse(sid int64, req *v2.DeltaDiscoveryRequest, res *v2.DeltaDiscoveryResponse) {
+	l.Infof("Stream delta response[%v]: %v -> %v", sid, req, res)
+}
+
 // OnFetchRequest is called for each Fetch request
 func (l logger) OnFetchRequest(_ context.Context, r *v2.DiscoveryRequest) error {
 	l.Infof("Fetch request: %v", r)
@@ -368,7 +626,14 @@ func Main() {
 
 	if watch {
 		for _, d := range dirs {
-			watcher.Add(d)
+			watchDir(watcher, d)
+		}
+		for _, m := range []dirMap{nodeDirs, clusterDirs} {
+			for _, ds := range m {
+				for _, d := range ds {
+					watchDir(watcher, d)
+				}
+			}
 		}
 	}
 
@@ -379,18 +644,44 @@ func Main() {
 	defer cancel()
 
 	config := cache.NewSnapshotCache(true, Hasher{}, logger{})
-	srv := server.NewServer(config, logger{})
+	nodes := newNodeSnapshots(config)
+	status := newConfigStatus(statusFile)
+	srv := server.NewServer(config, callbacks{nodes: nodes, status: status})
 
 	runManagementServer(ctx, srv, adsPort)
 
+	if statusAddr != "" {
+		runStatusServer(ctx, status, statusAddr)
+	}
+
+	if metricsAddr != "" {
+		runMetricsServer(ctx, metricsAddr)
+	}
+
+	runAdminServer(ctx, adminServer{config: config, nodes: nodes}, adminAddr, adminHTTPAddr)
+
 	pid := os.Getpid()
 	file := "ambex.pid"
 	if !warn(ioutil.WriteFile(file, []byte(fmt.Sprintf("%v", pid)), 0644)) {
 		log.WithFields(log.Fields{"pid": pid, "file": file}).Info("Wrote PID")
 	}
 
-	generation := 0
-	update(config, &generation, dirs)
+	var secretUpdates <-chan []cache.Resource
+	if k8sSecrets {
+		secretUpdates, err = watchSecrets(k8sSecretNamespace, k8sSecretSelector)
+		if err != nil {
+			log.WithError(err).Fatal("Error watching Kubernetes Secrets")
+		}
+	}
+
+	// file changes are coalesced, a reload happens when reload fires
+	var reloadLimiter limiter.Limiter = limiter.NewUnlimited()
+	if quietPeriod > 0 {
+		reloadLimiter = limiter.NewQuiet(quietPeriod, maxDelay)
+	}
+	var reload <-chan time.Time
+
+	update(nodes, dirs)
 
 OUTER:
 	for {
@@ -399,14 +690,34 @@ OUTER:
 		case sig := <-ch:
 			switch sig {
 			case syscall.SIGHUP:
-				update(config, &generation, dirs)
+				update(nodes, dirs)
 			case os.Interrupt, syscall.SIGTERM:
 				break OUTER
 			}
-		case <-watcher.Events:
-			update(config, &generation, dirs)
+		case event := <-watcher.Events:
+			if recursive && event.Op&fsnotify.Create != 0 {
+				// new subdirectories need watching too
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+					watchDir(watcher, event.Name)
+				}
+			}
+			delay := reloadLimiter.Limit(time.Now())
+			if delay == 0 {
+				update(nodes, dirs)
+			} else if delay > 0 {
+				reload = time.After(delay)
+			}
+		case <-reload:
+			reload = nil
+			update(nodes, dirs)
 		case err := <-watcher.Errors:
 			log.WithError(err).Warn("Watcher error")
+		case secrets := <-secretUpdates:
+			if err := nodes.SetSecrets(secrets); err != nil {
+				log.Errorf("Snapshot error %q pushing %d Kubernetes secret(s)", err, len(secrets))
+			} else {
+				log.Infof("Pushing %d Kubernetes secret(s)", len(secrets))
+			}
 		}
 
 	}
@@ -0,0 +1,270 @@
+package ambex
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+)
+
+// buildBuckets are the histogram buckets for snapshot build durations, in
+// seconds.
+var buildBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ambexMetrics are the control plane metrics, served in the Prometheus text
+// format. They are fed by the server callbacks and by update.
+type ambexMetrics struct {
+	mu sync.Mutex
+
+	// streamTypes is the type URLs requested on each open stream; an ADS
+	// stream requests several
+	streamTypes map[int64]map[string]bool
+
+	pushes map[string]int
+
+	buildCounts []int // per bucket, the last one is +Inf
+	buildSum    float64
+	buildCount  int
+	resources   map[string]int
+	bytes       int
+
+	// decodeFailures is by file, until it loads again, so that it
+	// doesn't grow a series for every file that ever failed
+	decodeFailures map[string]int
+
+	acks    map[string]int
+	nacks   map[string]int
+	lastAck map[string]time.Time
+}
+
+var metrics = newAmbexMetrics()
+
+func newAmbexMetrics() *ambexMetrics {
+	return &ambexMetrics{
+		streamTypes:    make(map[int64]map[string]bool),
+		pushes:         make(map[string]int),
+		buildCounts:    make([]int, len(buildBuckets)+1),
+		resources:      make(map[string]int),
+		decodeFailures: make(map[string]int),
+		acks:           make(map[string]int),
+		nacks:          make(map[string]int),
+		lastAck:        make(map[string]time.Time),
+	}
+}
+
+// Requested records that a stream requested a type.
+func (m *ambexMetrics) Requested(sid int64, typeURL string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	types, ok := m.streamTypes[sid]
+	if !ok {
+		types = make(map[string]bool)
+		m.streamTypes[sid] = types
+	}
+	types[typeURL] = true
+}
+
+// Closed forgets about a stream.
+func (m *ambexMetrics) Closed(sid int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streamTypes, sid)
+}
+
+// Reviewed counts an ACK or NACK from a node.
+func (m *ambexMetrics) Reviewed(id string, nacked bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if nacked {
+		m.nacks[id]++
+	} else {
+		m.acks[id]++
+		m.lastAck[id] = time.Now()
+	}
+}
+
+// Pushed counts a snapshot pushed to a node.
+func (m *ambexMetrics) Pushed(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pushes[id]++
+}
+
+// DecodeFailed counts a file that failed to load.
+func (m *ambexMetrics) DecodeFailed(file string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decodeFailures[file]++
+}
+
+// Decoded forgets the failures of a file that loads again.
+func (m *ambexMetrics) Decoded(file string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.decodeFailures, file)
+}
+
+// Built records how long a snapshot set took to build, and its size: the
+// resources of every snapshot in the set, by type.
+func (m *ambexMetrics) Built(duration time.Duration, set snapshotSet) {
+	resources := make(map[string]int)
+	bytes := 0
+	add := func(snapshot cache.Snapshot) {
+		for _, typeURL := range cache.ResponseTypes {
+			items := snapshot.GetResources(typeURL)
+			resources[typeURL] += len(items)
+			for _, item := range items {
+				bytes += proto.Size(item)
+			}
+		}
+	}
+	add(set.fallback)
+	for _, snapshot := range set.byNode {
+		add(snapshot)
+	}
+	for _, snapshot := range set.byCluster {
+		add(snapshot)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(buildBuckets, seconds)
+	m.buildCounts[i]++
+	m.buildSum += seconds
+	m.buildCount++
+	m.resources = resources
+	m.bytes = bytes
+}
+
+// labelEscaper escapes label values the way the Prometheus text format
+// does, which is not the way Go quotes strings.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats a set of label values.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// sortedCounts returns the keys of a map of counts, sorted.
+func sortedCounts(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *ambexMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	counts := func(name, label string, values map[string]int) {
+		for _, key := range sortedCounts(values) {
+			fmt.Fprintf(out, "%s%s %d\n", name, labels(label, key), values[key])
+		}
+	}
+
+	streams := make(map[string]int)
+	for _, types := range m.streamTypes {
+		for typeURL := range types {
+			streams[typeURL]++
+		}
+	}
+	metric("ambex_streams", "gauge", "Open xDS streams that requested each type URL.")
+	counts("ambex_streams", "type_url", streams)
+
+	metric("ambex_snapshot_pushes_total", "counter", "Snapshots pushed to each node.")
+	counts("ambex_snapshot_pushes_total", "node", m.pushes)
+
+	metric("ambex_snapshot_build_duration_seconds", "histogram", "Time to load and build a snapshot.")
+	cumulative := 0
+	for i, bound := range buildBuckets {
+		cumulative += m.buildCounts[i]
+		fmt.Fprintf(out, "ambex_snapshot_build_duration_seconds_bucket%s %d\n",
+			labels("le", strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+	}
+	fmt.Fprintf(out, "ambex_snapshot_build_duration_seconds_bucket%s %d\n", labels("le", "+Inf"), m.buildCount)
+	fmt.Fprintf(out, "ambex_snapshot_build_duration_seconds_sum %g\n", m.buildSum)
+	fmt.Fprintf(out, "ambex_snapshot_build_duration_seconds_count %d\n", m.buildCount)
+
+	metric("ambex_snapshot_resources", "gauge", "Resources of each type URL in the last snapshot built.")
+	counts("ambex_snapshot_resources", "type_url", m.resources)
+
+	metric("ambex_snapshot_bytes", "gauge", "Encoded size of the resources in the last snapshot built.")
+	fmt.Fprintf(out, "ambex_snapshot_bytes %d\n", m.bytes)
+
+	metric("ambex_decode_failures_total", "counter", "Failures to load each file, since it last loaded.")
+	counts("ambex_decode_failures_total", "file", m.decodeFailures)
+
+	metric("ambex_acks_total", "counter", "Responses ACKed by each node.")
+	counts("ambex_acks_total", "node", m.acks)
+
+	metric("ambex_nacks_total", "counter", "Responses NACKed by each node.")
+	counts("ambex_nacks_total", "node", m.nacks)
+
+	now := time.Now()
+	metric("ambex_seconds_since_last_ack", "gauge", "Time since each node last ACKed a response.")
+	ids := make([]string, 0, len(m.lastAck))
+	for id := range m.lastAck {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintf(out, "ambex_seconds_since_last_ack%s %g\n", labels("node", id), now.Sub(m.lastAck[id]).Seconds())
+	}
+}
+
+// runMetricsServer serves the metrics over HTTP at the given address.
+func runMetricsServer(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	srv := &http.Server{Handler: mux}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.WithError(err).Fatal("failed to listen")
+	}
+
+	log.WithFields(log.Fields{"addr": addr}).Info("Serving metrics")
+	go func() {
+		go func() {
+			err := srv.Serve(lis)
+
+			if err != nil && err != http.ErrServerClosed {
+				log.WithFields(log.Fields{"error": err}).Error("Metrics server exited")
+			}
+		}()
+
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+}
@@ -0,0 +1,177 @@
+package ambex
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/test/resource"
+)
+
+// sample is one line of the Prometheus text format.
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parseLabels parses `{a="b",c="d"}` at the start of s, undoing the
+// escaping of the text format, and returns the rest of s.
+func parseLabels(t *testing.T, s string) (map[string]string, string) {
+	labels := make(map[string]string)
+	if !strings.HasPrefix(s, "{") {
+		return labels, s
+	}
+	s = s[1:]
+	for !strings.HasPrefix(s, "}") {
+		eq := strings.Index(s, `="`)
+		require.True(t, eq > 0, "no label value in %q", s)
+		name := s[:eq]
+		s = s[eq+2:]
+		var value strings.Builder
+		for {
+			require.NotEmpty(t, s, "unterminated label value")
+			c := s[0]
+			s = s[1:]
+			if c == '"' {
+				break
+			}
+			require.NotEqual(t, byte('\n'), c)
+			if c == '\\' {
+				require.NotEmpty(t, s, "unterminated escape")
+				switch s[0] {
+				case '\\', '"':
+					value.WriteByte(s[0])
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					t.Fatalf("bad escape \\%c", s[0])
+				}
+				s = s[1:]
+				continue
+			}
+			value.WriteByte(c)
+		}
+		labels[name] = value.String()
+		s = strings.TrimPrefix(s, ",")
+	}
+	return labels, s[1:]
+}
+
+// parseMetrics parses the text format, checking that every sample belongs to
+// a metric with a HELP and a TYPE.
+func parseMetrics(t *testing.T, text string) []sample {
+	types := make(map[string]string)
+	var samples []sample
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# ") {
+			fields := strings.SplitN(line, " ", 4)
+			require.Len(t, fields, 4, line)
+			if fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			} else {
+				require.Equal(t, "HELP", fields[1], line)
+			}
+			continue
+		}
+		end := strings.IndexAny(line, "{ ")
+		require.True(t, end > 0, line)
+		s := sample{name: line[:end]}
+		var rest string
+		s.labels, rest = parseLabels(t, line[end:])
+		value, err := strconv.ParseFloat(strings.TrimPrefix(rest, " "), 64)
+		require.NoError(t, err, line)
+		s.value = value
+
+		family := s.name
+		if types[family] == "" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				family = strings.TrimSuffix(family, suffix)
+			}
+			require.Equal(t, "histogram", types[family], "%s has no TYPE", s.name)
+		}
+		samples = append(samples, s)
+	}
+	require.NoError(t, scanner.Err())
+	return samples
+}
+
+// find returns the value of a sample, or -1 if there's no such sample.
+func find(samples []sample, name string, labels map[string]string) float64 {
+	for _, s := range samples {
+		if s.name != name || len(s.labels) != len(labels) {
+			continue
+		}
+		match := true
+		for key, value := range labels {
+			if s.labels[key] != value {
+				match = false
+			}
+		}
+		if match {
+			return s.value
+		}
+	}
+	return -1
+}
+
+func TestMetrics(t *testing.T) {
+	m := newAmbexMetrics()
+	m.Requested(1, cache.ClusterType)
+	m.Requested(1, cache.EndpointType)
+	m.Requested(2, cache.ClusterType)
+	m.Requested(3, cache.ListenerType)
+	m.Closed(3)
+
+	// node IDs are whatever Envoy says they are
+	odd := "odd \"node\"\\\nid"
+	m.Pushed(odd)
+	m.Pushed(odd)
+	m.Reviewed(odd, false)
+	m.Reviewed(odd, true)
+
+	m.DecodeFailed("/etc/ambex/a.yaml")
+	m.DecodeFailed("/etc/ambex/a.yaml")
+	m.DecodeFailed("/etc/ambex/b.json")
+	m.DecodeFailed("/etc/ambex/node/c.json")
+	// fixed
+	m.Decoded("/etc/ambex/b.json")
+
+	m.Built(30*time.Millisecond, snapshotSet{
+		fallback: cache.NewSnapshot("", nil,
+			[]cache.Resource{resource.MakeCluster(resource.Ads, "a"), resource.MakeCluster(resource.Ads, "b")}, nil, nil),
+	})
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4", w.Header().Get("Content-Type"))
+	samples := parseMetrics(t, w.Body.String())
+
+	require.Equal(t, 2.0, find(samples, "ambex_streams", map[string]string{"type_url": cache.ClusterType}))
+	require.Equal(t, 1.0, find(samples, "ambex_streams", map[string]string{"type_url": cache.EndpointType}))
+	require.Equal(t, -1.0, find(samples, "ambex_streams", map[string]string{"type_url": cache.ListenerType}))
+
+	require.Equal(t, 2.0, find(samples, "ambex_snapshot_pushes_total", map[string]string{"node": odd}))
+	require.Equal(t, 1.0, find(samples, "ambex_acks_total", map[string]string{"node": odd}))
+	require.Equal(t, 1.0, find(samples, "ambex_nacks_total", map[string]string{"node": odd}))
+	require.True(t, find(samples, "ambex_seconds_since_last_ack", map[string]string{"node": odd}) >= 0)
+
+	require.Equal(t, 2.0, find(samples, "ambex_decode_failures_total", map[string]string{"file": "/etc/ambex/a.yaml"}))
+	require.Equal(t, 1.0, find(samples, "ambex_decode_failures_total", map[string]string{"file": "/etc/ambex/node/c.json"}))
+	require.Equal(t, -1.0, find(samples, "ambex_decode_failures_total", map[string]string{"file": "/etc/ambex/b.json"}))
+
+	require.Equal(t, 0.0, find(samples, "ambex_snapshot_build_duration_seconds_bucket", map[string]string{"le": "0.025"}))
+	require.Equal(t, 1.0, find(samples, "ambex_snapshot_build_duration_seconds_bucket", map[string]string{"le": "0.05"}))
+	require.Equal(t, 1.0, find(samples, "ambex_snapshot_build_duration_seconds_bucket", map[string]string{"le": "+Inf"}))
+	require.Equal(t, 1.0, find(samples, "ambex_snapshot_build_duration_seconds_count", nil))
+	require.Equal(t, 2.0, find(samples, "ambex_snapshot_resources", map[string]string{"type_url": cache.ClusterType}))
+	require.True(t, find(samples, "ambex_snapshot_bytes", nil) > 0)
+}
@@ -0,0 +1,367 @@
+package ambex
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+)
+
+// dirMap is a repeatable "key=dir" command line flag, used to map an Envoy
+// node ID or node cluster to the directories holding its configuration.
+type dirMap map[string][]string
+
+func (m dirMap) String() string {
+	var parts []string
+	for _, key := range m.keys() {
+		for _, dir := range m[key] {
+			parts = append(parts, key+"="+dir)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m dirMap) Set(value string) error {
+	eq := strings.Index(value, "=")
+	if eq <= 0 || eq == len(value)-1 {
+		return fmt.Errorf("expected KEY=DIR, got %q", value)
+	}
+	key, dir := value[:eq], value[eq+1:]
+	m[key] = append(m[key], dir)
+	return nil
+}
+
+func (m dirMap) keys() []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// snapshotSet is everything loaded by one update: the fallback snapshot, and
+// the snapshots for specific node IDs and node clusters.
+type snapshotSet struct {
+	version   string
+	fallback  cache.Snapshot
+	byNode    map[string]cache.Snapshot
+	byCluster map[string]cache.Snapshot
+}
+
+// lookup returns the snapshot for a node.
+func (set *snapshotSet) lookup(id string, node *core.Node) cache.Snapshot {
+	if snapshot, ok := set.byNode[id]; ok {
+		return snapshot
+	}
+	if snapshot, ok := set.byCluster[node.GetCluster()]; ok {
+		return snapshot
+	}
+	return set.fallback
+}
+
+// hash returns a version for the set derived from the contents of its
+// snapshots, so that loading the same configuration twice gives the same
+// version.
+func (set *snapshotSet) hash() (string, error) {
+	h := sha256.New()
+
+	add := func(label string, snapshot cache.Snapshot) error {
+		fmt.Fprintf(h, "%s\n", label)
+		for _, typeURL := range cache.ResponseTypes {
+			items := snapshot.GetResources(typeURL)
+			names := make([]string, 0, len(items))
+			for name := range items {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				hash, err := cache.HashResource(items[name])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, "%s %s %s\n", typeURL, name, hash)
+			}
+		}
+		return nil
+	}
+
+	if err := add("fallback", set.fallback); err != nil {
+		return "", err
+	}
+	for _, id := range sortedKeys(set.byNode) {
+		if err := add("node "+id, set.byNode[id]); err != nil {
+			return "", err
+		}
+	}
+	for _, cluster := range sortedKeys(set.byCluster) {
+		if err := add("cluster "+cluster, set.byCluster[cluster]); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)[:8]), nil
+}
+
+// setVersion sets the version of the set and of all its snapshots.
+func (set *snapshotSet) setVersion(version string) {
+	set.version = version
+	for _, resources := range allResources(&set.fallback) {
+		resources.Version = version
+	}
+	for _, m := range []map[string]cache.Snapshot{set.byNode, set.byCluster} {
+		for key, snapshot := range m {
+			for _, resources := range allResources(&snapshot) {
+				resources.Version = version
+			}
+			m[key] = snapshot
+		}
+	}
+}
+
+func sortedKeys(m map[string]cache.Snapshot) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// allResources returns the resources of every type in a snapshot.
+func allResources(snapshot *cache.Snapshot) []*cache.Resources {
+	return []*cache.Resources{
+		&snapshot.Endpoints, &snapshot.Clusters, &snapshot.Routes, &snapshot.Listeners, &snapshot.Secrets,
+	}
+}
+
+// nodeSnapshots hands out a separate snapshot to every Envoy node that talks
+// to us. A node gets the snapshot built for its node ID if there is one,
+// otherwise the snapshot built for its cluster, otherwise the fallback
+// snapshot built from the default directories.
+//
+// The SnapshotCache only knows about node IDs, so we have to remember every
+// node we have seen in order to push new snapshots to it on reload.
+//
+// We also remember the last set of snapshots that every node ACKed, so that
+// we can roll back to it, and the last version a node NACKed, so that
+// reloading the same files doesn't push it again only to roll back again.
+//
+// Secrets watched in Kubernetes are added to every snapshot. They change
+// independently of the files, so they get their own generation, which is
+// only folded into the version of the secrets.
+//
+// Forced pushes work the same way: the number of times a node was pushed to
+// is folded into the versions of its snapshot, since the cache only sends
+// versions a node doesn't have yet. See snapshotVersion.
+type nodeSnapshots struct {
+	config cache.SnapshotCache
+
+	mu      sync.Mutex
+	nodes   map[string]*core.Node
+	current *snapshotSet
+	good    *snapshotSet
+	// rejected is the version of the last snapshots a node NACKed
+	rejected string
+
+	secrets           []cache.Resource
+	secretsGeneration int
+
+	pushes map[string]int
+}
+
+func newNodeSnapshots(config cache.SnapshotCache) *nodeSnapshots {
+	return &nodeSnapshots{
+		config: config,
+		nodes:  make(map[string]*core.Node),
+		pushes: make(map[string]int),
+	}
+}
+
+// snapshotVersion returns the version of the snapshot set a resource version
+// came from, without what we add for Kubernetes secrets and forced pushes.
+func snapshotVersion(version string) string {
+	if dot := strings.Index(version, "."); dot >= 0 {
+		return version[:dot]
+	}
+	return version
+}
+
+// Add registers a node, and gives it its snapshot if this is the first time
+// we have seen it. It is called before the server creates any watch for the
+// node, so the node's first request is answered from the right snapshot.
+func (n *nodeSnapshots) Add(node *core.Node) error {
+	id := Hasher{}.ID(node)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.nodes[id]; ok {
+		return nil
+	}
+	n.nodes[id] = node
+
+	log.WithFields(log.Fields{"node": id, "cluster": node.GetCluster()}).Info("New node")
+
+	return n.push(id, node)
+}
+
+// Set replaces every snapshot we know about and pushes the new ones to all
+// known nodes. If that fails, the previous snapshots are put back.
+func (n *nodeSnapshots) Set(set snapshotSet) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	prev := n.current
+	n.current = &set
+
+	if err := n.pushAll(); err != nil {
+		n.current = prev
+		if prev != nil {
+			n.pushAll()
+		}
+		return err
+	}
+	return nil
+}
+
+// SetSecrets replaces the Kubernetes secrets and pushes them to all known
+// nodes, unless they didn't change. The watch calls back whenever anything
+// about a Secret changes, even what we don't use.
+func (n *nodeSnapshots) SetSecrets(secrets []cache.Resource) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.secretsGeneration > 0 && sameSecrets(n.secrets, secrets) {
+		return nil
+	}
+	n.secrets = secrets
+	n.secretsGeneration++
+
+	return n.pushAll()
+}
+
+// Push sends the current snapshot to a node again, or to all known nodes if
+// id is empty, even though they already have it. It returns the nodes pushed
+// to.
+func (n *nodeSnapshots) Push(id string) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var ids []string
+	if id == "" {
+		for id := range n.nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	} else if _, ok := n.nodes[id]; ok {
+		ids = []string{id}
+	} else {
+		return nil, fmt.Errorf("unknown node %q", id)
+	}
+
+	for _, id := range ids {
+		n.pushes[id]++
+		if err := n.push(id, n.nodes[id]); err != nil {
+			return nil, err
+		}
+		log.WithFields(log.Fields{"node": id}).Info("Forced push")
+	}
+	return ids, nil
+}
+
+// Version returns the version of the current snapshots.
+func (n *nodeSnapshots) Version() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.current == nil {
+		return ""
+	}
+	return n.current.version
+}
+
+// Rejected checks whether a version is the one a node last NACKed.
+func (n *nodeSnapshots) Rejected(version string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return version != "" && version == n.rejected
+}
+
+// MarkGood records that every node ACKed a version, which makes it the one to
+// roll back to if it is still current.
+func (n *nodeSnapshots) MarkGood(version string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.current == nil || n.current.version != version || n.good == n.current {
+		return
+	}
+	n.good = n.current
+	log.Infof("Snapshot %v is good", version)
+}
+
+// Rollback goes back to the last snapshots every node ACKed, if a node NACKed
+// the current version.
+func (n *nodeSnapshots) Rollback(version string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.current == nil || n.current.version != version {
+		// an old version, we've moved on already
+		return
+	}
+	n.rejected = version
+	if n.good == nil || n.good == n.current {
+		log.Errorf("Snapshot %v was rejected, but there is no good snapshot to roll back to", version)
+		return
+	}
+
+	log.Errorf("Snapshot %v was rejected, rolling back to snapshot %v", version, n.good.version)
+	n.current = n.good
+	if err := n.pushAll(); err != nil {
+		log.Errorf("Snapshot error %q rolling back to %v", err, n.good.version)
+	}
+}
+
+// pushAll must be called with the lock held.
+func (n *nodeSnapshots) pushAll() error {
+	for id, node := range n.nodes {
+		if err := n.push(id, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push must be called with the lock held.
+func (n *nodeSnapshots) push(id string, node *core.Node) error {
+	if n.current == nil {
+		// Nothing loaded yet, the watch stays open until the first
+		// update.
+		return nil
+	}
+	snapshot := n.current.lookup(id, node)
+	if n.secretsGeneration > 0 {
+		version := fmt.Sprintf("%s.s%d", snapshot.Secrets.Version, n.secretsGeneration)
+		snapshot = withSecrets(snapshot, version, n.secrets)
+	}
+	if pushes := n.pushes[id]; pushes > 0 {
+		suffix := fmt.Sprintf(".p%d", pushes)
+		for _, resources := range allResources(&snapshot) {
+			resources.Version += suffix
+		}
+	}
+	if err := n.config.SetSnapshot(id, snapshot); err != nil {
+		return err
+	}
+	metrics.Pushed(id)
+	return nil
+}
@@ -0,0 +1,158 @@
+package ambex
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	rpc "istio.io/gogo-genproto/googleapis/google/rpc"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/test/resource"
+)
+
+// clusterSet returns a snapshot set holding one cluster, versioned the way
+// update versions it.
+func clusterSet(t *testing.T, name string) snapshotSet {
+	set := snapshotSet{
+		fallback: cache.NewSnapshot("", nil, []cache.Resource{resource.MakeCluster(resource.Ads, name)}, nil, nil),
+	}
+	version, err := set.hash()
+	require.NoError(t, err)
+	set.setVersion(version)
+	return set
+}
+
+// envoyNode is a node on a stream, which answers what we send it.
+type envoyNode struct {
+	t     *testing.T
+	c     callbacks
+	sid   int64
+	node  *core.Node
+	nonce int
+}
+
+// respond sends the node the version of the clusters it has, and returns the
+// nonce of the response.
+func (e *envoyNode) respond() string {
+	snapshot, err := e.c.nodes.config.GetSnapshot(e.node.Id)
+	require.NoError(e.t, err)
+	e.nonce++
+	nonce := strconv.Itoa(e.nonce)
+	req := &v2.DiscoveryRequest{Node: e.node, TypeUrl: cache.ClusterType}
+	e.c.OnStreamResponse(e.sid, req, &v2.DiscoveryResponse{
+		VersionInfo: snapshot.GetVersion(cache.ClusterType),
+		TypeUrl:     cache.ClusterType,
+		Nonce:       nonce,
+	})
+	return nonce
+}
+
+func (e *envoyNode) ack(nonce, version string) {
+	require.NoError(e.t, e.c.OnStreamRequest(e.sid, &v2.DiscoveryRequest{
+		Node:          e.node,
+		TypeUrl:       cache.ClusterType,
+		VersionInfo:   version,
+		ResponseNonce: nonce,
+	}))
+}
+
+func (e *envoyNode) nack(nonce, version string) {
+	require.NoError(e.t, e.c.OnStreamRequest(e.sid, &v2.DiscoveryRequest{
+		Node:          e.node,
+		TypeUrl:       cache.ClusterType,
+		VersionInfo:   version,
+		ResponseNonce: nonce,
+		ErrorDetail:   &rpc.Status{Message: "nope"},
+	}))
+}
+
+func newEnvoyNodes(t *testing.T, ids ...string) (*nodeSnapshots, []*envoyNode) {
+	nodes := newNodeSnapshots(cache.NewSnapshotCache(true, Hasher{}, nil))
+	c := callbacks{nodes: nodes, status: newConfigStatus("")}
+	var envoys []*envoyNode
+	for idx, id := range ids {
+		node := &core.Node{Id: id}
+		require.NoError(t, c.OnStreamRequest(int64(idx+1), &v2.DiscoveryRequest{Node: node, TypeUrl: cache.ClusterType}))
+		envoys = append(envoys, &envoyNode{t: t, c: c, sid: int64(idx + 1), node: node})
+	}
+	return nodes, envoys
+}
+
+func withRollback(t *testing.T) func() {
+	saved := rollback
+	rollback = true
+	return func() { rollback = saved }
+}
+
+func TestMarkGoodAckedByAll(t *testing.T) {
+	nodes, envoys := newEnvoyNodes(t, "a", "b")
+	first := clusterSet(t, "first")
+	require.NoError(t, nodes.Set(first))
+
+	nonceA := envoys[0].respond()
+	nonceB := envoys[1].respond()
+
+	// one ACK isn't enough
+	envoys[0].ack(nonceA, first.version)
+	require.Nil(t, nodes.good)
+
+	envoys[1].ack(nonceB, first.version)
+	require.Equal(t, first.version, nodes.good.version)
+
+	// a new version isn't good until it's been ACKed as well
+	second := clusterSet(t, "second")
+	require.NoError(t, nodes.Set(second))
+	nonceA = envoys[0].respond()
+	envoys[0].ack(nonceA, second.version)
+	require.Equal(t, first.version, nodes.good.version)
+}
+
+func TestRollback(t *testing.T) {
+	defer withRollback(t)()
+	nodes, envoys := newEnvoyNodes(t, "a")
+	envoy := envoys[0]
+
+	first := clusterSet(t, "first")
+	require.NoError(t, nodes.Set(first))
+	envoy.ack(envoy.respond(), first.version)
+	require.Equal(t, first.version, nodes.good.version)
+
+	bad := clusterSet(t, "bad")
+	require.NoError(t, nodes.Set(bad))
+	envoy.nack(envoy.respond(), first.version)
+
+	// back to what was ACKed, and the node gets it
+	require.Equal(t, first.version, nodes.Version())
+	snapshot, err := nodes.config.GetSnapshot("a")
+	require.NoError(t, err)
+	require.Equal(t, first.version, snapshot.GetVersion(cache.ClusterType))
+
+	// reloading the same files doesn't push them again
+	require.True(t, nodes.Rejected(bad.version))
+	require.False(t, nodes.Rejected(first.version))
+	require.False(t, nodes.Rejected(""))
+
+	// a NACK of a version we've moved on from is ignored
+	second := clusterSet(t, "second")
+	require.NoError(t, nodes.Set(second))
+	nodes.Rollback(bad.version)
+	require.Equal(t, second.version, nodes.Version())
+}
+
+func TestRollbackWithoutGood(t *testing.T) {
+	defer withRollback(t)()
+	nodes, envoys := newEnvoyNodes(t, "a")
+	envoy := envoys[0]
+
+	bad := clusterSet(t, "bad")
+	require.NoError(t, nodes.Set(bad))
+	envoy.nack(envoy.respond(), "")
+
+	// there's nothing to go back to, so the node keeps what it has
+	require.Nil(t, nodes.good)
+	require.Equal(t, bad.version, nodes.Version())
+	require.True(t, nodes.Rejected(bad.version))
+}
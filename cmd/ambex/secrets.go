@@ -0,0 +1,138 @@
+package ambex
+
+import (
+	"encoding/base64"
+	"sort"
+
+	"github.com/gogo/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+
+	auth "github.com/datawire/ambassador/pkg/api/envoy/api/v2/auth"
+	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+	"github.com/datawire/ambassador/pkg/k8s"
+)
+
+// Keys of the Kubernetes Secret data we know what to do with.
+const (
+	secretCertKey = "tls.crt"
+	secretKeyKey  = "tls.key"
+	secretCAKey   = "ca.crt"
+)
+
+// inlineBytes wraps secret material in a DataSource.
+func inlineBytes(b []byte) *core.DataSource {
+	return &core.DataSource{Specifier: &core.DataSource_InlineBytes{InlineBytes: b}}
+}
+
+// secretData returns the decoded data for a key of a Kubernetes Secret.
+func secretData(secret k8s.Resource, key string) ([]byte, bool) {
+	encoded := k8s.Map(secret.Data()).GetString(key)
+	if encoded == "" {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.WithError(err).Warnf("Secret %s: bad %s", secret.QName(), key)
+		return nil, false
+	}
+	return decoded, true
+}
+
+// convertSecrets turns Kubernetes Secrets into SDS secrets:
+//
+//   - a Secret with a tls.crt and a tls.key becomes a TLS certificate named
+//     NAME.NAMESPACE, and
+//   - a Secret with a ca.crt becomes a validation context named
+//     NAME.NAMESPACE-ca.
+//
+// Other Secrets are ignored.
+func convertSecrets(secrets []k8s.Resource) []cache.Resource {
+	var out []cache.Resource
+
+	for _, secret := range secrets {
+		name := secret.QName()
+
+		cert, hasCert := secretData(secret, secretCertKey)
+		key, hasKey := secretData(secret, secretKeyKey)
+		if hasCert && hasKey {
+			out = append(out, &auth.Secret{
+				Name: name,
+				Type: &auth.Secret_TlsCertificate{
+					TlsCertificate: &auth.TlsCertificate{
+						CertificateChain: inlineBytes(cert),
+						PrivateKey:       inlineBytes(key),
+					},
+				},
+			})
+		}
+
+		if ca, ok := secretData(secret, secretCAKey); ok {
+			out = append(out, &auth.Secret{
+				Name: name + "-ca",
+				Type: &auth.Secret_ValidationContext{
+					ValidationContext: &auth.CertificateValidationContext{
+						TrustedCa: inlineBytes(ca),
+					},
+				},
+			})
+		}
+	}
+
+	// keep the order stable, so the same Secrets make the same snapshot
+	sort.Slice(out, func(i, j int) bool {
+		return cache.GetResourceName(out[i]) < cache.GetResourceName(out[j])
+	})
+
+	return out
+}
+
+// sameSecrets tells whether two lists of converted secrets are the same,
+// which convertSecrets keeps in order.
+func sameSecrets(a, b []cache.Resource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchSecrets watches Kubernetes Secrets, and sends the converted SDS
+// secrets on the returned channel whenever they change.
+func watchSecrets(namespace, labelSelector string) (<-chan []cache.Resource, error) {
+	client, err := k8s.NewClient(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []cache.Resource)
+	watcher := client.Watcher()
+	err = watcher.SelectiveWatch(namespace, "secrets", "", labelSelector, func(w *k8s.Watcher) {
+		ch <- convertSecrets(w.List("secrets"))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go watcher.Wait()
+
+	return ch, nil
+}
+
+// withSecrets returns a copy of a snapshot with extra secrets added. Secrets
+// from the snapshot win over extra secrets of the same name.
+func withSecrets(snapshot cache.Snapshot, version string, extra []cache.Resource) cache.Snapshot {
+	items := make(map[string]cache.Resource, len(snapshot.Secrets.Items)+len(extra))
+	for _, secret := range extra {
+		items[cache.GetResourceName(secret)] = secret
+	}
+	for name, secret := range snapshot.Secrets.Items {
+		items[name] = secret
+	}
+	snapshot.Secrets = cache.Resources{Version: version, Items: items}
+	return snapshot
+}
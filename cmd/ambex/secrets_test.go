@@ -0,0 +1,174 @@
+package ambex
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	auth "github.com/datawire/ambassador/pkg/api/envoy/api/v2/auth"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+	"github.com/datawire/ambassador/pkg/k8s"
+)
+
+// kubeSecret returns a Kubernetes Secret in the default namespace with the
+// given data, base64 encoded the way the API server has it.
+func kubeSecret(name string, data map[string]string) k8s.Resource {
+	encoded := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		encoded[k] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	return k8s.Resource{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"data":       encoded,
+	}
+}
+
+func tlsSecret(name, cert, key string) *auth.Secret {
+	return &auth.Secret{
+		Name: name,
+		Type: &auth.Secret_TlsCertificate{
+			TlsCertificate: &auth.TlsCertificate{
+				CertificateChain: inlineBytes([]byte(cert)),
+				PrivateKey:       inlineBytes([]byte(key)),
+			},
+		},
+	}
+}
+
+func caSecret(name, ca string) *auth.Secret {
+	return &auth.Secret{
+		Name: name,
+		Type: &auth.Secret_ValidationContext{
+			ValidationContext: &auth.CertificateValidationContext{TrustedCa: inlineBytes([]byte(ca))},
+		},
+	}
+}
+
+func TestConvertSecrets(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		secrets []k8s.Resource
+		out     []cache.Resource
+	}{
+		{
+			name:    "certificate",
+			secrets: []k8s.Resource{kubeSecret("foo", map[string]string{"tls.crt": "CERT", "tls.key": "KEY"})},
+			out:     []cache.Resource{tlsSecret("foo.default", "CERT", "KEY")},
+		},
+		{
+			name:    "ca",
+			secrets: []k8s.Resource{kubeSecret("foo", map[string]string{"ca.crt": "CA"})},
+			out:     []cache.Resource{caSecret("foo.default-ca", "CA")},
+		},
+		{
+			name:    "both",
+			secrets: []k8s.Resource{kubeSecret("foo", map[string]string{"tls.crt": "CERT", "tls.key": "KEY", "ca.crt": "CA"})},
+			out:     []cache.Resource{tlsSecret("foo.default", "CERT", "KEY"), caSecret("foo.default-ca", "CA")},
+		},
+		{
+			name:    "no key",
+			secrets: []k8s.Resource{kubeSecret("foo", map[string]string{"tls.crt": "CERT"})},
+		},
+		{
+			name:    "no certificate",
+			secrets: []k8s.Resource{kubeSecret("foo", map[string]string{"tls.key": "KEY"})},
+		},
+		{
+			name: "not base64",
+			secrets: []k8s.Resource{{
+				"kind":     "Secret",
+				"metadata": map[string]interface{}{"name": "foo", "namespace": "default"},
+				"data":     map[string]interface{}{"tls.crt": "!!!", "tls.key": "!!!"},
+			}},
+		},
+		{
+			name:    "other data",
+			secrets: []k8s.Resource{kubeSecret("foo", map[string]string{"password": "hunter2"})},
+		},
+		{
+			name: "sorted",
+			secrets: []k8s.Resource{
+				kubeSecret("b", map[string]string{"tls.crt": "B", "tls.key": "B"}),
+				kubeSecret("a", map[string]string{"tls.crt": "A", "tls.key": "A"}),
+			},
+			out: []cache.Resource{tlsSecret("a.default", "A", "A"), tlsSecret("b.default", "B", "B")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := convertSecrets(tc.secrets)
+			require.True(t, sameSecrets(tc.out, out), "got %v", out)
+		})
+	}
+}
+
+func TestWithSecrets(t *testing.T) {
+	fromFile := tlsSecret("foo.default", "FILE", "FILE")
+	fromKube := tlsSecret("foo.default", "KUBE", "KUBE")
+	other := tlsSecret("bar.default", "KUBE", "KUBE")
+
+	for _, tc := range []struct {
+		name  string
+		files []cache.Resource
+		extra []cache.Resource
+		out   map[string]cache.Resource
+	}{
+		{
+			name:  "kubernetes only",
+			extra: []cache.Resource{fromKube, other},
+			out:   map[string]cache.Resource{"foo.default": fromKube, "bar.default": other},
+		},
+		{
+			name:  "files only",
+			files: []cache.Resource{fromFile},
+			out:   map[string]cache.Resource{"foo.default": fromFile},
+		},
+		{
+			name:  "files win",
+			files: []cache.Resource{fromFile},
+			extra: []cache.Resource{fromKube, other},
+			out:   map[string]cache.Resource{"foo.default": fromFile, "bar.default": other},
+		},
+		{
+			name: "none",
+			out:  map[string]cache.Resource{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			snapshot := cache.NewSnapshot("1", nil, nil, nil, nil)
+			snapshot.Secrets = cache.NewResources("1", tc.files)
+			out := withSecrets(snapshot, "1.s1", tc.extra)
+			require.Equal(t, "1.s1", out.Secrets.Version)
+			require.Equal(t, tc.out, out.Secrets.Items)
+			// the snapshot it came from is left alone
+			require.Equal(t, "1", snapshot.Secrets.Version)
+			require.Len(t, snapshot.Secrets.Items, len(tc.files))
+		})
+	}
+}
+
+func TestSetSecretsUnchanged(t *testing.T) {
+	nodes, _ := newEnvoyNodes(t, "a")
+	require.NoError(t, nodes.Set(clusterSet(t, "first")))
+
+	secretsVersion := func() string {
+		snapshot, err := nodes.config.GetSnapshot("a")
+		require.NoError(t, err)
+		return snapshot.GetVersion(cache.SecretType)
+	}
+	secrets := func(cert string) []cache.Resource {
+		return convertSecrets([]k8s.Resource{kubeSecret("foo", map[string]string{"tls.crt": cert, "tls.key": "KEY"})})
+	}
+
+	require.NoError(t, nodes.SetSecrets(secrets("CERT")))
+	version := secretsVersion()
+
+	// the watch calls back with the same secrets, e.g. when a label changes
+	require.NoError(t, nodes.SetSecrets(secrets("CERT")))
+	require.Equal(t, version, secretsVersion())
+
+	require.NoError(t, nodes.SetSecrets(secrets("ROTATED")))
+	require.NotEqual(t, version, secretsVersion())
+}
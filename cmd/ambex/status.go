@@ -0,0 +1,289 @@
+package ambex
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	rpc "istio.io/gogo-genproto/googleapis/google/rpc"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
+)
+
+// typeStatus is what we know about one resource type on one node: the last
+// version we sent it, the last version it ACKed, and the last version it
+// NACKed along with the reason it gave.
+type typeStatus struct {
+	SentVersion   string    `json:"sent_version"`
+	SentTime      time.Time `json:"sent_time"`
+	AckedVersion  string    `json:"acked_version"`
+	AckedTime     time.Time `json:"acked_time"`
+	NackedVersion string    `json:"nacked_version,omitempty"`
+	NackedTime    time.Time `json:"nacked_time"`
+	NackError     string    `json:"nack_error,omitempty"`
+
+	// Rejected is set when the last response for the type was NACKed,
+	// and cleared by the next ACK.
+	Rejected bool `json:"rejected"`
+}
+
+// sentResponse is the last response sent for one type on one stream, so that
+// we can tell which version an ACK or NACK refers to.
+type sentResponse struct {
+	nonce   string
+	version string
+}
+
+// configStatus tracks, for each node and resource type, whether the node
+// took the configuration we sent it. It is fed by the server callbacks, and
+// can be served over HTTP and written out to a file for diagd to read.
+type configStatus struct {
+	// file, if set, is rewritten shortly after the status changes
+	file   string
+	saveMu sync.Mutex
+
+	mu      sync.Mutex
+	nodes   map[string]map[string]*typeStatus
+	sent    map[int64]map[string]sentResponse
+	streams map[int64]string
+	// dirty is set while a write of the file is scheduled
+	dirty bool
+}
+
+func newConfigStatus(file string) *configStatus {
+	return &configStatus{
+		file:    file,
+		nodes:   make(map[string]map[string]*typeStatus),
+		sent:    make(map[int64]map[string]sentResponse),
+		streams: make(map[int64]string),
+	}
+}
+
+// get returns the status for a node and type, and remembers which node is on
+// the stream. It must be called with the lock held.
+func (s *configStatus) get(sid int64, node *core.Node, typeURL string) *typeStatus {
+	id := Hasher{}.ID(node)
+	s.streams[sid] = id
+	types, ok := s.nodes[id]
+	if !ok {
+		types = make(map[string]*typeStatus)
+		s.nodes[id] = types
+	}
+	ts, ok := types[typeURL]
+	if !ok {
+		ts = &typeStatus{}
+		types[typeURL] = ts
+	}
+	return ts
+}
+
+// Sent records a response sent on a stream.
+func (s *configStatus) Sent(sid int64, node *core.Node, typeURL, version, nonce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := s.get(sid, node, typeURL)
+	ts.SentVersion = version
+	ts.SentTime = time.Now()
+
+	sent, ok := s.sent[sid]
+	if !ok {
+		sent = make(map[string]sentResponse)
+		s.sent[sid] = sent
+	}
+	sent[typeURL] = sentResponse{nonce: nonce, version: version}
+
+	s.changed()
+}
+
+// Received records a request received on a stream, which is an ACK or a NACK
+// if it carries the nonce of a response. ackedVersion is the version the
+// request claims to have applied, if the protocol says. errorDetail is nil
+// for an ACK. It returns the version that was ACKed or NACKed, if known.
+func (s *configStatus) Received(sid int64, node *core.Node, typeURL, nonce, ackedVersion string, errorDetail *rpc.Status) string {
+	if nonce == "" {
+		// initial request, nothing to acknowledge
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the version the ACK or NACK is about
+	version := ""
+	if last, ok := s.sent[sid][typeURL]; ok && last.nonce == nonce {
+		version = last.version
+	}
+
+	ts := s.get(sid, node, typeURL)
+	now := time.Now()
+	if errorDetail != nil {
+		ts.NackedVersion = version
+		ts.NackedTime = now
+		ts.NackError = errorDetail.Message
+		ts.Rejected = true
+		log.WithFields(log.Fields{
+			"node":    Hasher{}.ID(node),
+			"type":    typeURL,
+			"version": version,
+		}).Errorf("Envoy rejected configuration: %s", errorDetail.Message)
+	} else {
+		if ackedVersion == "" {
+			ackedVersion = version
+		}
+		ts.AckedVersion = ackedVersion
+		ts.AckedTime = now
+		ts.Rejected = false
+		version = ackedVersion
+	}
+
+	s.changed()
+	return version
+}
+
+// AckedByAll checks whether every connected node ACKed a snapshot version for
+// every resource type it was sent.
+func (s *configStatus) AckedByAll(version string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	connected := make(map[string]bool)
+	for _, id := range s.streams {
+		connected[id] = true
+	}
+	for id := range connected {
+		for _, ts := range s.nodes[id] {
+			if ts.SentVersion != "" && snapshotVersion(ts.AckedVersion) != version {
+				return false
+			}
+		}
+	}
+	return len(connected) > 0
+}
+
+// Closed forgets about a stream.
+func (s *configStatus) Closed(sid int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sent, sid)
+	delete(s.streams, sid)
+}
+
+// statusSaveDelay is how long changes to the status are collected before the
+// status file is written, so that a burst of ACKs is one write.
+const statusSaveDelay = 100 * time.Millisecond
+
+// changed schedules a write of the status file, if there is one and a write
+// isn't scheduled already. It must be called with the lock held.
+func (s *configStatus) changed() {
+	if s.file == "" || s.dirty {
+		return
+	}
+	s.dirty = true
+	time.AfterFunc(statusSaveDelay, s.save)
+}
+
+// save writes the status file. The file is replaced atomically so readers
+// never see a partial write. Only one save runs at a time, so the last one to
+// run, which has the latest status, is the one left in the file.
+func (s *configStatus) save() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	s.dirty = false
+	bytes, err := json.MarshalIndent(s.nodes, "", "  ")
+	s.mu.Unlock()
+
+	if err != nil {
+		log.WithError(err).Warn("Error marshalling status")
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), "."+filepath.Base(s.file))
+	if err != nil {
+		log.WithError(err).Warn("Error writing status file")
+		return
+	}
+	_, err = tmp.Write(bytes)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.WithError(err).Warn("Error writing status file")
+	}
+}
+
+func (s *configStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	bytes, err := json.MarshalIndent(s.nodes, "", "  ")
+	s.mu.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// OnStreamRequest records ACKs and NACKs on a stream, and returns the version
+// that was ACKed or NACKed.
+func (s *configStatus) OnStreamRequest(sid int64, req *v2.DiscoveryRequest) string {
+	return s.Received(sid, req.Node, req.TypeUrl, req.ResponseNonce, req.VersionInfo, req.ErrorDetail)
+}
+
+// OnStreamResponse records responses sent on a stream.
+func (s *configStatus) OnStreamResponse(sid int64, req *v2.DiscoveryRequest, res *v2.DiscoveryResponse) {
+	s.Sent(sid, req.Node, res.TypeUrl, res.VersionInfo, res.Nonce)
+}
+
+// OnStreamDeltaRequest records ACKs and NACKs on an incremental stream, and
+// returns the version that was ACKed or NACKed.
+func (s *configStatus) OnStreamDeltaRequest(sid int64, req *v2.DeltaDiscoveryRequest) string {
+	// incremental requests don't carry a version, the nonce tells us
+	return s.Received(sid, req.Node, req.TypeUrl, req.ResponseNonce, "", req.ErrorDetail)
+}
+
+// OnStreamDeltaResponse records responses sent on an incremental stream.
+func (s *configStatus) OnStreamDeltaResponse(sid int64, req *v2.DeltaDiscoveryRequest, res *v2.DeltaDiscoveryResponse) {
+	s.Sent(sid, req.Node, res.TypeUrl, res.SystemVersionInfo, res.Nonce)
+}
+
+// runStatusServer serves the config status over HTTP at the given address.
+func runStatusServer(ctx context.Context, status *configStatus, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/status", status)
+	srv := &http.Server{Handler: mux}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.WithError(err).Fatal("failed to listen")
+	}
+
+	log.WithFields(log.Fields{"addr": addr}).Info("Serving status")
+	go func() {
+		go func() {
+			err := srv.Serve(lis)
+
+			if err != nil && err != http.ErrServerClosed {
+				log.WithFields(log.Fields{"error": err}).Error("Status server exited")
+			}
+		}()
+
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+}
@@ -0,0 +1,109 @@
+package ambex
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	rpc "istio.io/gogo-genproto/googleapis/google/rpc"
+
+	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+)
+
+func TestStatusReceived(t *testing.T) {
+	s := newConfigStatus("")
+	node := &core.Node{Id: "a"}
+	ts := func() *typeStatus { return s.nodes["a"][cache.ClusterType] }
+
+	// the first request isn't about anything
+	require.Equal(t, "", s.Received(1, node, cache.ClusterType, "", "", nil))
+	require.Nil(t, ts())
+
+	s.Sent(1, node, cache.ClusterType, "v1", "n1")
+	require.Equal(t, "v1", ts().SentVersion)
+
+	// an ACK with the nonce of the response is for its version
+	require.Equal(t, "v1", s.Received(1, node, cache.ClusterType, "n1", "", nil))
+	require.Equal(t, "v1", ts().AckedVersion)
+	require.False(t, ts().Rejected)
+
+	// a NACK is for the version the nonce was sent with, not the version
+	// the node still has
+	s.Sent(1, node, cache.ClusterType, "v2", "n2")
+	require.Equal(t, "v2", s.Received(1, node, cache.ClusterType, "n2", "v1", &rpc.Status{Message: "bad cluster"}))
+	require.Equal(t, "v1", ts().AckedVersion)
+	require.Equal(t, "v2", ts().NackedVersion)
+	require.Equal(t, "bad cluster", ts().NackError)
+	require.True(t, ts().Rejected)
+
+	// a NACK with a nonce we don't know, or that was sent on another
+	// stream, isn't for any version we can tell
+	require.Equal(t, "", s.Received(1, node, cache.ClusterType, "n1", "v1", &rpc.Status{Message: "stale"}))
+	require.Equal(t, "", s.Received(2, node, cache.ClusterType, "n2", "v1", &rpc.Status{Message: "other"}))
+
+	// an ACK says what it applied, which wins over the nonce
+	s.Sent(1, node, cache.ClusterType, "v3", "n3")
+	require.Equal(t, "v3.s1", s.Received(1, node, cache.ClusterType, "n3", "v3.s1", nil))
+	require.Equal(t, "v3.s1", ts().AckedVersion)
+	require.False(t, ts().Rejected)
+}
+
+func TestStatusAckedByAll(t *testing.T) {
+	s := newConfigStatus("")
+	a, b := &core.Node{Id: "a"}, &core.Node{Id: "b"}
+	require.False(t, s.AckedByAll("v1"))
+
+	s.Sent(1, a, cache.ClusterType, "v1.p1", "n1")
+	s.Sent(2, b, cache.ClusterType, "v1", "n1")
+	s.Received(1, a, cache.ClusterType, "n1", "", nil)
+	require.False(t, s.AckedByAll("v1"))
+
+	s.Received(2, b, cache.ClusterType, "n1", "", nil)
+	require.True(t, s.AckedByAll("v1"))
+	require.False(t, s.AckedByAll("v2"))
+
+	// a node that went away doesn't hold things up
+	s.Sent(1, a, cache.ClusterType, "v2", "n2")
+	s.Sent(2, b, cache.ClusterType, "v2", "n2")
+	s.Received(1, a, cache.ClusterType, "n2", "", nil)
+	require.False(t, s.AckedByAll("v2"))
+	s.Closed(2)
+	require.True(t, s.AckedByAll("v2"))
+}
+
+func TestStatusFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ambex-status")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "status.json")
+
+	s := newConfigStatus(file)
+	node := &core.Node{Id: "a"}
+	s.Sent(1, node, cache.ClusterType, "v1", "n1")
+	s.Received(1, node, cache.ClusterType, "n1", "", nil)
+
+	// the file is written in the background, with everything so far
+	var status map[string]map[string]*typeStatus
+	require.Eventually(t, func() bool {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false
+		}
+		require.NoError(t, json.Unmarshal(bytes, &status))
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "v1", status["a"][cache.ClusterType].AckedVersion)
+
+	s.Sent(1, node, cache.ClusterType, "v2", "n2")
+	require.Eventually(t, func() bool {
+		bytes, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(bytes, &status))
+		return status["a"][cache.ClusterType].SentVersion == "v2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,394 @@
+package ambex
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
+	v3 "github.com/datawire/ambassador/pkg/api/envoy/api/v3alpha"
+	_ "github.com/datawire/ambassador/pkg/api/envoy/api/v3alpha/auth"
+	_ "github.com/datawire/ambassador/pkg/api/envoy/config/filter/network/http_connection_manager/v3alpha"
+	discoveryv3 "github.com/datawire/ambassador/pkg/api/envoy/service/discovery/v3alpha"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/server"
+)
+
+// The snapshot cache and the server only speak xDS v2. We serve v3 (which is
+// still v3alpha in our Envoy) from the same snapshots by translating every
+// request from a v3 client to v2, and every response back to v3.
+//
+// The v3 API is generated from the v2 one and keeps its field numbers, so the
+// messages translate by going through the wire format. Fields that are
+// deprecated in v2 are gone in v3. We move the TLS contexts of clusters and
+// filter chains to their transport sockets, since Ambassador still uses
+// those; a v3 client doesn't get any other deprecated field, and we warn about
+// it. Resources in files may be either version: v3 ones are translated
+// to v2 as they are loaded. Only the resources themselves are translated,
+// typed configs inside them keep their type.
+
+const (
+	v2TypePrefix = "type.googleapis.com/envoy.api.v2."
+	v3TypePrefix = "type.googleapis.com/envoy.api.v3alpha."
+)
+
+// v3Dropped records the resources we warned about dropping fields from, so
+// that we only warn once and not on every response.
+var v3Dropped sync.Map
+
+// translate copies a message into one of the other version.
+func translate(from, to proto.Message) error {
+	bytes, err := proto.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(bytes, to)
+}
+
+// v2TypeURL returns the v2 type URL of a v3 resource type.
+func v2TypeURL(typeURL string) string {
+	if strings.HasPrefix(typeURL, v3TypePrefix) {
+		return v2TypePrefix + strings.TrimPrefix(typeURL, v3TypePrefix)
+	}
+	return typeURL
+}
+
+// v3TypeURL returns the v3 type URL of a v2 resource type.
+func v3TypeURL(typeURL string) string {
+	if strings.HasPrefix(typeURL, v2TypePrefix) {
+		return v3TypePrefix + strings.TrimPrefix(typeURL, v2TypePrefix)
+	}
+	return typeURL
+}
+
+// fromV3 translates a v3 resource loaded from a file to v2. It returns the
+// message unchanged if it isn't a v3 resource.
+func fromV3(m proto.Message) (proto.Message, error) {
+	name := proto.MessageName(m)
+	if !strings.HasPrefix(name, "envoy.api.v3alpha.") {
+		return m, nil
+	}
+	t := proto.MessageType("envoy.api.v2." + strings.TrimPrefix(name, "envoy.api.v3alpha."))
+	if t == nil {
+		return m, nil
+	}
+	out := reflect.New(t.Elem()).Interface().(proto.Message)
+	return out, translate(m, out)
+}
+
+// tlsTransportSocket returns the transport socket for a TLS context.
+func tlsTransportSocket(tlsContext proto.Message) (*core.TransportSocket, error) {
+	config, err := types.MarshalAny(tlsContext)
+	if err != nil {
+		return nil, err
+	}
+	return &core.TransportSocket{
+		Name:       "envoy.transport_sockets.tls",
+		ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: config},
+	}, nil
+}
+
+// upgradeTLSContexts moves the deprecated TLS contexts of a v2 cluster or
+// listener to transport sockets, which is where v3 wants them.
+func upgradeTLSContexts(m proto.Message) error {
+	var err error
+	switch r := m.(type) {
+	case *v2.Cluster:
+		if r.TlsContext != nil && r.TransportSocket == nil {
+			if r.TransportSocket, err = tlsTransportSocket(r.TlsContext); err != nil {
+				return err
+			}
+			r.TlsContext = nil
+		}
+	case *v2.Listener:
+		for _, chain := range r.FilterChains {
+			if chain.TlsContext != nil && chain.TransportSocket == nil {
+				if chain.TransportSocket, err = tlsTransportSocket(chain.TlsContext); err != nil {
+					return err
+				}
+				chain.TlsContext = nil
+			}
+		}
+	}
+	return nil
+}
+
+// toV3Resource translates a v2 resource to v3.
+func toV3Resource(any *types.Any) (*types.Any, error) {
+	typeURL := v3TypeURL(any.TypeUrl)
+	t := proto.MessageType(typeURL[strings.LastIndex(typeURL, "/")+1:])
+	if t == nil {
+		return any, nil
+	}
+
+	var in types.DynamicAny
+	if err := types.UnmarshalAny(any, &in); err != nil {
+		return nil, err
+	}
+	if err := upgradeTLSContexts(in.Message); err != nil {
+		return nil, err
+	}
+
+	m := reflect.New(t.Elem()).Interface().(proto.Message)
+	if err := translate(in.Message, m); err != nil {
+		return nil, err
+	}
+	size := proto.Size(m)
+	proto.DiscardUnknown(m)
+	if proto.Size(m) != size {
+		key := any.TypeUrl + " " + resourceName(m)
+		if _, warned := v3Dropped.LoadOrStore(key, true); !warned {
+			log.Warnf("%s uses fields that are not in v3, v3 clients won't get them", key)
+		}
+	}
+
+	value, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Any{TypeUrl: typeURL, Value: value}, nil
+}
+
+// resourceName returns the name of a resource of any version, for logging.
+func resourceName(m proto.Message) string {
+	if named, ok := m.(interface{ GetName() string }); ok {
+		return named.GetName()
+	}
+	if named, ok := m.(interface{ GetClusterName() string }); ok {
+		return named.GetClusterName()
+	}
+	return ""
+}
+
+func toV2Request(req *v3.DiscoveryRequest) (*v2.DiscoveryRequest, error) {
+	out := &v2.DiscoveryRequest{}
+	if err := translate(req, out); err != nil {
+		return nil, err
+	}
+	out.TypeUrl = v2TypeURL(out.TypeUrl)
+	return out, nil
+}
+
+func toV3Response(res *v2.DiscoveryResponse) (*v3.DiscoveryResponse, error) {
+	out := &v3.DiscoveryResponse{}
+	if err := translate(res, out); err != nil {
+		return nil, err
+	}
+	out.TypeUrl = v3TypeURL(out.TypeUrl)
+	for i, resource := range out.Resources {
+		translated, err := toV3Resource(resource)
+		if err != nil {
+			return nil, err
+		}
+		out.Resources[i] = translated
+	}
+	return out, nil
+}
+
+func toV2DeltaRequest(req *v3.DeltaDiscoveryRequest) (*v2.DeltaDiscoveryRequest, error) {
+	out := &v2.DeltaDiscoveryRequest{}
+	if err := translate(req, out); err != nil {
+		return nil, err
+	}
+	out.TypeUrl = v2TypeURL(out.TypeUrl)
+	return out, nil
+}
+
+func toV3DeltaResponse(res *v2.DeltaDiscoveryResponse) (*v3.DeltaDiscoveryResponse, error) {
+	out := &v3.DeltaDiscoveryResponse{}
+	if err := translate(res, out); err != nil {
+		return nil, err
+	}
+	out.TypeUrl = v3TypeURL(out.TypeUrl)
+	for _, resource := range out.Resources {
+		if resource.Resource == nil {
+			continue
+		}
+		translated, err := toV3Resource(resource.Resource)
+		if err != nil {
+			return nil, err
+		}
+		resource.Resource = translated
+	}
+	return out, nil
+}
+
+// v3Stream is what all the v3 state of the world streams look like.
+type v3Stream interface {
+	grpc.ServerStream
+	Send(*v3.DiscoveryResponse) error
+	Recv() (*v3.DiscoveryRequest, error)
+}
+
+// v3StreamAdapter makes a v3 stream look like a v2 one to the server. It
+// fits every v2 state of the world stream.
+type v3StreamAdapter struct {
+	grpc.ServerStream
+	stream v3Stream
+}
+
+func (a v3StreamAdapter) Send(res *v2.DiscoveryResponse) error {
+	out, err := toV3Response(res)
+	if err != nil {
+		return err
+	}
+	return a.stream.Send(out)
+}
+
+func (a v3StreamAdapter) Recv() (*v2.DiscoveryRequest, error) {
+	req, err := a.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return toV2Request(req)
+}
+
+func adaptStream(stream v3Stream) v3StreamAdapter {
+	return v3StreamAdapter{ServerStream: stream, stream: stream}
+}
+
+// v3DeltaStream is what all the v3 incremental streams look like.
+type v3DeltaStream interface {
+	grpc.ServerStream
+	Send(*v3.DeltaDiscoveryResponse) error
+	Recv() (*v3.DeltaDiscoveryRequest, error)
+}
+
+// v3DeltaStreamAdapter makes a v3 incremental stream look like a v2 one to
+// the server.
+type v3DeltaStreamAdapter struct {
+	grpc.ServerStream
+	stream v3DeltaStream
+}
+
+func (a v3DeltaStreamAdapter) Send(res *v2.DeltaDiscoveryResponse) error {
+	out, err := toV3DeltaResponse(res)
+	if err != nil {
+		return err
+	}
+	return a.stream.Send(out)
+}
+
+func (a v3DeltaStreamAdapter) Recv() (*v2.DeltaDiscoveryRequest, error) {
+	req, err := a.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return toV2DeltaRequest(req)
+}
+
+func adaptDeltaStream(stream v3DeltaStream) v3DeltaStreamAdapter {
+	return v3DeltaStreamAdapter{ServerStream: stream, stream: stream}
+}
+
+// v3Server serves the v3 discovery services with a v2 server.
+type v3Server struct {
+	server server.Server
+}
+
+var (
+	_ discoveryv3.AggregatedDiscoveryServiceServer = v3Server{}
+	_ v3.EndpointDiscoveryServiceServer            = v3Server{}
+	_ v3.ClusterDiscoveryServiceServer             = v3Server{}
+	_ v3.RouteDiscoveryServiceServer               = v3Server{}
+	_ v3.ListenerDiscoveryServiceServer            = v3Server{}
+	_ discoveryv3.SecretDiscoveryServiceServer     = v3Server{}
+)
+
+// register registers all the v3 discovery services.
+func (s v3Server) register(grpcServer *grpc.Server) {
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(grpcServer, s)
+	v3.RegisterEndpointDiscoveryServiceServer(grpcServer, s)
+	v3.RegisterClusterDiscoveryServiceServer(grpcServer, s)
+	v3.RegisterRouteDiscoveryServiceServer(grpcServer, s)
+	v3.RegisterListenerDiscoveryServiceServer(grpcServer, s)
+	discoveryv3.RegisterSecretDiscoveryServiceServer(grpcServer, s)
+}
+
+// fetch answers a v3 fetch request with a v2 fetch.
+func (s v3Server) fetch(ctx context.Context, req *v3.DiscoveryRequest,
+	fetch func(context.Context, *v2.DiscoveryRequest) (*v2.DiscoveryResponse, error)) (*v3.DiscoveryResponse, error) {
+	in, err := toV2Request(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := fetch(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return toV3Response(res)
+}
+
+func (s v3Server) StreamAggregatedResources(stream discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	return s.server.StreamAggregatedResources(adaptStream(stream))
+}
+
+func (s v3Server) DeltaAggregatedResources(stream discoveryv3.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return s.server.DeltaAggregatedResources(adaptDeltaStream(stream))
+}
+
+func (s v3Server) StreamEndpoints(stream v3.EndpointDiscoveryService_StreamEndpointsServer) error {
+	return s.server.StreamEndpoints(adaptStream(stream))
+}
+
+func (s v3Server) DeltaEndpoints(stream v3.EndpointDiscoveryService_DeltaEndpointsServer) error {
+	return s.server.DeltaEndpoints(adaptDeltaStream(stream))
+}
+
+func (s v3Server) FetchEndpoints(ctx context.Context, req *v3.DiscoveryRequest) (*v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, req, s.server.FetchEndpoints)
+}
+
+func (s v3Server) StreamClusters(stream v3.ClusterDiscoveryService_StreamClustersServer) error {
+	return s.server.StreamClusters(adaptStream(stream))
+}
+
+func (s v3Server) DeltaClusters(stream v3.ClusterDiscoveryService_DeltaClustersServer) error {
+	return s.server.DeltaClusters(adaptDeltaStream(stream))
+}
+
+func (s v3Server) FetchClusters(ctx context.Context, req *v3.DiscoveryRequest) (*v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, req, s.server.FetchClusters)
+}
+
+func (s v3Server) StreamRoutes(stream v3.RouteDiscoveryService_StreamRoutesServer) error {
+	return s.server.StreamRoutes(adaptStream(stream))
+}
+
+func (s v3Server) DeltaRoutes(stream v3.RouteDiscoveryService_DeltaRoutesServer) error {
+	return s.server.DeltaRoutes(adaptDeltaStream(stream))
+}
+
+func (s v3Server) FetchRoutes(ctx context.Context, req *v3.DiscoveryRequest) (*v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, req, s.server.FetchRoutes)
+}
+
+func (s v3Server) StreamListeners(stream v3.ListenerDiscoveryService_StreamListenersServer) error {
+	return s.server.StreamListeners(adaptStream(stream))
+}
+
+func (s v3Server) DeltaListeners(stream v3.ListenerDiscoveryService_DeltaListenersServer) error {
+	return s.server.DeltaListeners(adaptDeltaStream(stream))
+}
+
+func (s v3Server) FetchListeners(ctx context.Context, req *v3.DiscoveryRequest) (*v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, req, s.server.FetchListeners)
+}
+
+func (s v3Server) StreamSecrets(stream discoveryv3.SecretDiscoveryService_StreamSecretsServer) error {
+	return s.server.StreamSecrets(adaptStream(stream))
+}
+
+func (s v3Server) DeltaSecrets(stream discoveryv3.SecretDiscoveryService_DeltaSecretsServer) error {
+	return s.server.DeltaSecrets(adaptDeltaStream(stream))
+}
+
+func (s v3Server) FetchSecrets(ctx context.Context, req *v3.DiscoveryRequest) (*v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, req, s.server.FetchSecrets)
+}
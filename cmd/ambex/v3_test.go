@@ -0,0 +1,271 @@
+package ambex
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+	auth "github.com/datawire/ambassador/pkg/api/envoy/api/v2/auth"
+	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
+	listener "github.com/datawire/ambassador/pkg/api/envoy/api/v2/listener"
+	v3 "github.com/datawire/ambassador/pkg/api/envoy/api/v3alpha"
+	v3core "github.com/datawire/ambassador/pkg/api/envoy/api/v3alpha/core"
+	discoveryv3 "github.com/datawire/ambassador/pkg/api/envoy/service/discovery/v3alpha"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/server"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/test/resource"
+)
+
+// roundTrip translates a v2 resource to v3 and back, the way a v3 client
+// gets it and a v3 file is loaded.
+func roundTrip(t *testing.T, m proto.Message) proto.Message {
+	t.Helper()
+	any, err := types.MarshalAny(m)
+	require.NoError(t, err)
+	v3Any, err := toV3Resource(any)
+	require.NoError(t, err)
+	require.Equal(t, v3TypeURL(any.TypeUrl), v3Any.TypeUrl)
+	require.NotEqual(t, any.TypeUrl, v3Any.TypeUrl)
+
+	var v3Message types.DynamicAny
+	require.NoError(t, types.UnmarshalAny(v3Any, &v3Message))
+	back, err := fromV3(v3Message.Message)
+	require.NoError(t, err)
+	require.Equal(t, proto.MessageName(m), proto.MessageName(back))
+	return back
+}
+
+func TestV3RoundTrip(t *testing.T) {
+	resources := []proto.Message{
+		resource.MakeCluster(resource.Ads, "cluster"),
+		resource.MakeEndpoint("cluster", 8080),
+		resource.MakeRoute("route", "cluster"),
+		resource.MakeHTTPListener(resource.Ads, "listener", 8080, "route"),
+		resource.MakeTCPListener("tcp", 8081, "cluster"),
+	}
+	for _, secret := range resource.MakeSecrets("tls", "root") {
+		resources = append(resources, secret)
+	}
+
+	for _, m := range resources {
+		m := m
+		t.Run(proto.MessageName(m)+"/"+resourceName(m), func(t *testing.T) {
+			back := roundTrip(t, m)
+			require.True(t, proto.Equal(m, back), "%v\n!=\n%v", m, back)
+		})
+	}
+}
+
+func TestV3TLSContexts(t *testing.T) {
+	tlsContext := &auth.UpstreamTlsContext{Sni: "example.com"}
+	cluster := resource.MakeCluster(resource.Ads, "cluster")
+	cluster.TlsContext = tlsContext
+
+	back := roundTrip(t, cluster).(*v2.Cluster)
+	require.Nil(t, back.TlsContext)
+	require.Equal(t, "envoy.transport_sockets.tls", back.TransportSocket.Name)
+	var config auth.UpstreamTlsContext
+	require.NoError(t, types.UnmarshalAny(back.TransportSocket.GetTypedConfig(), &config))
+	require.Equal(t, "example.com", config.Sni)
+
+	// a transport socket that's already there wins
+	socket := &core.TransportSocket{Name: "envoy.transport_sockets.raw_buffer"}
+	cluster.TransportSocket = socket
+	back = roundTrip(t, cluster).(*v2.Cluster)
+	require.Equal(t, "envoy.transport_sockets.raw_buffer", back.TransportSocket.Name)
+
+	downstream := &auth.DownstreamTlsContext{RequireClientCertificate: &types.BoolValue{Value: true}}
+	l := resource.MakeHTTPListener(resource.Ads, "listener", 8080, "route")
+	l.FilterChains = append(l.FilterChains, &listener.FilterChain{TlsContext: downstream})
+	backListener := roundTrip(t, l).(*v2.Listener)
+	require.Nil(t, backListener.FilterChains[0].TransportSocket)
+	require.Nil(t, backListener.FilterChains[1].TlsContext)
+	var downstreamConfig auth.DownstreamTlsContext
+	require.NoError(t, types.UnmarshalAny(backListener.FilterChains[1].TransportSocket.GetTypedConfig(), &downstreamConfig))
+	require.True(t, downstreamConfig.RequireClientCertificate.Value)
+}
+
+func TestV3DropsDeprecatedFields(t *testing.T) {
+	cluster := resource.MakeCluster(resource.Ads, "deprecated")
+	cluster.ExtensionProtocolOptions = map[string]*types.Struct{"envoy.http_connection_manager": {}}
+	back := roundTrip(t, cluster).(*v2.Cluster)
+	require.Empty(t, back.ExtensionProtocolOptions)
+	require.Equal(t, "deprecated", back.Name)
+}
+
+func TestV3TypeURLs(t *testing.T) {
+	for _, typeURL := range []string{cache.EndpointType, cache.ClusterType, cache.RouteType, cache.ListenerType,
+		cache.SecretType} {
+		v3URL := v3TypeURL(typeURL)
+		require.Contains(t, v3URL, ".v3alpha.")
+		require.Equal(t, typeURL, v2TypeURL(v3URL))
+	}
+	// anything else is left alone
+	require.Equal(t, "type.googleapis.com/google.protobuf.Struct", v3TypeURL("type.googleapis.com/google.protobuf.Struct"))
+	require.Equal(t, "type.googleapis.com/google.protobuf.Struct", v2TypeURL("type.googleapis.com/google.protobuf.Struct"))
+	require.Equal(t, "", v2TypeURL(""))
+}
+
+func TestV3Requests(t *testing.T) {
+	req, err := toV2Request(&v3.DiscoveryRequest{
+		VersionInfo:   "1",
+		ResourceNames: []string{"cluster"},
+		TypeUrl:       v3TypeURL(cache.EndpointType),
+		ResponseNonce: "2",
+	})
+	require.NoError(t, err)
+	require.Equal(t, &v2.DiscoveryRequest{
+		VersionInfo:   "1",
+		ResourceNames: []string{"cluster"},
+		TypeUrl:       cache.EndpointType,
+		ResponseNonce: "2",
+	}, req)
+
+	endpoint, err := types.MarshalAny(resource.MakeEndpoint("cluster", 8080))
+	require.NoError(t, err)
+	res, err := toV3Response(&v2.DiscoveryResponse{
+		VersionInfo: "1",
+		Resources:   []*types.Any{endpoint},
+		TypeUrl:     cache.EndpointType,
+		Nonce:       "2",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "1", res.VersionInfo)
+	require.Equal(t, "2", res.Nonce)
+	require.Equal(t, v3TypeURL(cache.EndpointType), res.TypeUrl)
+	require.Len(t, res.Resources, 1)
+	require.Equal(t, v3TypeURL(cache.EndpointType), res.Resources[0].TypeUrl)
+
+	deltaReq, err := toV2DeltaRequest(&v3.DeltaDiscoveryRequest{
+		TypeUrl:                  v3TypeURL(cache.ClusterType),
+		ResourceNamesSubscribe:   []string{"a"},
+		ResourceNamesUnsubscribe: []string{"b"},
+		InitialResourceVersions:  map[string]string{"a": "1"},
+		ResponseNonce:            "3",
+	})
+	require.NoError(t, err)
+	require.Equal(t, &v2.DeltaDiscoveryRequest{
+		TypeUrl:                  cache.ClusterType,
+		ResourceNamesSubscribe:   []string{"a"},
+		ResourceNamesUnsubscribe: []string{"b"},
+		InitialResourceVersions:  map[string]string{"a": "1"},
+		ResponseNonce:            "3",
+	}, deltaReq)
+
+	cluster, err := types.MarshalAny(resource.MakeCluster(resource.Ads, "cluster"))
+	require.NoError(t, err)
+	deltaRes, err := toV3DeltaResponse(&v2.DeltaDiscoveryResponse{
+		SystemVersionInfo: "4",
+		Resources:         []*v2.Resource{{Name: "cluster", Version: "v", Resource: cluster}},
+		TypeUrl:           cache.ClusterType,
+		RemovedResources:  []string{"gone"},
+		Nonce:             "5",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "4", deltaRes.SystemVersionInfo)
+	require.Equal(t, "5", deltaRes.Nonce)
+	require.Equal(t, v3TypeURL(cache.ClusterType), deltaRes.TypeUrl)
+	require.Equal(t, []string{"gone"}, deltaRes.RemovedResources)
+	require.Equal(t, "cluster", deltaRes.Resources[0].Name)
+	require.Equal(t, "v", deltaRes.Resources[0].Version)
+	require.Equal(t, v3TypeURL(cache.ClusterType), deltaRes.Resources[0].Resource.TypeUrl)
+}
+
+// startV3Server serves the v3 discovery services from a snapshot cache, and
+// returns an ADS client connected to them.
+func startV3Server(t *testing.T, config cache.Cache) (discoveryv3.AggregatedDiscoveryServiceClient, func()) {
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	v3Server{server: server.NewServer(config, logger{})}.register(grpcServer)
+	go func() {
+		_ = grpcServer.Serve(lis)
+	}()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	require.NoError(t, err)
+	return discoveryv3.NewAggregatedDiscoveryServiceClient(conn), func() {
+		conn.Close()
+		grpcServer.Stop()
+	}
+}
+
+func TestV3Stream(t *testing.T) {
+	config := cache.NewSnapshotCache(true, cache.IDHash{}, nil)
+	client, stop := startV3Server(t, config)
+	defer stop()
+
+	node := &v3core.Node{Id: "envoy"}
+	require.NoError(t, config.SetSnapshot(node.Id, cache.NewSnapshot("1", nil,
+		[]cache.Resource{resource.MakeCluster(resource.Ads, "cluster1")}, nil, nil)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.StreamAggregatedResources(ctx)
+	require.NoError(t, err)
+
+	clusterType := v3TypeURL(cache.ClusterType)
+	require.NoError(t, stream.Send(&v3.DiscoveryRequest{Node: node, TypeUrl: clusterType}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "1", res.VersionInfo)
+	require.Equal(t, clusterType, res.TypeUrl)
+	require.Len(t, res.Resources, 1)
+	var cluster v3.Cluster
+	require.NoError(t, types.UnmarshalAny(res.Resources[0], &cluster))
+	require.Equal(t, "cluster1", cluster.Name)
+
+	// ACK, and the next snapshot comes along
+	require.NoError(t, stream.Send(&v3.DiscoveryRequest{Node: node, TypeUrl: clusterType,
+		VersionInfo: res.VersionInfo, ResponseNonce: res.Nonce}))
+	require.NoError(t, config.SetSnapshot(node.Id, cache.NewSnapshot("2", nil,
+		[]cache.Resource{resource.MakeCluster(resource.Ads, "cluster2")}, nil, nil)))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "2", res.VersionInfo)
+	require.NoError(t, types.UnmarshalAny(res.Resources[0], &cluster))
+	require.Equal(t, "cluster2", cluster.Name)
+}
+
+func TestV3DeltaStream(t *testing.T) {
+	config := cache.NewSnapshotCache(true, cache.IDHash{}, nil)
+	client, stop := startV3Server(t, config)
+	defer stop()
+
+	node := &v3core.Node{Id: "envoy"}
+	require.NoError(t, config.SetSnapshot(node.Id, cache.NewSnapshot("1", nil,
+		[]cache.Resource{resource.MakeCluster(resource.Ads, "cluster1")}, nil, nil)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.DeltaAggregatedResources(ctx)
+	require.NoError(t, err)
+
+	clusterType := v3TypeURL(cache.ClusterType)
+	require.NoError(t, stream.Send(&v3.DeltaDiscoveryRequest{Node: node, TypeUrl: clusterType}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, clusterType, res.TypeUrl)
+	require.Len(t, res.Resources, 1)
+	require.Equal(t, "cluster1", res.Resources[0].Name)
+	require.Equal(t, clusterType, res.Resources[0].Resource.TypeUrl)
+
+	// ACK, and only the difference comes along
+	require.NoError(t, stream.Send(&v3.DeltaDiscoveryRequest{TypeUrl: clusterType, ResponseNonce: res.Nonce}))
+	require.NoError(t, config.SetSnapshot(node.Id, cache.NewSnapshot("2", nil,
+		[]cache.Resource{resource.MakeCluster(resource.Ads, "cluster2")}, nil, nil)))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Resources, 1)
+	require.Equal(t, "cluster2", res.Resources[0].Name)
+	require.Equal(t, []string{"cluster1"}, res.RemovedResources)
+}
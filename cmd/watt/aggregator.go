@@ -2,9 +2,9 @@ package watt
 
 import (
 	"encoding/json"
-	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/datawire/ambassador/pkg/consulwatch"
@@ -15,47 +15,99 @@ import (
 	"github.com/datawire/ambassador/pkg/supervisor"
 )
 
-type WatchHook func(p *supervisor.Process, snapshot string) WatchSet
+// WatchHook works out the watches for a snapshot. See watchhook.go.
+type WatchHook func(p *supervisor.Process, snapshot string) (WatchSet, error)
 
 type aggregator struct {
+	// changes counts the changes, and flushed how many of them went
+	// out in a snapshot, so that a pending notification can be
+	// skipped when another one beat it to it. They come first to
+	// be 64-bit aligned for sync/atomic.
+	changes uint64
+	flushed uint64
 	// Input channel used to tell us about kubernetes state.
 	KubernetesEvents chan k8sEvent
 	// Input channel used to tell us about consul endpoints.
 	ConsulEvents chan consulEvent
+	// Input channels used to tell us about files and DNS records.
+	FileEvents    chan fileEvent
+	DNSEvents     chan dnsEvent
+	ConnectEvents chan connectEvent
 	// Output channel used to communicate with the k8s watch manager.
 	k8sWatches chan<- []KubernetesWatchSpec
 	// Output channel used to communicate with the consul watch manager.
 	consulWatches chan<- []ConsulWatchSpec
+	// Output channels used to communicate with the file and DNS watch
+	// managers, if they are running.
+	fileWatches    chan<- []WatchSpec
+	dnsWatches     chan<- []WatchSpec
+	connectWatches chan<- []WatchSpec
+	// Watches we always want, on top of what the watch hook says.
+	staticWatches WatchSet
 	// Output channel used to communicate with the invoker.
 	snapshots chan<- string
 	// We won't consider ourselves "bootstrapped" until we hear
 	// about all these kinds.
-	requiredKinds       []string
-	watchHook           WatchHook
-	limiter             limiter.Limiter
+	requiredKinds []string
+	watchHook     WatchHook
+	limiter       limiter.Limiter
+	// limiters, if set, limit every source and kind on its own,
+	// instead of limiter limiting everything together
+	limiters *limiter.Keyed
+	limitMux sync.Mutex
+	// the pending notifications, by limiter key
+	timers map[string]*time.Timer
+	// mux guards what the watches found, which is changed by their
+	// events and read by notify, and the errors, which are changed by
+	// the watches, the watch hook and notify
+	mux                 sync.Mutex
 	ids                 map[string]bool
 	kubernetesResources map[string]map[string][]k8s.Resource
 	consulEndpoints     map[string]consulwatch.Endpoints
-	bootstrapped        bool
-	notifyMux           sync.Mutex
+	files               map[string][]k8s.Resource
+	dnsRecords          map[string]watt.DNSRecords
+	connectCerts        map[string]watt.ConnectCerts
 	errors              map[string][]watt.Error
+	// removed are the file, DNS and Connect watches that are gone, whose
+	// workers may still send an event on their way out
+	removed      map[string]bool
+	bootstrapped bool
+	notifyMux    sync.Mutex
+	// compact snapshots aren't indented, which makes them a lot
+	// smaller in large clusters
+	compact bool
+	// status tells the API server how the watches are doing
+	status *statusBoard
 }
 
 func NewAggregator(snapshots chan<- string, k8sWatches chan<- []KubernetesWatchSpec, consulWatches chan<- []ConsulWatchSpec,
 	requiredKinds []string, watchHook WatchHook, limiter limiter.Limiter) *aggregator {
+	status := newStatusBoard()
+	if len(requiredKinds) > 0 {
+		status.setWatches(bootstrapSource, []string{strings.Join(requiredKinds, ",")})
+	}
 	return &aggregator{
 		KubernetesEvents:    make(chan k8sEvent),
 		ConsulEvents:        make(chan consulEvent),
+		FileEvents:          make(chan fileEvent),
+		DNSEvents:           make(chan dnsEvent),
+		ConnectEvents:       make(chan connectEvent),
 		k8sWatches:          k8sWatches,
 		consulWatches:       consulWatches,
 		snapshots:           snapshots,
 		requiredKinds:       requiredKinds,
 		watchHook:           watchHook,
 		limiter:             limiter,
+		timers:              make(map[string]*time.Timer),
 		ids:                 make(map[string]bool),
 		kubernetesResources: make(map[string]map[string][]k8s.Resource),
 		consulEndpoints:     make(map[string]consulwatch.Endpoints),
+		files:               make(map[string][]k8s.Resource),
+		dnsRecords:          make(map[string]watt.DNSRecords),
+		connectCerts:        make(map[string]watt.ConnectCerts),
+		removed:             make(map[string]bool),
 		errors:              make(map[string][]watt.Error),
+		status:              status,
 	}
 }
 
@@ -104,10 +156,23 @@ func (a *aggregator) Work(p *supervisor.Process) error {
 
 	p.Ready()
 
+	// keys are the limiter keys of all the events coalesced into the
+	// signal, so that a Mapping coalesced with Endpoints isn't held
+	// back by the limiter of the Endpoints
 	type eventSignal struct {
 		kubernetesEvent k8sEvent
+		keys            []string
 		skip            bool
 	}
+	coalesce := func(signal eventSignal, event k8sEvent) eventSignal {
+		key := kubernetesLimiterKey(event.kind)
+		for _, k := range signal.keys {
+			if k == key {
+				return eventSignal{kubernetesEvent: event, keys: signal.keys}
+			}
+		}
+		return eventSignal{kubernetesEvent: event, keys: append(signal.keys, key)}
+	}
 
 	kubernetesEventProcessor := make(chan eventSignal)
 	go func() {
@@ -117,10 +182,16 @@ func (a *aggregator) Work(p *supervisor.Process) error {
 				// corner case where we haven't yet received an event yet.
 				continue
 			}
-			a.maybeNotify(p)
+			a.maybeNotify(p, event.keys...)
 		}
 	}()
 
+	if len(a.requiredKinds) == 0 {
+		// without Kubernetes there's no event to get us started,
+		// so we kick things off ourselves to start the static watches
+		a.maybeNotify(p, "")
+	}
+
 	potentialKubernetesEventSignal := eventSignal{kubernetesEvent: k8sEvent{}, skip: true}
 	for {
 		select {
@@ -130,7 +201,7 @@ func (a *aggregator) Work(p *supervisor.Process) error {
 			// then we will overwrite potentialKubernetesEvent
 			// with a newer event while still processing a.setKubernetesResources
 			a.setKubernetesResources(potentialKubernetesEvent)
-			potentialKubernetesEventSignal = eventSignal{kubernetesEvent: potentialKubernetesEvent, skip: false}
+			potentialKubernetesEventSignal = coalesce(potentialKubernetesEventSignal, potentialKubernetesEvent)
 		case kubernetesEventProcessor <- potentialKubernetesEventSignal:
 			// if we aren't currently blocked in
 			// a.maybeNotify() then the above goroutine will be
@@ -138,14 +209,24 @@ func (a *aggregator) Work(p *supervisor.Process) error {
 			// will send the current potentialKubernetesEventSignal
 			// value over the kubernetesEventProcessor channel to be
 			// processed
+			potentialKubernetesEventSignal = eventSignal{skip: true}
 			select {
 			case potentialKubernetesEvent := <-a.KubernetesEvents:
 				// here we do blocking read of the next event for caveat #2.
 				a.setKubernetesResources(potentialKubernetesEvent)
-				potentialKubernetesEventSignal = eventSignal{kubernetesEvent: potentialKubernetesEvent, skip: false}
+				potentialKubernetesEventSignal = coalesce(potentialKubernetesEventSignal, potentialKubernetesEvent)
 			case event := <-a.ConsulEvents:
 				a.updateConsulResources(event)
-				a.maybeNotify(p)
+				a.maybeNotify(p, "consul/"+event.Endpoints.Service)
+			case event := <-a.FileEvents:
+				a.updateFileResources(event)
+				a.maybeNotify(p, "file")
+			case event := <-a.DNSEvents:
+				a.updateDNSRecords(event)
+				a.maybeNotify(p, "dns")
+			case event := <-a.ConnectEvents:
+				a.updateConnectCerts(event)
+				a.maybeNotify(p, "connect/"+event.service)
 			case <-p.Shutdown():
 				return nil
 			}
@@ -153,7 +234,18 @@ func (a *aggregator) Work(p *supervisor.Process) error {
 			// we are always reading and processing ConsulEvents directly,
 			// not coalescing them.
 			a.updateConsulResources(event)
-			a.maybeNotify(p)
+			a.maybeNotify(p, "consul/"+event.Endpoints.Service)
+		case event := <-a.FileEvents:
+			// like ConsulEvents, FileEvents and DNSEvents
+			// aren't coalesced
+			a.updateFileResources(event)
+			a.maybeNotify(p, "file")
+		case event := <-a.DNSEvents:
+			a.updateDNSRecords(event)
+			a.maybeNotify(p, "dns")
+		case event := <-a.ConnectEvents:
+			a.updateConnectCerts(event)
+			a.maybeNotify(p, "connect/"+event.service)
 		case <-p.Shutdown():
 			return nil
 		}
@@ -161,17 +253,239 @@ func (a *aggregator) Work(p *supervisor.Process) error {
 }
 
 func (a *aggregator) updateConsulResources(event consulEvent) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
 	a.ids[event.WatchId] = true
 	a.consulEndpoints[event.Endpoints.Service] = event.Endpoints
+	if event.Err != nil {
+		a.status.failed("consul", event.WatchId, event.Err.Error(), time.Now())
+	} else {
+		a.status.synced("consul", event.WatchId, len(event.Endpoints.Endpoints), time.Now())
+	}
+}
+
+// setSourceErrors replaces the errors of a watch with the latest ones. The
+// caller holds mux.
+func (a *aggregator) setSourceErrors(watchId string, errors []watt.Error) {
+	if len(errors) > 0 {
+		a.errors[watchId] = errors
+	} else {
+		delete(a.errors, watchId)
+	}
+}
+
+func (a *aggregator) updateFileResources(event fileEvent) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.removed[event.watchId] {
+		return
+	}
+	a.ids[event.watchId] = true
+	a.files[event.watchId] = event.resources
+	a.setSourceErrors(event.watchId, event.errors)
+	if len(event.errors) > 0 {
+		a.status.failed("file", event.watchId, event.errors[0].Message, time.Now())
+	} else {
+		a.status.synced("file", event.watchId, len(event.resources), time.Now())
+	}
+}
+
+func (a *aggregator) updateDNSRecords(event dnsEvent) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.removed[event.watchId] {
+		return
+	}
+	a.ids[event.watchId] = true
+	a.dnsRecords[event.watchId] = event.records
+	var errors []watt.Error
+	if event.err != nil {
+		errors = append(errors, watt.NewError(event.watchId, event.err.Error()))
+		a.status.failed("dns", event.watchId, event.err.Error(), time.Now())
+	} else {
+		a.status.synced("dns", event.watchId, len(event.records.Records), time.Now())
+	}
+	a.setSourceErrors(event.watchId, errors)
+}
+
+// updateConnectCerts keeps the certificates we had when there's an error. A
+// Connect watch is only initialized once it has both its leaf certificate and
+// the CA roots.
+func (a *aggregator) updateConnectCerts(event connectEvent) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.removed[event.watchId] {
+		return
+	}
+	certs := a.connectCerts[event.watchId]
+	certs.Id = event.id
+	certs.Service = event.service
+	if event.err != nil {
+		a.setSourceErrors(event.watchId, []watt.Error{watt.NewError(event.watchId, event.err.Error())})
+		a.status.failed("connect", event.watchId, event.err.Error(), time.Now())
+		a.connectCerts[event.watchId] = certs
+		return
+	}
+	if event.leaf != nil {
+		certs.Leaf = event.leaf
+	}
+	if event.roots != nil {
+		certs.Roots = event.roots
+	}
+	a.connectCerts[event.watchId] = certs
+	a.setSourceErrors(event.watchId, nil)
+
+	if certs.Leaf != nil && certs.Roots != nil {
+		a.ids[event.watchId] = true
+		a.status.synced("connect", event.watchId, 1+len(certs.Roots.Roots), time.Now())
+	}
+}
+
+// pruneSourceWatches forgets what the file, DNS and Connect watches that are
+// no longer in the watch set found, along with their errors.
+func (a *aggregator) pruneSourceWatches(watchset WatchSet) {
+	current := make(map[string]bool)
+	for _, w := range watchset.sourceWatches() {
+		current[w.WatchId()] = true
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for id := range a.removed {
+		if current[id] {
+			delete(a.removed, id)
+		}
+	}
+	gone := func(id string) bool {
+		if current[id] {
+			return false
+		}
+		a.removed[id] = true
+		delete(a.errors, id)
+		return true
+	}
+	for id := range a.files {
+		if gone(id) {
+			delete(a.files, id)
+		}
+	}
+	for id := range a.dnsRecords {
+		if gone(id) {
+			delete(a.dnsRecords, id)
+		}
+	}
+	for id := range a.connectCerts {
+		if gone(id) {
+			delete(a.connectCerts, id)
+		}
+	}
+}
+
+const (
+	// how long the errors of a watch that doesn't recover stick around
+	watchErrorTTL = 10 * time.Minute
+	// how many different errors of a watch we keep
+	maxWatchErrors = 10
+)
+
+// addWatchError adds an error of a Kubernetes watch, under its watch id, or
+// its source if it doesn't have one. An error that happened before bumps the
+// retries of the earlier one instead.
+func (a *aggregator) addWatchError(kError watt.Error) {
+	key := kError.WatchId
+	if key == "" {
+		key = kError.Source
+	}
+
+	var kept []watt.Error
+	found := false
+	for _, e := range a.errors[key] {
+		switch {
+		case e.Message == kError.Message && e.Class == kError.Class:
+			e.Retries++
+			e.Timestamp = kError.Timestamp
+			found = true
+		case expired(e, kError.Timestamp):
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if !found {
+		kept = append(kept, kError)
+	}
+	if len(kept) > maxWatchErrors {
+		kept = kept[len(kept)-maxWatchErrors:]
+	}
+	a.errors[key] = kept
+}
+
+// expired tells whether an error of a watch is too old to keep, at the given
+// Unix time.
+func expired(e watt.Error, now int64) bool {
+	return now-e.Timestamp > int64(watchErrorTTL/time.Second)
+}
+
+// expireWatchErrors drops the errors of the watches that are too old, so that
+// a watch that failed once and was never heard from again doesn't stay in the
+// snapshots. The caller holds mux.
+func (a *aggregator) expireWatchErrors(now time.Time) {
+	for key, errors := range a.errors {
+		var kept []watt.Error
+		for _, e := range errors {
+			// only the errors of watches have a class
+			if e.Class == "" || !expired(e, now.Unix()) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(a.errors, key)
+		} else if len(kept) < len(errors) {
+			a.errors[key] = kept
+		}
+	}
+}
+
+// pruneWatchErrors forgets the errors of the Kubernetes watches that are no
+// longer in the watch set.
+func (a *aggregator) pruneWatchErrors(watchset WatchSet) {
+	current := make(map[string]bool)
+	for _, w := range watchset.KubernetesWatches {
+		current[w.WatchId()] = true
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for key, errors := range a.errors {
+		if len(errors) > 0 && errors[0].Source == "kubernetes" && errors[0].WatchId == key && !current[key] {
+			delete(a.errors, key)
+		}
+	}
 }
 
 func (a *aggregator) setKubernetesResources(event k8sEvent) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	source, id := "kubernetes", event.watchId
+	if id == "" {
+		source, id = bootstrapSource, strings.Join(a.requiredKinds, ",")
+	}
+
 	if len(event.errors) > 0 {
 		for _, kError := range event.errors {
-			a.errors[kError.Source] = append(a.errors[kError.Source], kError)
+			a.addWatchError(kError)
 		}
+		a.status.failed(source, id, event.errors[len(event.errors)-1].Message, time.Now())
 		return
 	}
+	// the watch works, so whatever went wrong is over, unless some of its
+	// namespaces still can't be watched
+	if !event.partial {
+		if event.watchId == "" {
+			delete(a.errors, bootstrapSource)
+		} else {
+			delete(a.errors, event.watchId)
+		}
+	}
 	a.ids[event.watchId] = true
 	submap, ok := a.kubernetesResources[event.watchId]
 	if !ok {
@@ -179,22 +493,73 @@ func (a *aggregator) setKubernetesResources(event k8sEvent) {
 		a.kubernetesResources[event.watchId] = submap
 	}
 	submap[event.kind] = event.resources
+
+	// the bootstrap watch is synced once we've heard about all the kinds,
+	// and a partial watch is still failing
+	if !event.partial && (event.watchId != "" || a.kubernetesBootstrapped()) {
+		count := 0
+		for _, resources := range submap {
+			count += len(resources)
+		}
+		a.status.synced(source, id, count, time.Now())
+	}
 }
 
 func (a *aggregator) generateSnapshot() (string, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.expireWatchErrors(time.Now())
+
 	k8sResources := make(map[string][]k8s.Resource)
 	for _, submap := range a.kubernetesResources {
 		for k, v := range submap {
 			k8sResources[k] = append(k8sResources[k], v...)
 		}
 	}
+	var files map[string][]k8s.Resource
+	for _, resources := range a.files {
+		for _, r := range resources {
+			if files == nil {
+				files = make(map[string][]k8s.Resource)
+			}
+			kind := strings.ToLower(r.Kind())
+			files[kind] = append(files[kind], r)
+		}
+	}
+	var dnsRecords map[string]watt.DNSRecords
+	for _, records := range a.dnsRecords {
+		if dnsRecords == nil {
+			dnsRecords = make(map[string]watt.DNSRecords)
+		}
+		dnsRecords[records.Service] = records
+	}
+	// a service may have several watches, on different Consuls or with
+	// different tokens, so they go by the id of the watch, which is
+	// only there once it has both its leaf certificate and the roots
+	var connect map[string]watt.ConnectCerts
+	for watchId, certs := range a.connectCerts {
+		if certs.Leaf == nil || certs.Roots == nil {
+			continue
+		}
+		if connect == nil {
+			connect = make(map[string]watt.ConnectCerts)
+		}
+		key := certs.Id
+		if key == "" {
+			key = watchId
+		}
+		connect[key] = certs
+	}
+
 	s := watt.Snapshot{
-		Consul:     watt.ConsulSnapshot{Endpoints: a.consulEndpoints},
+		Consul:     watt.ConsulSnapshot{Endpoints: a.consulEndpoints, Connect: connect},
 		Kubernetes: k8sResources,
+		Files:      files,
+		DNS:        dnsRecords,
 		Errors:     a.errors,
 	}
 
-	jsonBytes, err := json.MarshalIndent(s, "", "    ")
+	jsonBytes, err := encodeSnapshot(s, a.compact)
 	if err != nil {
 		return "{}", err
 	}
@@ -202,7 +567,27 @@ func (a *aggregator) generateSnapshot() (string, error) {
 	return string(jsonBytes), nil
 }
 
+// encodeSnapshot encodes a snapshot, or a snapshot delta, as JSON.
+func encodeSnapshot(v interface{}, compact bool) ([]byte, error) {
+	if compact {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "    ")
+}
+
 func (a *aggregator) isKubernetesBootstrapped(p *supervisor.Process) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.kubernetesBootstrapped()
+}
+
+// kubernetesBootstrapped is isKubernetesBootstrapped for callers that hold
+// mux.
+func (a *aggregator) kubernetesBootstrapped() bool {
+	if len(a.requiredKinds) == 0 {
+		// not using Kubernetes
+		return true
+	}
 	submap, sok := a.kubernetesResources[""]
 	if !sok {
 		return false
@@ -223,6 +608,8 @@ func (a *aggregator) isKubernetesBootstrapped(p *supervisor.Process) bool {
 // referenced by kubernetes have populated endpoint information (even
 // if the value of the populated info is an empty set of endpoints).
 func (a *aggregator) isComplete(p *supervisor.Process, watchset WatchSet) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
 	complete := true
 
 	for _, w := range watchset.KubernetesWatches {
@@ -243,21 +630,74 @@ func (a *aggregator) isComplete(p *supervisor.Process, watchset WatchSet) bool {
 		}
 	}
 
+	for _, w := range watchset.sourceWatches() {
+		if _, ok := a.ids[w.WatchId()]; ok {
+			p.Logf("initialized watch: %s", w.WatchId())
+		} else {
+			complete = false
+			p.Logf("waiting for watch: %s", w.WatchId())
+		}
+	}
+
 	return complete
 }
 
-func (a *aggregator) maybeNotify(p *supervisor.Process) {
+// kubernetesLimiterKey returns the limiter key of a Kubernetes kind.
+func kubernetesLimiterKey(kind string) string {
+	if kind == "" {
+		return "kubernetes"
+	}
+	return "kubernetes/" + strings.ToLower(kind)
+}
+
+// maybeNotify asks the limiter of every key whether to notify about a
+// change. Keys are like "consul/SERVICE" or "kubernetes/KIND".
+func (a *aggregator) maybeNotify(p *supervisor.Process, keys ...string) {
 	now := time.Now()
-	delay := a.limiter.Limit(now)
-	if delay == 0 {
+	change := atomic.AddUint64(&a.changes, 1)
+
+	if a.limiters == nil {
+		// one limiter for everything
+		keys = []string{""}
+	}
+
+	notify := false
+	a.limitMux.Lock()
+	for _, key := range keys {
+		l := a.limiter
+		if a.limiters != nil {
+			l = a.limiters.For(key)
+		}
+
+		delay := l.Limit(now)
+		if delay == 0 {
+			notify = true
+		} else if delay > 0 {
+			// a positive delay replaces the pending one, if any
+			if timer, ok := a.timers[key]; ok {
+				timer.Stop()
+			}
+			a.timers[key] = time.AfterFunc(delay, func() {
+				a.notifyChange(p, change)
+			})
+		}
+	}
+	a.limitMux.Unlock()
+
+	if notify {
 		a.notify(p)
-	} else if delay > 0 {
-		time.AfterFunc(delay, func() {
-			a.notify(p)
-		})
 	}
 }
 
+// notifyChange notifies, unless a snapshot with the change in it went out
+// already.
+func (a *aggregator) notifyChange(p *supervisor.Process, change uint64) {
+	if atomic.LoadUint64(&a.flushed) >= change {
+		return
+	}
+	a.notify(p)
+}
+
 func (a *aggregator) notify(p *supervisor.Process) {
 	a.notifyMux.Lock()
 	defer a.notifyMux.Unlock()
@@ -265,17 +705,35 @@ func (a *aggregator) notify(p *supervisor.Process) {
 	if !a.isKubernetesBootstrapped(p) {
 		return
 	}
+	// everything up to here makes it in the snapshot
+	changes := atomic.LoadUint64(&a.changes)
 
 	watchset := a.getWatches(p)
 
 	p.Logf("found %d kubernetes watches", len(watchset.KubernetesWatches))
 	p.Logf("found %d consul watches", len(watchset.ConsulWatches))
+	a.setWatchStatus(watchset)
+	a.pruneSourceWatches(watchset)
+	a.pruneWatchErrors(watchset)
 	a.k8sWatches <- watchset.KubernetesWatches
 	a.consulWatches <- watchset.ConsulWatches
+	if a.fileWatches != nil {
+		p.Logf("found %d file watches", len(watchset.FileWatches))
+		a.fileWatches <- watchset.fileSpecs()
+	}
+	if a.dnsWatches != nil {
+		p.Logf("found %d dns watches", len(watchset.DNSWatches))
+		a.dnsWatches <- watchset.dnsSpecs()
+	}
+	if a.connectWatches != nil {
+		p.Logf("found %d connect watches", len(watchset.ConnectWatches))
+		a.connectWatches <- watchset.connectSpecs()
+	}
 
 	if !a.bootstrapped && a.isComplete(p, watchset) {
 		p.Logf("bootstrapped!")
 		a.bootstrapped = true
+		a.status.setBootstrapped()
 	}
 
 	if a.bootstrapped {
@@ -286,68 +744,64 @@ func (a *aggregator) notify(p *supervisor.Process) {
 		}
 
 		a.snapshots <- snapshot
+		atomic.StoreUint64(&a.flushed, changes)
 	}
 }
 
-func (a *aggregator) getWatches(p *supervisor.Process) WatchSet {
-	snapshot, err := a.generateSnapshot()
-	if err != nil {
-		p.Logf("generate snapshot failed %v", err)
-		return WatchSet{}
+// setWatchStatus tells the status board about the current watches, before
+// they are sent to the watch managers so that it doesn't miss their first
+// events.
+func (a *aggregator) setWatchStatus(watchset WatchSet) {
+	var ids []string
+	for _, w := range watchset.KubernetesWatches {
+		ids = append(ids, w.WatchId())
 	}
-	result := a.watchHook(p, snapshot)
-	return result.interpolate()
-}
+	a.status.setWatches("kubernetes", ids)
 
-func ExecWatchHook(watchHooks []string) WatchHook {
-	return func(p *supervisor.Process, snapshot string) WatchSet {
-		result := WatchSet{}
+	ids = nil
+	for _, w := range watchset.ConsulWatches {
+		ids = append(ids, w.WatchId())
+	}
+	a.status.setWatches("consul", ids)
 
-		for _, hook := range watchHooks {
-			ws := invokeHook(p, hook, snapshot)
-			result.KubernetesWatches = append(result.KubernetesWatches, ws.KubernetesWatches...)
-			result.ConsulWatches = append(result.ConsulWatches, ws.ConsulWatches...)
-		}
+	ids = nil
+	for _, w := range watchset.FileWatches {
+		ids = append(ids, w.WatchId())
+	}
+	a.status.setWatches("file", ids)
 
-		return result
+	ids = nil
+	for _, w := range watchset.DNSWatches {
+		ids = append(ids, w.WatchId())
 	}
-}
+	a.status.setWatches("dns", ids)
 
-func lines(st string) []string {
-	return strings.Split(st, "\n")
+	ids = nil
+	for _, w := range watchset.ConnectWatches {
+		ids = append(ids, w.WatchId())
+	}
+	a.status.setWatches("connect", ids)
 }
 
-func invokeHook(p *supervisor.Process, hook, snapshot string) WatchSet {
-	cmd := exec.Command("sh", "-c", hook)
-	cmd.Stdin = strings.NewReader(snapshot)
-	var watches, errors strings.Builder
-	cmd.Stdout = &watches
-	cmd.Stderr = &errors
-	err := cmd.Run()
-	stderr := errors.String()
-	if stderr != "" {
-		for _, line := range lines(stderr) {
-			p.Logf("watch hook stderr: %s", line)
-		}
-	}
+func (a *aggregator) getWatches(p *supervisor.Process) WatchSet {
+	snapshot, err := a.generateSnapshot()
 	if err != nil {
-		p.Logf("watch hook failed: %v", err)
+		p.Logf("generate snapshot failed %v", err)
 		return WatchSet{}
 	}
-
-	encoded := watches.String()
-
-	decoder := json.NewDecoder(strings.NewReader(encoded))
-	decoder.DisallowUnknownFields()
-	result := WatchSet{}
-	err = decoder.Decode(&result)
+	result, err := a.watchHook(p, snapshot)
+	result.FileWatches = append(result.FileWatches, a.staticWatches.FileWatches...)
+	result.DNSWatches = append(result.DNSWatches, a.staticWatches.DNSWatches...)
+	result.ConnectWatches = append(result.ConnectWatches, a.staticWatches.ConnectWatches...)
+	// the errors of the last run of the watch hook are the ones that
+	// matter, so they replace the earlier ones
+	a.mux.Lock()
+	defer a.mux.Unlock()
 	if err != nil {
-		for _, line := range lines(encoded) {
-			p.Logf("watch hook: %s", line)
-		}
-		p.Logf("watchset decode failed: %v", err)
-		return WatchSet{}
+		p.Logf("watch hook failed: %v", err)
+		a.errors[watchHookErrorSource] = []watt.Error{watt.NewError(watchHookErrorSource, err.Error())}
+	} else {
+		delete(a.errors, watchHookErrorSource)
 	}
-
-	return result
+	return result.interpolate()
 }
@@ -3,6 +3,7 @@ package watt
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -134,20 +135,20 @@ var WATCH = ConsulWatchSpec{
 //   b) received (possibly empty) endpoint info about all referenced
 //      consul services...
 func TestAggregatorBootstrap(t *testing.T) {
-	watchHook := func(p *supervisor.Process, snapshot string) WatchSet {
+	watchHook := func(p *supervisor.Process, snapshot string) (WatchSet, error) {
 		if strings.Contains(snapshot, "configmap") {
 			return WatchSet{
 				ConsulWatches: []ConsulWatchSpec{WATCH},
-			}
+			}, nil
 		} else {
-			return WatchSet{}
+			return WatchSet{}, nil
 		}
 	}
 	iso := startAggIsolator(t, []string{"service", "configmap"}, watchHook)
 	defer iso.Stop()
 
 	// initial kubernetes state is just services
-	iso.aggregator.KubernetesEvents <- k8sEvent{"", "service", SERVICES, nil}
+	iso.aggregator.KubernetesEvents <- k8sEvent{"", "service", SERVICES, nil, false}
 
 	// we should not generate a snapshot or consulWatches yet
 	// because we specified configmaps are required
@@ -156,7 +157,7 @@ func TestAggregatorBootstrap(t *testing.T) {
 
 	// the configmap references a consul service, so we shouldn't
 	// get a snapshot yet, but we should get watches
-	iso.aggregator.KubernetesEvents <- k8sEvent{"", "configmap", RESOLVER, nil}
+	iso.aggregator.KubernetesEvents <- k8sEvent{"", "configmap", RESOLVER, nil, false}
 	expect(t, iso.snapshots, Timeout(100*time.Millisecond))
 	expect(t, iso.consulWatches, func(watches []ConsulWatchSpec) bool {
 		if len(watches) != 1 {
@@ -185,6 +186,7 @@ func TestAggregatorBootstrap(t *testing.T) {
 				},
 			},
 		},
+		nil,
 	}
 
 	expect(t, iso.snapshots, func(snapshot string) bool {
@@ -197,3 +199,280 @@ func TestAggregatorBootstrap(t *testing.T) {
 		return ok
 	})
 }
+
+// Check that a failing watch hook shows up in the snapshot errors, and goes
+// away once the hook succeeds again.
+func TestAggregatorWatchHookErrors(t *testing.T) {
+	fail := true
+	watchHook := func(p *supervisor.Process, snapshot string) (WatchSet, error) {
+		if fail {
+			return WatchSet{}, errors.New("hook exploded")
+		}
+		return WatchSet{}, nil
+	}
+	iso := startAggIsolator(t, []string{"service"}, watchHook)
+	defer iso.Stop()
+
+	hookErrors := func(snapshot string) []watt.Error {
+		s := &watt.Snapshot{}
+		if err := json.Unmarshal([]byte(snapshot), s); err != nil {
+			return nil
+		}
+		return s.Errors[watchHookErrorSource]
+	}
+
+	iso.aggregator.KubernetesEvents <- k8sEvent{"", "service", SERVICES, nil, false}
+	expect(t, iso.snapshots, func(snapshot string) bool {
+		errs := hookErrors(snapshot)
+		return len(errs) == 1 && errs[0].Message == "hook exploded"
+	})
+
+	fail = false
+	iso.aggregator.KubernetesEvents <- k8sEvent{"", "service", SERVICES, nil, false}
+	expect(t, iso.snapshots, func(snapshot string) bool {
+		return len(hookErrors(snapshot)) == 0
+	})
+}
+
+// Check that the limiter of one kind doesn't hold back the others, and that
+// a pending notification is dropped once its change went out anyway.
+func TestAggregatorLimiters(t *testing.T) {
+	watchHook := func(p *supervisor.Process, snapshot string) (WatchSet, error) {
+		return WatchSet{}, nil
+	}
+	iso := newAggIsolator(t, []string{"service"}, watchHook)
+	iso.aggregator.limiters = limiter.NewKeyed(map[string]limiter.Policy{
+		"kubernetes/service": func() limiter.Limiter { return limiter.NewInterval(200 * time.Millisecond) },
+	}, limiter.NewUnlimited)
+	iso.Start()
+	defer iso.Stop()
+
+	iso.aggregator.KubernetesEvents <- k8sEvent{"", "service", SERVICES, nil, false}
+	expect(t, iso.snapshots, func(snapshot string) bool {
+		return strings.Contains(snapshot, "foo")
+	})
+
+	// this one is held back...
+	iso.aggregator.KubernetesEvents <- k8sEvent{"", "service", resources(`
+---
+kind: Service
+apiVersion: v1
+metadata:
+  name: baz
+`), nil, false}
+	expect(t, iso.snapshots, Timeout(50*time.Millisecond))
+
+	// ...until a mapping comes along
+	iso.aggregator.KubernetesEvents <- k8sEvent{"", "mapping", resources(`
+---
+kind: Mapping
+apiVersion: getambassador.io/v2
+metadata:
+  name: qux
+`), nil, false}
+	expect(t, iso.snapshots, func(snapshot string) bool {
+		return strings.Contains(snapshot, "baz") && strings.Contains(snapshot, "qux")
+	})
+
+	// and then there's nothing left to send
+	expect(t, iso.snapshots, Timeout(400*time.Millisecond))
+}
+
+// Check that watch errors are deduplicated, and cleared when the watch
+// recovers.
+func TestAggregatorWatchErrors(t *testing.T) {
+	a := NewAggregator(nil, nil, nil, []string{"service"}, nil, nil)
+	watchId := "mapping|*|*|*"
+	forbidden := errors.New(`mappings.getambassador.io is forbidden`)
+
+	a.setKubernetesResources(makeWatchErrorEvent("kubernetes", watchId, forbidden))
+	a.setKubernetesResources(makeWatchErrorEvent("kubernetes", watchId, forbidden))
+	a.setKubernetesResources(makeWatchErrorEvent("kubernetes", watchId, errors.New("connection refused")))
+	if len(a.errors[watchId]) != 2 {
+		t.Fatalf("expected 2 errors, got %v", a.errors[watchId])
+	}
+	if a.errors[watchId][0].Retries != 1 || a.errors[watchId][1].Retries != 0 {
+		t.Errorf("unexpected retries: %v", a.errors[watchId])
+	}
+
+	// errors that are too old go away
+	old := makeWatchErrorEvent("kubernetes", watchId, errors.New("timeout"))
+	old.errors[0].Timestamp -= int64(2 * watchErrorTTL / time.Second)
+	a.errors[watchId] = append(a.errors[watchId], old.errors[0])
+	a.setKubernetesResources(makeWatchErrorEvent("kubernetes", watchId, forbidden))
+	if len(a.errors[watchId]) != 2 || a.errors[watchId][0].Retries != 2 {
+		t.Errorf("unexpected errors: %v", a.errors[watchId])
+	}
+
+	a.setKubernetesResources(k8sEvent{watchId: watchId, kind: "mapping"})
+	if _, ok := a.errors[watchId]; ok {
+		t.Errorf("expected the errors to be cleared, got %v", a.errors[watchId])
+	}
+
+	a.setKubernetesResources(makeWatchErrorEvent("kubebootstrap", "", forbidden))
+	if len(a.errors[bootstrapSource]) != 1 {
+		t.Errorf("expected a bootstrap error, got %v", a.errors)
+	}
+	a.setKubernetesResources(k8sEvent{kind: "service", resources: SERVICES})
+	if len(a.errors) != 0 {
+		t.Errorf("expected no errors, got %v", a.errors)
+	}
+}
+
+// Check that the errors of a watch that's gone, or that were never followed
+// by anything, don't stay in the snapshots.
+func TestAggregatorStaleWatchErrors(t *testing.T) {
+	a := NewAggregator(nil, nil, nil, nil, nil, nil)
+	kept := KubernetesWatchSpec{Kind: "mapping"}
+	gone := KubernetesWatchSpec{Kind: "service"}
+	failed := errors.New("connection refused")
+
+	a.setKubernetesResources(makeWatchErrorEvent("kubernetes", kept.WatchId(), failed))
+	a.setKubernetesResources(makeWatchErrorEvent("kubernetes", gone.WatchId(), failed))
+	a.setSourceErrors(watchHookErrorSource, []watt.Error{watt.NewError(watchHookErrorSource, "oops")})
+	a.pruneWatchErrors(WatchSet{KubernetesWatches: []KubernetesWatchSpec{kept}})
+	if len(a.errors) != 2 || len(a.errors[kept.WatchId()]) != 1 || len(a.errors[watchHookErrorSource]) != 1 {
+		t.Errorf("expected the errors of the kept watch and the hook, got %v", a.errors)
+	}
+
+	a.errors[kept.WatchId()][0].Timestamp -= int64(2 * watchErrorTTL / time.Second)
+	a.errors[watchHookErrorSource][0].Timestamp -= int64(2 * watchErrorTTL / time.Second)
+	snapshot, err := a.generateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &watt.Snapshot{}
+	if err := json.Unmarshal([]byte(snapshot), s); err != nil {
+		t.Fatal(err)
+	}
+	// the hook error isn't a watch error, it's there until the hook works
+	if len(s.Errors) != 1 || len(s.Errors[watchHookErrorSource]) != 1 {
+		t.Errorf("expected only the hook error, got %v", s.Errors)
+	}
+}
+
+func TestNewLimiters(t *testing.T) {
+	// without --limit or --max-staleness, one limiter limits everything
+	limiters, err := newLimiters(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiters != nil {
+		t.Errorf("expected no limiters, got %v", limiters)
+	}
+
+	limiters, err = newLimiters(nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiters == nil {
+		t.Error("expected limiters for --max-staleness")
+	}
+
+	if _, err := newLimiters([]string{"consul"}, 0); err == nil {
+		t.Error("expected an error for a --limit without a policy")
+	}
+}
+
+func TestAggregatorPruneSourceWatches(t *testing.T) {
+	a := NewAggregator(nil, nil, nil, nil, nil, nil)
+	keep := FileWatchSpec{Path: "/keep"}
+	gone := FileWatchSpec{Path: "/gone"}
+	dns := DNSWatchSpec{Id: "gone", Service: "foo"}
+	connect := ConnectWatchSpec{Id: "gone", ConsulAddress: "127.0.0.1:8500", ServiceName: "foo"}
+	watchset := WatchSet{
+		FileWatches:    []FileWatchSpec{keep, gone},
+		DNSWatches:     []DNSWatchSpec{dns},
+		ConnectWatches: []ConnectWatchSpec{connect},
+	}
+	a.pruneSourceWatches(watchset)
+
+	a.updateFileResources(fileEvent{watchId: keep.WatchId(), resources: SERVICES})
+	a.updateFileResources(fileEvent{watchId: gone.WatchId(), errors: []watt.Error{watt.NewError(gone.WatchId(), "oops")}})
+	a.updateDNSRecords(dnsEvent{watchId: dns.WatchId(), records: watt.DNSRecords{Service: "foo"}})
+	a.updateConnectCerts(connectEvent{watchId: connect.WatchId(), service: "foo", roots: &consulwatch.CARoots{}})
+
+	a.pruneSourceWatches(WatchSet{FileWatches: []FileWatchSpec{keep}})
+	if len(a.files) != 1 || len(a.files[keep.WatchId()]) != len(SERVICES) {
+		t.Errorf("expected only the kept file watch, got %v", a.files)
+	}
+	if len(a.dnsRecords) != 0 || len(a.connectCerts) != 0 {
+		t.Errorf("expected no DNS records or certificates, got %v and %v", a.dnsRecords, a.connectCerts)
+	}
+	if len(a.errors) != 0 {
+		t.Errorf("expected no errors, got %v", a.errors)
+	}
+
+	// a watch on its way out doesn't bring anything back
+	a.updateFileResources(fileEvent{watchId: gone.WatchId(), resources: SERVICES})
+	a.updateDNSRecords(dnsEvent{watchId: dns.WatchId(), records: watt.DNSRecords{Service: "foo"}})
+	if len(a.files) != 1 || len(a.dnsRecords) != 0 {
+		t.Errorf("expected events of removed watches to be ignored, got %v and %v", a.files, a.dnsRecords)
+	}
+
+	// unless it's back
+	a.pruneSourceWatches(watchset)
+	a.updateFileResources(fileEvent{watchId: gone.WatchId(), resources: SERVICES})
+	if len(a.files) != 2 {
+		t.Errorf("expected the file watch to be back, got %v", a.files)
+	}
+}
+
+// Check that the watch hook and the watches can change the errors at the
+// same time.
+func TestAggregatorConcurrentErrors(t *testing.T) {
+	watchHook := func(p *supervisor.Process, snapshot string) (WatchSet, error) {
+		return WatchSet{}, errors.New("hook exploded")
+	}
+	a := NewAggregator(nil, nil, nil, nil, watchHook, nil)
+
+	supervisor.MustRun("errors", func(p *supervisor.Process) error {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 200; i++ {
+				a.getWatches(p)
+			}
+		}()
+		for i := 0; i < 200; i++ {
+			a.setKubernetesResources(makeWatchErrorEvent("kubernetes", "mapping|*|*|*", errors.New("oops")))
+			a.setKubernetesResources(k8sEvent{watchId: "mapping|*|*|*", kind: "mapping"})
+		}
+		<-done
+		return nil
+	})
+
+	if len(a.errors[watchHookErrorSource]) != 1 {
+		t.Errorf("expected the watch hook error, got %v", a.errors)
+	}
+}
+
+// Check that what the watches found can change while a snapshot is made.
+func TestAggregatorConcurrentEvents(t *testing.T) {
+	a := NewAggregator(nil, nil, nil, nil, nil, nil)
+	consul := ConsulWatchSpec{ConsulAddress: "127.0.0.1:8500", Datacenter: "dc1", ServiceName: "bar"}
+	watchset := WatchSet{ConsulWatches: []ConsulWatchSpec{consul}}
+
+	supervisor.MustRun("events", func(p *supervisor.Process) error {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 200; i++ {
+				a.isComplete(p, watchset)
+				if _, err := a.generateSnapshot(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		for i := 0; i < 200; i++ {
+			a.updateConsulResources(consulEvent{WatchId: consul.WatchId(), Endpoints: consulwatch.Endpoints{Service: "bar"}})
+			a.setKubernetesResources(k8sEvent{watchId: "service|*|*|*", kind: "service", resources: SERVICES})
+		}
+		<-done
+
+		if !a.isComplete(p, watchset) {
+			t.Error("expected the consul watch to be initialized")
+		}
+		return nil
+	})
+}
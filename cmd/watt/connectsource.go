@@ -0,0 +1,97 @@
+package watt
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/datawire/ambassador/pkg/consulwatch"
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+// connectEvent carries either a new leaf certificate, new CA roots, or an
+// error.
+type connectEvent struct {
+	watchId string
+	id      string
+	service string
+	leaf    *consulwatch.Certificate
+	roots   *consulwatch.CARoots
+	err     error
+}
+
+// ConnectWatchMaker makes watches on the Consul Connect leaf certificate of
+// a service and on the Connect CA roots. Consul hands out a new leaf
+// certificate before the old one expires, and new roots when the CA is
+// rotated, and both make for a new snapshot.
+type ConnectWatchMaker struct {
+	aggregatorCh chan<- connectEvent
+	// shared with the ConsulWatchMaker
+	clients *consulClients
+}
+
+func (m *ConnectWatchMaker) MakeWatch(spec WatchSpec) (*supervisor.Worker, error) {
+	cspec, ok := spec.(ConnectWatchSpec)
+	if !ok {
+		return nil, fmt.Errorf("not a Consul Connect watch: %v", spec)
+	}
+	if cspec.ServiceName == "" {
+		return nil, fmt.Errorf("Consul Connect watch %s: service name is empty", cspec.WatchId())
+	}
+
+	// like the Consul watches, the client is got by every run of the
+	// worker
+	worker := &supervisor.Worker{
+		Name: fmt.Sprintf("connect:%s", cspec.WatchId()),
+		Work: func(p *supervisor.Process) error {
+			consul, err := m.clients.get(cspec.ConsulAddress, cspec.Consul)
+			if err != nil {
+				return err
+			}
+			logger := log.New(os.Stdout, "", log.LstdFlags)
+			leafWatcher, err := consulwatch.NewConnectLeafWatcher(consul, logger, cspec.ServiceName)
+			if err != nil {
+				return err
+			}
+			rootsWatcher, err := consulwatch.NewConnectCARootsWatcher(consul, logger)
+			if err != nil {
+				return err
+			}
+
+			event := connectEvent{watchId: cspec.WatchId(), id: cspec.Id, service: cspec.ServiceName}
+			leafWatcher.Watch(func(leaf *consulwatch.Certificate, err error) {
+				e := event
+				e.leaf, e.err = leaf, err
+				m.aggregatorCh <- e
+			})
+			rootsWatcher.Watch(func(roots *consulwatch.CARoots, err error) {
+				e := event
+				e.roots, e.err = roots, err
+				m.aggregatorCh <- e
+			})
+
+			_ = p.Go(func(p *supervisor.Process) error {
+				if err := leafWatcher.Start(); err != nil {
+					p.Logf("failed to start leaf certificate watcher %v", err)
+					return err
+				}
+				return nil
+			})
+			_ = p.Go(func(p *supervisor.Process) error {
+				if err := rootsWatcher.Start(); err != nil {
+					p.Logf("failed to start CA roots watcher %v", err)
+					return err
+				}
+				return nil
+			})
+
+			err = m.clients.wait(p, cspec.ConsulAddress, cspec.Consul, consul)
+			leafWatcher.Stop()
+			rootsWatcher.Stop()
+			return err
+		},
+		Retry: true,
+	}
+
+	return worker, nil
+}
@@ -0,0 +1,156 @@
+package watt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/consulwatch"
+	"github.com/datawire/ambassador/pkg/supervisor"
+	"github.com/datawire/ambassador/pkg/watt"
+)
+
+// fakeConnect serves a leaf certificate for the foo service and one CA root.
+func fakeConnect(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("index") == "1" {
+		// nothing changed, block like Consul does
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	w.Header().Set("X-Consul-Index", "1")
+	switch r.URL.Path {
+	case "/v1/agent/connect/ca/leaf/foo":
+		_ = json.NewEncoder(w).Encode(&consulapi.LeafCert{
+			SerialNumber:  "01",
+			CertPEM:       "leaf",
+			PrivateKeyPEM: "key",
+			Service:       "foo",
+		})
+	case "/v1/agent/connect/ca/roots":
+		_ = json.NewEncoder(w).Encode(&consulapi.CARootList{
+			ActiveRootID: "root",
+			TrustDomain:  "example.consul",
+			Roots:        []*consulapi.CARoot{{ID: "root", Name: "Root", RootCertPEM: "root", Active: true}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConnectWatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(fakeConnect))
+	defer server.Close()
+
+	events := make(chan connectEvent, 10)
+	maker := &ConnectWatchMaker{aggregatorCh: events, clients: &consulClients{}}
+	_, err := maker.MakeWatch(ConnectWatchSpec{ConsulAddress: "127.0.0.1:8500"})
+	require.Error(t, err)
+
+	spec := ConnectWatchSpec{Id: "foo", ConsulAddress: strings.TrimPrefix(server.URL, "http://"), ServiceName: "foo"}
+	worker, err := maker.MakeWatch(spec)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sup := supervisor.WithContext(ctx)
+	sup.Supervise(worker)
+	done := make(chan struct{})
+	go func() {
+		sup.Run()
+		close(done)
+	}()
+
+	var leaf *consulwatch.Certificate
+	var roots *consulwatch.CARoots
+	for leaf == nil || roots == nil {
+		select {
+		case event := <-events:
+			require.NoError(t, event.err)
+			require.Equal(t, spec.WatchId(), event.watchId)
+			require.Equal(t, "foo", event.service)
+			if event.leaf != nil {
+				leaf = event.leaf
+			}
+			if event.roots != nil {
+				roots = event.roots
+			}
+		case <-ctx.Done():
+			t.Fatal("no certificates from consul")
+		}
+	}
+
+	sup.Shutdown()
+	<-done
+
+	require.Equal(t, "leaf", leaf.PEM)
+	require.Equal(t, "key", leaf.PrivateKeyPEM)
+	require.Equal(t, "root", roots.ActiveRootID)
+	require.Equal(t, "root", roots.Roots["root"].PEM)
+}
+
+func TestAggregatorConnectCerts(t *testing.T) {
+	a := NewAggregator(nil, nil, nil, nil, nil, nil)
+	spec := ConnectWatchSpec{Id: "foo", ConsulAddress: "127.0.0.1:8500", ServiceName: "foo"}
+	watchId := spec.WatchId()
+
+	a.updateConnectCerts(connectEvent{watchId: watchId, id: "foo", service: "foo",
+		leaf: &consulwatch.Certificate{SerialNumber: "1"}})
+	require.False(t, a.ids[watchId])
+
+	roots := &consulwatch.CARoots{ActiveRootID: "root"}
+	a.updateConnectCerts(connectEvent{watchId: watchId, id: "foo", service: "foo", roots: roots})
+	require.True(t, a.ids[watchId])
+
+	// errors keep the certificates we have
+	a.updateConnectCerts(connectEvent{watchId: watchId, id: "foo", service: "foo", err: errors.New("oops")})
+	require.Equal(t, 1, len(a.errors[watchId]))
+
+	// a rotated leaf certificate replaces the old one
+	a.updateConnectCerts(connectEvent{watchId: watchId, id: "foo", service: "foo",
+		leaf: &consulwatch.Certificate{SerialNumber: "2"}})
+	require.Empty(t, a.errors[watchId])
+
+	encoded, err := a.generateSnapshot()
+	require.NoError(t, err)
+	var snapshot watt.Snapshot
+	require.NoError(t, json.Unmarshal([]byte(encoded), &snapshot))
+	require.Equal(t, map[string]watt.ConnectCerts{
+		"foo": {Id: "foo", Service: "foo", Leaf: &consulwatch.Certificate{SerialNumber: "2"}, Roots: roots},
+	}, snapshot.Consul.Connect)
+
+	// the same service on another Consul is there as well, once it has
+	// both its leaf certificate and the roots
+	other := ConnectWatchSpec{Id: "foo-east", ConsulAddress: "10.0.0.1:8500", ServiceName: "foo"}
+	a.updateConnectCerts(connectEvent{watchId: other.WatchId(), id: other.Id, service: "foo",
+		leaf: &consulwatch.Certificate{SerialNumber: "3"}})
+	unnamed := ConnectWatchSpec{ConsulAddress: "10.0.0.2:8500", ServiceName: "foo"}
+	a.updateConnectCerts(connectEvent{watchId: unnamed.WatchId(), service: "foo",
+		leaf: &consulwatch.Certificate{SerialNumber: "4"}, roots: roots})
+
+	encoded, err = a.generateSnapshot()
+	require.NoError(t, err)
+	snapshot = watt.Snapshot{}
+	require.NoError(t, json.Unmarshal([]byte(encoded), &snapshot))
+	require.Len(t, snapshot.Consul.Connect, 2)
+	require.Equal(t, "2", snapshot.Consul.Connect["foo"].Leaf.SerialNumber)
+	require.Equal(t, "4", snapshot.Consul.Connect[unnamed.WatchId()].Leaf.SerialNumber)
+
+	a.updateConnectCerts(connectEvent{watchId: other.WatchId(), id: other.Id, service: "foo", roots: roots})
+	encoded, err = a.generateSnapshot()
+	require.NoError(t, err)
+	snapshot = watt.Snapshot{}
+	require.NoError(t, json.Unmarshal([]byte(encoded), &snapshot))
+	require.Len(t, snapshot.Consul.Connect, 3)
+	require.Equal(t, "3", snapshot.Consul.Connect["foo-east"].Leaf.SerialNumber)
+}
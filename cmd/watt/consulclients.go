@@ -0,0 +1,192 @@
+package watt
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+// ConsulConfig is how to talk to a Consul: the ACL token, TLS, and the
+// namespace. It comes from the resolver, so it is the same for all the
+// watches of a resolver. Secrets are referenced by file, so they can be
+// mounted rather than passed around in the watch set.
+type ConsulConfig struct {
+	// Token is the ACL token. TokenFile, if set, is read instead.
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token-file,omitempty"`
+
+	// Namespace is the Consul Enterprise namespace of the services.
+	Namespace string `json:"namespace,omitempty"`
+
+	// TLS is used when the scheme is https, either in the Consul address
+	// or here.
+	Scheme             string `json:"scheme,omitempty"`
+	CAFile             string `json:"ca-file,omitempty"`
+	CertFile           string `json:"cert-file,omitempty"`
+	KeyFile            string `json:"key-file,omitempty"`
+	ServerName         string `json:"server-name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure-skip-verify,omitempty"`
+}
+
+// key identifies the config without giving away the token.
+func (c *ConsulConfig) key() string {
+	if c == nil {
+		return ""
+	}
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		// can't happen, it's all strings and bools
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(bytes))[:12]
+}
+
+// consulClients shares Consul clients, and with them their connections,
+// between the watches on the same Consul with the same config. The zero
+// value is ready to use.
+//
+// Clients are never closed: there's one per Consul and config, and idle
+// connections time out on their own. A token file is read every time a
+// client is asked for, and a token that changed gets a new client, which
+// replaces the old one.
+type consulClients struct {
+	mux     sync.Mutex
+	clients map[string]consulClient
+}
+
+type consulClient struct {
+	client *consulapi.Client
+	// token is what was in the token file, if any
+	token string
+}
+
+func (c *consulClients) get(address string, config *ConsulConfig) (*consulapi.Client, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	token := ""
+	if config != nil && config.TokenFile != "" {
+		contents, err := ioutil.ReadFile(config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+
+	key := address + "|" + config.key()
+	if cached, ok := c.clients[key]; ok && cached.token == token {
+		return cached.client, nil
+	}
+
+	if config != nil && config.TokenFile != "" {
+		withToken := *config
+		withToken.Token = token
+		withToken.TokenFile = ""
+		config = &withToken
+	}
+	client, err := newConsulClient(address, config)
+	if err != nil {
+		return nil, err
+	}
+	if c.clients == nil {
+		c.clients = make(map[string]consulClient)
+	}
+	c.clients[key] = consulClient{client: client, token: token}
+	return client, nil
+}
+
+// consulTokenCheck is how often a running watch reads its token file again.
+var consulTokenCheck = 10 * time.Second
+
+// wait blocks a watch until shutdown. If the watch has a token file, it
+// returns an error once the token in the file is no longer the one of its
+// client, so that its worker is retried with a new client: the Consul
+// watches retry failed requests on their own, with the client they were
+// made with.
+func (c *consulClients) wait(p *supervisor.Process, address string, config *ConsulConfig, client *consulapi.Client) error {
+	if config == nil || config.TokenFile == "" {
+		<-p.Shutdown()
+		return nil
+	}
+
+	ticker := time.NewTicker(consulTokenCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.Shutdown():
+			return nil
+		case <-ticker.C:
+			current, err := c.get(address, config)
+			if err != nil {
+				// the file may be in the middle of being
+				// replaced, the token we have may still work
+				p.Logf("can't read consul token: %v", err)
+				continue
+			}
+			if current != client {
+				return fmt.Errorf("consul token in %s changed", config.TokenFile)
+			}
+		}
+	}
+}
+
+func newConsulClient(address string, config *ConsulConfig) (*consulapi.Client, error) {
+	consulConfig := consulapi.DefaultConfig()
+	consulConfig.Address = address
+	if config == nil {
+		return consulapi.NewClient(consulConfig)
+	}
+
+	consulConfig.Token = config.Token
+	consulConfig.TokenFile = config.TokenFile
+	if config.Scheme != "" {
+		consulConfig.Scheme = config.Scheme
+	}
+	consulConfig.TLSConfig = consulapi.TLSConfig{
+		Address:            config.ServerName,
+		CAFile:             config.CAFile,
+		CertFile:           config.CertFile,
+		KeyFile:            config.KeyFile,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.Namespace != "" {
+		// this version of the client doesn't know about namespaces,
+		// but all they take is a query parameter
+		httpClient, err := consulapi.NewHttpClient(consulConfig.Transport, consulConfig.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		consulConfig.HttpClient = &http.Client{
+			Transport: &namespaceTransport{namespace: config.Namespace, next: httpClient.Transport},
+		}
+	}
+
+	return consulapi.NewClient(consulConfig)
+}
+
+// namespaceTransport adds a Consul namespace to every request.
+type namespaceTransport struct {
+	namespace string
+	next      http.RoundTripper
+}
+
+func (t *namespaceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers mustn't change the request they're given
+	r = r.WithContext(r.Context())
+	u := *r.URL
+	query := u.Query()
+	query.Set("ns", t.namespace)
+	u.RawQuery = query.Encode()
+	r.URL = &u
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,338 @@
+package watt
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/consulwatch"
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+// fakeConsul serves the health of the bar service, which has a passing and a
+// critical endpoint, and remembers the ACL tokens and namespaces of the
+// requests it gets.
+type fakeConsul struct {
+	mux        sync.Mutex
+	tokens     []string
+	namespaces []string
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/bar" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mux.Lock()
+	f.tokens = append(f.tokens, r.Header.Get("X-Consul-Token"))
+	f.namespaces = append(f.namespaces, r.URL.Query().Get("ns"))
+	f.mux.Unlock()
+
+	if r.URL.Query().Get("index") == "1" {
+		// nothing changed, block like Consul does
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	entries := []*consulapi.ServiceEntry{
+		{
+			Node: &consulapi.Node{ID: "node-1", Node: "one", Address: "1.2.3.4", Datacenter: "dc1"},
+			// no address, so the node's is used
+			Service: &consulapi.AgentService{ID: "bar-1", Service: "bar", Port: 80,
+				Meta:    map[string]string{"version": "v1"},
+				Weights: consulapi.AgentWeights{Passing: 10, Warning: 1}},
+			Checks: consulapi.HealthChecks{{Status: consulapi.HealthPassing}},
+		},
+		{
+			Node:    &consulapi.Node{ID: "node-2", Node: "two", Address: "1.2.3.5", Datacenter: "dc1"},
+			Service: &consulapi.AgentService{ID: "bar-2", Service: "bar", Address: "10.0.0.2", Port: 80},
+			Checks:  consulapi.HealthChecks{{Status: consulapi.HealthCritical}},
+		},
+	}
+	if _, ok := r.URL.Query()["passing"]; ok {
+		entries = entries[:1]
+	}
+
+	w.Header().Set("X-Consul-Index", "1")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+func (f *fakeConsul) seen() ([]string, []string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]string{}, f.tokens...), append([]string{}, f.namespaces...)
+}
+
+func TestConsulClients(t *testing.T) {
+	var clients consulClients
+
+	a, err := clients.get("127.0.0.1:8500", nil)
+	require.NoError(t, err)
+	b, err := clients.get("127.0.0.1:8500", nil)
+	require.NoError(t, err)
+	require.True(t, a == b)
+
+	c, err := clients.get("127.0.0.1:8500", &ConsulConfig{Token: "secret"})
+	require.NoError(t, err)
+	require.True(t, a != c)
+	d, err := clients.get("127.0.0.1:8501", nil)
+	require.NoError(t, err)
+	require.True(t, a != d)
+
+	spec := ConsulWatchSpec{ConsulAddress: "127.0.0.1:8500", Datacenter: "dc1", ServiceName: "bar"}
+	require.Equal(t, "127.0.0.1:8500|dc1|bar", spec.WatchId())
+	spec.Consul = &ConsulConfig{Token: "secret"}
+	require.NotContains(t, spec.WatchId(), "secret")
+	require.NotEqual(t, "127.0.0.1:8500|dc1|bar", spec.WatchId())
+
+	watchset := WatchSet{ConsulWatches: []ConsulWatchSpec{spec}}
+	require.Equal(t, spec.Consul, watchset.interpolate().ConsulWatches[0].Consul)
+}
+
+func TestConsulClientsTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consulclients")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("one\n"), 0600))
+
+	fake := &fakeConsul{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	var clients consulClients
+	config := &ConsulConfig{TokenFile: tokenFile}
+	a, err := clients.get(address, config)
+	require.NoError(t, err)
+	b, err := clients.get(address, config)
+	require.NoError(t, err)
+	require.True(t, a == b)
+
+	// a rotated token gets a new client, with the new token
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("two\n"), 0600))
+	c, err := clients.get(address, config)
+	require.NoError(t, err)
+	require.True(t, a != c)
+	require.Len(t, clients.clients, 1)
+
+	for _, client := range []*consulapi.Client{a, c} {
+		_, _, err := client.Health().Service("bar", "", false, nil)
+		require.NoError(t, err)
+	}
+	tokens, _ := fake.seen()
+	require.Equal(t, []string{"one", "two"}, tokens)
+
+	require.NoError(t, os.Remove(tokenFile))
+	_, err = clients.get(address, config)
+	require.Error(t, err)
+}
+
+func TestConsulWatchTokenAndNamespace(t *testing.T) {
+	fake := &fakeConsul{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "consul")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	event := watchConsul(t, ConsulWatchSpec{
+		ConsulAddress: strings.TrimPrefix(server.URL, "http://"),
+		Datacenter:    "dc1",
+		ServiceName:   "bar",
+		Consul:        &ConsulConfig{TokenFile: tokenFile, Namespace: "team-a"},
+	})
+	require.Equal(t, 1, len(event.Endpoints.Endpoints))
+	require.Equal(t, "1.2.3.4", event.Endpoints.Endpoints[0].Address)
+
+	tokens, namespaces := fake.seen()
+	require.Equal(t, "secret", tokens[0])
+	require.Equal(t, "team-a", namespaces[0])
+}
+
+// Check that a running watch follows its token file, and waits for one that
+// isn't there yet.
+func TestConsulWatchTokenRotation(t *testing.T) {
+	saved := consulTokenCheck
+	consulTokenCheck = 50 * time.Millisecond
+	defer func() { consulTokenCheck = saved }()
+
+	fake := &fakeConsul{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "consul")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+
+	events := make(chan consulEvent, 10)
+	maker := &ConsulWatchMaker{aggregatorCh: events}
+	worker, err := maker.MakeConsulWatch(ConsulWatchSpec{
+		ConsulAddress: strings.TrimPrefix(server.URL, "http://"),
+		Datacenter:    "dc1",
+		ServiceName:   "bar",
+		Consul:        &ConsulConfig{TokenFile: tokenFile},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sup := supervisor.WithContext(ctx)
+	sup.Supervise(worker)
+	done := make(chan struct{})
+	go func() {
+		sup.Run()
+		close(done)
+	}()
+	defer func() {
+		sup.Shutdown()
+		<-done
+	}()
+	go func() {
+		for {
+			select {
+			case <-events:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sawToken := func(token string) func() bool {
+		return func() bool {
+			tokens, _ := fake.seen()
+			for _, seen := range tokens {
+				if seen == token {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("one\n"), 0600))
+	require.Eventually(t, sawToken("one"), 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("two\n"), 0600))
+	require.Eventually(t, sawToken("two"), 5*time.Second, 10*time.Millisecond)
+}
+
+// watchConsul runs a Consul watch until it sends its first endpoints.
+func watchConsul(t *testing.T, spec ConsulWatchSpec) consulEvent {
+	events := make(chan consulEvent, 10)
+	maker := &ConsulWatchMaker{aggregatorCh: events}
+	worker, err := maker.MakeConsulWatch(spec)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sup := supervisor.WithContext(ctx)
+	sup.Supervise(worker)
+	done := make(chan struct{})
+	go func() {
+		sup.Run()
+		close(done)
+	}()
+	defer func() {
+		sup.Shutdown()
+		<-done
+	}()
+
+	select {
+	case event := <-events:
+		require.NoError(t, event.Err)
+		return event
+	case <-ctx.Done():
+		t.Fatal("no endpoints from consul")
+		return consulEvent{}
+	}
+}
+
+func TestConsulEndpoints(t *testing.T) {
+	server := httptest.NewServer(&fakeConsul{})
+	defer server.Close()
+
+	spec := ConsulWatchSpec{
+		ConsulAddress:    strings.TrimPrefix(server.URL, "http://"),
+		Datacenter:       "dc1",
+		ServiceName:      "bar",
+		IncludeUnhealthy: true,
+	}
+	event := watchConsul(t, spec)
+	require.Equal(t, []consulwatch.Endpoint{
+		{
+			SystemID:    "consul::node-1",
+			ID:          "bar-1",
+			Service:     "bar",
+			Address:     "1.2.3.4",
+			Port:        80,
+			Tags:        []string{},
+			Meta:        map[string]string{"version": "v1"},
+			Node:        "one",
+			NodeAddress: "1.2.3.4",
+			Datacenter:  "dc1",
+			Health:      "passing",
+			Weights:     consulwatch.Weights{Passing: 10, Warning: 1},
+		},
+		{
+			SystemID:    "consul::node-2",
+			ID:          "bar-2",
+			Service:     "bar",
+			Address:     "10.0.0.2",
+			Port:        80,
+			Tags:        []string{},
+			Node:        "two",
+			NodeAddress: "1.2.3.5",
+			Datacenter:  "dc1",
+			Health:      "critical",
+		},
+	}, event.Endpoints.Endpoints)
+	watchset := WatchSet{ConsulWatches: []ConsulWatchSpec{spec}}
+	require.Equal(t, spec, watchset.interpolate().ConsulWatches[0])
+}
+
+func TestConsulTLS(t *testing.T) {
+	server := httptest.NewTLSServer(&fakeConsul{})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "consul")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, ca, 0600))
+
+	address := strings.TrimPrefix(server.URL, "https://")
+
+	// without the CA, the server isn't trusted
+	client, err := newConsulClient(address, &ConsulConfig{Scheme: "https"})
+	require.NoError(t, err)
+	_, _, err = client.Health().Service("bar", "", true, nil)
+	require.Error(t, err)
+
+	client, err = newConsulClient(address, &ConsulConfig{Scheme: "https", CAFile: caFile})
+	require.NoError(t, err)
+	entries, _, err := client.Health().Service("bar", "", true, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entries))
+}
@@ -5,8 +5,6 @@ import (
 	"log"
 	"os"
 
-	consulapi "github.com/hashicorp/consul/api"
-
 	"github.com/datawire/ambassador/pkg/consulwatch"
 	"github.com/datawire/ambassador/pkg/supervisor"
 )
@@ -14,6 +12,7 @@ import (
 type consulEvent struct {
 	WatchId   string
 	Endpoints consulwatch.Endpoints
+	Err       error
 }
 
 type consulwatchman struct {
@@ -24,25 +23,24 @@ type consulwatchman struct {
 
 type ConsulWatchMaker struct {
 	aggregatorCh chan<- consulEvent
+	// the watches on the same Consul share a client
+	clients consulClients
 }
 
+// MakeConsulWatch makes the worker of a Consul watch. The worker gets its
+// client when it starts, so that a retry reads the token file again, and one
+// that's missing for now doesn't lose the watch.
 func (m *ConsulWatchMaker) MakeConsulWatch(spec ConsulWatchSpec) (*supervisor.Worker, error) {
-	consulConfig := consulapi.DefaultConfig()
-	consulConfig.Address = spec.ConsulAddress
-
-	// TODO: Should we really allocated a Consul client per Service watch? Not sure... there some design stuff here
-	// May be multiple consul clusters
-	// May be different connection parameters on the consulConfig
-	// Seems excessive...
-	consul, err := consulapi.NewClient(consulConfig)
-	if err != nil {
-		return nil, err
-	}
-
 	worker := &supervisor.Worker{
 		Name: fmt.Sprintf("consul:%s", spec.WatchId()),
 		Work: func(p *supervisor.Process) error {
-			w, err := consulwatch.New(consul, log.New(os.Stdout, "", log.LstdFlags), spec.Datacenter, spec.ServiceName, true)
+			consul, err := m.clients.get(spec.ConsulAddress, spec.Consul)
+			if err != nil {
+				return err
+			}
+
+			w, err := consulwatch.New(consul, log.New(os.Stdout, "", log.LstdFlags), spec.Datacenter, spec.ServiceName,
+				!spec.IncludeUnhealthy)
 			if err != nil {
 				p.Logf("failed to setup new consul watch %v", err)
 				return err
@@ -50,7 +48,7 @@ func (m *ConsulWatchMaker) MakeConsulWatch(spec ConsulWatchSpec) (*supervisor.Wo
 
 			w.Watch(func(endpoints consulwatch.Endpoints, e error) {
 				endpoints.Id = spec.Id
-				m.aggregatorCh <- consulEvent{spec.WatchId(), endpoints}
+				m.aggregatorCh <- consulEvent{spec.WatchId(), endpoints, e}
 			})
 			_ = p.Go(func(p *supervisor.Process) error {
 				x := w.Start()
@@ -62,9 +60,9 @@ func (m *ConsulWatchMaker) MakeConsulWatch(spec ConsulWatchSpec) (*supervisor.Wo
 				return nil
 			})
 
-			<-p.Shutdown()
+			err = m.clients.wait(p, spec.ConsulAddress, spec.Consul, consul)
 			w.Stop()
-			return nil
+			return err
 		},
 		Retry: true,
 	}
@@ -0,0 +1,139 @@
+package watt
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+	"github.com/datawire/ambassador/pkg/watt"
+)
+
+const defaultDNSInterval = 30 * time.Second
+
+type dnsEvent struct {
+	watchId string
+	records watt.DNSRecords
+	err     error
+}
+
+// DNSWatchMaker makes watches that poll DNS SRV records.
+type DNSWatchMaker struct {
+	aggregatorCh chan<- dnsEvent
+}
+
+func (m *DNSWatchMaker) MakeWatch(spec WatchSpec) (*supervisor.Worker, error) {
+	dspec, ok := spec.(DNSWatchSpec)
+	if !ok {
+		return nil, fmt.Errorf("not a DNS watch: %v", spec)
+	}
+
+	interval := defaultDNSInterval
+	if dspec.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(dspec.Interval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	worker := &supervisor.Worker{
+		Name: fmt.Sprintf("dns:%s", dspec.WatchId()),
+		Work: func(p *supervisor.Process) error {
+			resolver := dspec.Resolver
+			if resolver == "" {
+				config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+				if err != nil {
+					return err
+				}
+				if len(config.Servers) == 0 {
+					return fmt.Errorf("no DNS servers in /etc/resolv.conf")
+				}
+				resolver = net.JoinHostPort(config.Servers[0], config.Port)
+			}
+
+			p.Ready()
+
+			// only changes are sent to the aggregator, but the
+			// first lookup is always sent, even if it fails, so
+			// that the aggregator knows the watch is there
+			var last *dnsEvent
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				records, err := lookupSRV(resolver, dspec)
+				event := dnsEvent{watchId: dspec.WatchId(), records: records, err: err}
+				if err != nil {
+					p.Logf("DNS lookup of %s failed: %v", dspec.Name(), err)
+					if last != nil {
+						// keep the records we had
+						event.records = last.records
+					}
+				}
+				if last == nil || !reflect.DeepEqual(event.records, last.records) || (err == nil) != (last.err == nil) {
+					m.aggregatorCh <- event
+					last = &event
+				}
+
+				select {
+				case <-ticker.C:
+				case <-p.Shutdown():
+					return nil
+				}
+			}
+		},
+		Retry: true,
+	}
+
+	return worker, nil
+}
+
+// lookupSRV looks up the SRV records of a DNS watch. A name that doesn't
+// exist has no records.
+func lookupSRV(resolver string, spec DNSWatchSpec) (watt.DNSRecords, error) {
+	result := watt.DNSRecords{Id: spec.Id, Service: spec.Name()}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(spec.Name()), dns.TypeSRV)
+	client := &dns.Client{Timeout: 5 * time.Second}
+	in, _, err := client.Exchange(msg, resolver)
+	if err != nil {
+		return result, err
+	}
+
+	switch in.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return result, nil
+	default:
+		return result, fmt.Errorf("%s", dns.RcodeToString[in.Rcode])
+	}
+
+	for _, rr := range in.Answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			result.Records = append(result.Records, watt.SRV{
+				Target:   strings.TrimSuffix(srv.Target, "."),
+				Port:     srv.Port,
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+			})
+		}
+	}
+	sort.Slice(result.Records, func(i, j int) bool {
+		a, b := result.Records[i], result.Records[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Port < b.Port
+	})
+
+	return result, nil
+}
@@ -0,0 +1,65 @@
+package watt
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/watt"
+)
+
+// startDNSServer serves SRV records for _http._tcp.example.com on a local
+// port, and returns its address.
+func startDNSServer(t *testing.T) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		q := r.Question[0]
+		if q.Name != "_http._tcp.example.com." || q.Qtype != dns.TypeSRV {
+			msg.Rcode = dns.RcodeNameError
+			w.WriteMsg(msg)
+			return
+		}
+		for _, target := range []string{"b.example.com.", "a.example.com."} {
+			msg.Answer = append(msg.Answer, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 60},
+				Priority: 10,
+				Weight:   5,
+				Port:     8080,
+				Target:   target,
+			})
+		}
+		w.WriteMsg(msg)
+	})
+
+	server := &dns.Server{PacketConn: conn, Handler: handler}
+	go server.ActivateAndServe()
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestLookupSRV(t *testing.T) {
+	addr, stop := startDNSServer(t)
+	defer stop()
+
+	spec := DNSWatchSpec{Id: "web", Service: "http", Domain: "example.com", Resolver: addr}
+	records, err := lookupSRV(addr, spec)
+	require.NoError(t, err)
+	require.Equal(t, watt.DNSRecords{
+		Id:      "web",
+		Service: "_http._tcp.example.com",
+		Records: []watt.SRV{
+			{Target: "a.example.com", Port: 8080, Priority: 10, Weight: 5},
+			{Target: "b.example.com", Port: 8080, Priority: 10, Weight: 5},
+		},
+	}, records)
+
+	spec = DNSWatchSpec{Service: "http", Proto: "udp", Domain: "example.com", Resolver: addr}
+	records, err = lookupSRV(addr, spec)
+	require.NoError(t, err)
+	require.Empty(t, records.Records)
+}
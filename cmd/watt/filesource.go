@@ -0,0 +1,170 @@
+package watt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/datawire/ambassador/pkg/k8s"
+	"github.com/datawire/ambassador/pkg/supervisor"
+	"github.com/datawire/ambassador/pkg/watt"
+)
+
+type fileEvent struct {
+	watchId   string
+	resources []k8s.Resource
+	errors    []watt.Error
+}
+
+// FileWatchMaker makes watches on YAML files, so that watt can run without
+// Kubernetes.
+type FileWatchMaker struct {
+	aggregatorCh chan<- fileEvent
+}
+
+func (m *FileWatchMaker) MakeWatch(spec WatchSpec) (*supervisor.Worker, error) {
+	fspec, ok := spec.(FileWatchSpec)
+	if !ok {
+		return nil, fmt.Errorf("not a file watch: %v", spec)
+	}
+
+	worker := &supervisor.Worker{
+		Name: fmt.Sprintf("file:%s", fspec.WatchId()),
+		Work: func(p *supervisor.Process) error {
+			watcher, err := fsnotify.NewWatcher()
+			if err != nil {
+				return err
+			}
+			defer watcher.Close()
+
+			changed, err := watchPath(watcher, fspec.Path)
+			if err != nil {
+				return err
+			}
+
+			p.Ready()
+			m.aggregatorCh <- readFiles(fspec)
+
+			for {
+				select {
+				case event := <-watcher.Events:
+					if changed(event) {
+						m.aggregatorCh <- readFiles(fspec)
+					}
+				case err := <-watcher.Errors:
+					p.Logf("file watch error: %v", err)
+				case <-p.Shutdown():
+					return nil
+				}
+			}
+		},
+		Retry: true,
+	}
+
+	return worker, nil
+}
+
+// watchPath watches a directory, or a file through its directory, and
+// returns what tells whether an event changed what's at the path.
+//
+// Editors and ConfigMap volumes replace a file rather than write to it, and
+// a watch on the file itself is lost once it's replaced. A file in a
+// ConfigMap volume is a symlink through a ..data symlink that is swapped for
+// every update, so the events are about ..data rather than the file, and
+// what tells us the file changed is that it leads somewhere else.
+func watchPath(watcher *fsnotify.Watcher, path string) (func(fsnotify.Event) bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if err := watcher.Add(path); err != nil {
+			return nil, err
+		}
+		return func(fsnotify.Event) bool { return true }, nil
+	}
+
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	target, _ := filepath.EvalSymlinks(path)
+	return func(event fsnotify.Event) bool {
+		if filepath.Clean(event.Name) == path {
+			return true
+		}
+		newTarget, _ := filepath.EvalSymlinks(path)
+		if newTarget != target {
+			target = newTarget
+			return true
+		}
+		return false
+	}, nil
+}
+
+// isResourceFile tells whether a file holds resources.
+func isResourceFile(name string) bool {
+	if strings.HasPrefix(filepath.Base(name), ".") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+// readFiles reads the resources at the path of a file watch. A file that
+// can't be read or parsed is an error, the other files are still read.
+func readFiles(spec FileWatchSpec) fileEvent {
+	event := fileEvent{watchId: spec.WatchId()}
+	source := spec.WatchId()
+
+	var names []string
+	info, err := os.Stat(spec.Path)
+	if err != nil {
+		event.errors = append(event.errors, watt.NewError(source, err.Error()))
+		return event
+	}
+	if info.IsDir() {
+		infos, err := ioutil.ReadDir(spec.Path)
+		if err != nil {
+			event.errors = append(event.errors, watt.NewError(source, err.Error()))
+			return event
+		}
+		for _, info := range infos {
+			if !info.IsDir() && isResourceFile(info.Name()) {
+				names = append(names, filepath.Join(spec.Path, info.Name()))
+			}
+		}
+		sort.Strings(names)
+	} else {
+		names = []string{spec.Path}
+	}
+
+	for _, name := range names {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			event.errors = append(event.errors, watt.NewError(source, err.Error()))
+			continue
+		}
+		resources, err := k8s.ParseResources(name, string(contents))
+		if err != nil {
+			event.errors = append(event.errors, watt.NewError(source, err.Error()))
+			continue
+		}
+		for _, r := range resources {
+			if !r.Empty() {
+				event.resources = append(event.resources, r)
+			}
+		}
+	}
+
+	return event
+}
@@ -0,0 +1,140 @@
+package watt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+func TestReadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesource")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+	write("a.yaml", `
+---
+kind: Service
+apiVersion: v1
+metadata:
+  name: foo
+---
+kind: Mapping
+apiVersion: getambassador.io/v2
+metadata:
+  name: foo
+`)
+	write("b.json", `{"kind": "Service", "apiVersion": "v1", "metadata": {"name": "bar"}}`)
+	write("c.txt", "not a resource")
+	write(".d.yaml", "kind: Service")
+
+	spec := FileWatchSpec{Path: dir}
+	event := readFiles(spec)
+	require.Equal(t, spec.WatchId(), event.watchId)
+	require.Empty(t, event.errors)
+	require.Equal(t, 3, len(event.resources))
+	require.Equal(t, "Mapping", event.resources[1].Kind())
+	require.Equal(t, "bar", event.resources[2].Name())
+
+	write("e.yaml", "kind: [")
+	event = readFiles(spec)
+	require.Equal(t, 3, len(event.resources))
+	require.Equal(t, 1, len(event.errors))
+	require.Contains(t, event.errors[0].Message, "e.yaml")
+
+	event = readFiles(FileWatchSpec{Path: filepath.Join(dir, "b.json")})
+	require.Equal(t, 1, len(event.resources))
+}
+
+func TestFileWatchReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesource")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	service := func(name string) []byte {
+		return []byte("kind: Service\napiVersion: v1\nmetadata:\n  name: " + name + "\n")
+	}
+
+	// a file laid out like a ConfigMap volume
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..v1"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "..v1", "configmap.yaml"), service("one"), 0644))
+	require.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "configmap.yaml"), filepath.Join(dir, "configmap.yaml")))
+	// and a plain one
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "plain.yaml"), service("one"), 0644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := make(chan fileEvent)
+	maker := &FileWatchMaker{aggregatorCh: events}
+	sup := supervisor.WithContext(ctx)
+	for _, name := range []string{"configmap.yaml", "plain.yaml"} {
+		worker, err := maker.MakeWatch(FileWatchSpec{Path: filepath.Join(dir, name)})
+		require.NoError(t, err)
+		sup.Supervise(worker)
+	}
+	done := make(chan struct{})
+	go func() {
+		sup.Run()
+		close(done)
+	}()
+	defer func() {
+		sup.Shutdown()
+		// let a worker that's sending an event get to shut down
+		for {
+			select {
+			case <-events:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// waitFor waits until a watch finds the service with a name, keeping
+	// track of what the other watches find meanwhile
+	found := make(map[string]string)
+	waitFor := func(path, name string) {
+		watchId := FileWatchSpec{Path: path}.WatchId()
+		for found[watchId] != name {
+			select {
+			case event := <-events:
+				if len(event.resources) == 1 {
+					found[event.watchId] = event.resources[0].Name()
+				}
+			case <-ctx.Done():
+				t.Fatalf("%s never found %s", path, name)
+			}
+		}
+	}
+	configmap := filepath.Join(dir, "configmap.yaml")
+	plain := filepath.Join(dir, "plain.yaml")
+	waitFor(configmap, "one")
+	waitFor(plain, "one")
+
+	// an atomic rename, twice, in case the first one lost the watch
+	for _, name := range []string{"two", "three"} {
+		tmp := filepath.Join(dir, ".plain.yaml.tmp")
+		require.NoError(t, ioutil.WriteFile(tmp, service(name), 0644))
+		require.NoError(t, os.Rename(tmp, plain))
+		waitFor(plain, name)
+	}
+
+	// a ConfigMap update, twice
+	for _, version := range []string{"v2", "v3"} {
+		data := filepath.Join(dir, ".."+version)
+		require.NoError(t, os.Mkdir(data, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(data, "configmap.yaml"), service(version), 0644))
+		require.NoError(t, os.Symlink(".."+version, filepath.Join(dir, "..data_tmp")))
+		require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+		waitFor(configmap, version)
+	}
+}
@@ -0,0 +1,112 @@
+package watt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The snapshot server says what every snapshot it serves hashes to, and,
+// given a key, signs it, so that receivers can check that what they got is
+// what we meant them to get.
+
+const (
+	// digestHeader is the SHA-256 of the body, as in RFC 3230.
+	digestHeader = "Digest"
+	// signatureHeader is the HMAC-SHA256 of the body, hex encoded.
+	signatureHeader = "X-Watt-Signature"
+)
+
+func snapshotDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func snapshotSignature(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(body)
+	return "hmac-sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeSnapshot writes a snapshot, or a snapshot delta, along with its
+// digest and signature.
+func writeSnapshot(w http.ResponseWriter, key, body []byte) error {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set(digestHeader, snapshotDigest(body))
+	if key != nil {
+		w.Header().Set(signatureHeader, snapshotSignature(key, body))
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// readHMACKey reads the key to sign snapshots with. Whitespace around it
+// isn't part of it, so that a trailing newline doesn't change the key.
+func readHMACKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("HMAC key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// unixPrefix marks --listen addresses that are Unix sockets.
+const unixPrefix = "unix:"
+
+// listenAddress returns where the snapshot server listens: a Unix socket,
+// or the port on the given host, or on all of them if there's no host.
+func listenAddress(listen string, port int) string {
+	if strings.HasPrefix(listen, unixPrefix) {
+		return listen
+	}
+	return net.JoinHostPort(listen, strconv.Itoa(port))
+}
+
+// checkListen rejects a Unix socket when there are --notify receivers, as
+// they're handed an http URL, and can only fetch snapshots over TCP.
+func checkListen(listen string, notify []string) error {
+	if strings.HasPrefix(listen, unixPrefix) && len(notify) > 0 {
+		return fmt.Errorf("--listen %s can't be used with --notify, whose receivers fetch snapshots over TCP", listen)
+	}
+	return nil
+}
+
+// listen listens on an address returned by listenAddress. Only we may
+// use a Unix socket, and one left behind by an earlier run is replaced.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, unixPrefix)
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
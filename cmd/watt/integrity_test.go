@@ -0,0 +1,113 @@
+package watt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSnapshot(t *testing.T) {
+	body := []byte(`{"Kubernetes": {}}`)
+
+	w := httptest.NewRecorder()
+	require.NoError(t, writeSnapshot(w, nil, body))
+	require.Equal(t, "application/json", w.Header().Get("content-type"))
+	// echo -n '{"Kubernetes": {}}' | openssl dgst -sha256 -binary | base64
+	require.Equal(t, "SHA-256=XKHy7OeeoCzMnXvLzDquR9i5b7/i/0xkmmC079mYeY0=", w.Header().Get(digestHeader))
+	require.Empty(t, w.Header().Get(signatureHeader))
+	require.Equal(t, body, w.Body.Bytes())
+
+	key := []byte("sekrit")
+	w = httptest.NewRecorder()
+	require.NoError(t, writeSnapshot(w, key, body))
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(body)
+	require.Equal(t, "hmac-sha256="+hex.EncodeToString(mac.Sum(nil)), w.Header().Get(signatureHeader))
+}
+
+func TestReadHMACKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watt-hmac")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(path, []byte("sekrit\n"), 0600))
+	key, err := readHMACKey(path)
+	require.NoError(t, err)
+	require.Equal(t, []byte("sekrit"), key)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("\n"), 0600))
+	_, err = readHMACKey(path)
+	require.Error(t, err)
+
+	_, err = readHMACKey(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestListenAddress(t *testing.T) {
+	require.Equal(t, ":7000", listenAddress("", 7000))
+	require.Equal(t, "localhost:7000", listenAddress("localhost", 7000))
+	require.Equal(t, "[::1]:7000", listenAddress("::1", 7000))
+	require.Equal(t, "unix:/run/watt.sock", listenAddress("unix:/run/watt.sock", 7000))
+
+	i := &invoker{apiServerPort: 7000}
+	require.Equal(t, "http://localhost:7000/snapshots/3", i.snapshotURL(3))
+	i.apiServerListen = "127.0.0.1"
+	require.Equal(t, "http://127.0.0.1:7000/snapshots/3", i.snapshotURL(3))
+
+	require.NoError(t, checkListen("localhost", []string{"receiver"}))
+	require.NoError(t, checkListen("unix:/run/watt.sock", nil))
+	require.Error(t, checkListen("unix:/run/watt.sock", []string{"receiver"}))
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watt-socket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "watt.sock")
+
+	// what an earlier run left behind gets replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	listener, err := listen(unixPrefix + path)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = writeSnapshot(w, nil, []byte("{}"))
+		}))
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://localhost/snapshots/1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, snapshotDigest([]byte("{}")), resp.Header.Get(digestHeader))
+
+	// anything else is left alone
+	other := filepath.Join(dir, "other")
+	require.NoError(t, ioutil.WriteFile(other, nil, 0600))
+	_, err = listen(unixPrefix + other)
+	require.Error(t, err)
+}
@@ -1,38 +1,53 @@
 package watt
 
 import (
+	"encoding/json"
 	"fmt"
-	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/datawire/ambassador/pkg/supervisor"
 	"github.com/datawire/ambassador/pkg/tpu"
+	"github.com/datawire/ambassador/pkg/watt"
 )
 
 type invoker struct {
 	Snapshots        chan string
 	mux              sync.Mutex
 	invokedSnapshots map[int]string
-	id               int
-	notify           []string
-	apiServerPort    int
+	// deltas are the encoded deltas served so far, by the ids of the
+	// snapshots they're between, so that every one is worked out once
+	deltas        map[[2]int][]byte
+	id            int
+	notify        []string
+	apiServerPort int
+	// apiServerListen is the --listen of the API server
+	apiServerListen string
 
 	// This stores the latest snapshot, but we don't assign an id
 	// unless/until we invoke... some of these will be discarded
 	// by the rate limiting/coalescing logic
 	latestSnapshot string
 	process        *supervisor.Process
+
+	// journal, if set, records every snapshot we invoke
+	journal *journal
+
+	// subscribers get every snapshot we invoke pushed to them
+	subscribers *subscribers
 }
 
 func NewInvoker(port int, notify []string) *invoker {
 	return &invoker{
 		Snapshots:        make(chan string),
 		invokedSnapshots: make(map[int]string),
+		deltas:           make(map[[2]int][]byte),
 		notify:           notify,
 		apiServerPort:    port,
+		subscribers:      newSubscribers(),
 	}
 }
 
@@ -141,6 +156,11 @@ func (a *invoker) gcSnapshots() {
 			a.process.Logf("deleting snapshot %d", k)
 		}
 	}
+	for k := range a.deltas {
+		if k[0] <= a.id-10 {
+			delete(a.deltas, k)
+		}
+	}
 }
 
 func (a *invoker) getSnapshot(id int) string {
@@ -149,6 +169,22 @@ func (a *invoker) getSnapshot(id int) string {
 	return a.invokedSnapshots[id]
 }
 
+func (a *invoker) getDelta(since, id int) []byte {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.deltas[[2]int{since, id}]
+}
+
+// storeDelta keeps a delta for as long as the earlier of its snapshots is
+// kept.
+func (a *invoker) storeDelta(since, id int, delta []byte) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if _, ok := a.invokedSnapshots[since]; ok {
+		a.deltas[[2]int{since, id}] = delta
+	}
+}
+
 func (a *invoker) getKeys() (result []int) {
 	for i := range a.invokedSnapshots {
 		result = append(result, i)
@@ -158,20 +194,50 @@ func (a *invoker) getKeys() (result []int) {
 
 func (a *invoker) invoke() {
 	id := a.storeSnapshot(a.latestSnapshot)
+	if a.journal != nil {
+		if err := a.journal.record(id, a.latestSnapshot, time.Now()); err != nil {
+			a.process.Logf("journal error: %v", err)
+		}
+	}
+	a.subscribers.publish(id)
 	for _, n := range a.notify {
-		k := tpu.NewKeeper("notify", fmt.Sprintf("%s http://localhost:%d/snapshots/%d", n, a.apiServerPort, id))
+		k := tpu.NewKeeper("notify", fmt.Sprintf("%s %s", n, a.snapshotURL(id)))
 		k.Limit = 1
 		k.Start()
 		k.Wait()
 	}
 }
 
+// snapshotURL returns where receivers get a snapshot. There are none when
+// the snapshot server is on a Unix socket, see checkListen.
+func (a *invoker) snapshotURL(id int) string {
+	if a.apiServerListen != "" {
+		return fmt.Sprintf("http://%s/snapshots/%d", listenAddress(a.apiServerListen, a.apiServerPort), id)
+	}
+	return fmt.Sprintf("http://localhost:%d/snapshots/%d", a.apiServerPort, id)
+}
+
 type apiServer struct {
-	port    int
+	port int
+	// listen, if set, is the host to listen on, or a unix: socket
+	listen  string
 	invoker *invoker
+	compact bool
+	// hmacKey, if set, signs the snapshots
+	hmacKey []byte
+	// status, if set, serves /healthz, /readyz and /watches
+	status *statusBoard
 }
 
 func (s *apiServer) Work(p *supervisor.Process) error {
+	if s.status != nil {
+		s.status.handle(p)
+	}
+
+	http.HandleFunc("/snapshots/stream", func(w http.ResponseWriter, r *http.Request) {
+		s.serveStream(w, r, p)
+	})
+
 	http.HandleFunc("/snapshots/", func(w http.ResponseWriter, r *http.Request) {
 		relpath := strings.TrimPrefix(r.URL.Path, "/snapshots/")
 
@@ -194,23 +260,25 @@ func (s *apiServer) Work(p *supervisor.Process) error {
 				return
 			}
 
-			w.Header().Set("content-type", "application/json")
-			if _, err := w.Write([]byte(snapshot)); err != nil {
+			if since := r.URL.Query().Get("since"); since != "" {
+				s.serveDelta(w, p, since, id, snapshot)
+				return
+			}
+
+			if err := writeSnapshot(w, s.hmacKey, []byte(snapshot)); err != nil {
 				p.Logf("write snapshot error: %v", err)
 			}
 		}
 	})
 
-	listenHostAndPort := fmt.Sprintf(":%d", s.port)
-	listener, err := net.Listen("tcp", listenHostAndPort)
+	listenHostAndPort := listenAddress(s.listen, s.port)
+	listener, err := listen(listenHostAndPort)
 	if err != nil {
 		return err
 	}
 	p.Ready()
 	p.Logf("snapshot server listening on: %s", listenHostAndPort)
-	srv := &http.Server{
-		Addr: listenHostAndPort,
-	}
+	srv := &http.Server{}
 	return p.DoClean(func() error {
 		err := srv.Serve(listener)
 		if err == http.ErrServerClosed {
@@ -224,6 +292,59 @@ func (s *apiServer) Work(p *supervisor.Process) error {
 
 }
 
+// serveDelta serves the changes from an earlier snapshot to the snapshot
+// with the given id. Old snapshots are garbage collected, so the earlier one
+// may be gone, in which case the client has to fetch the whole snapshot.
+// Every receiver asks for the same deltas, so they're kept once worked out.
+func (s *apiServer) serveDelta(w http.ResponseWriter, p *supervisor.Process, since string, id int, snapshot string) {
+	sinceId, err := strconv.Atoi(since)
+	if err != nil {
+		http.Error(w, "since is not an integer", http.StatusBadRequest)
+		return
+	}
+	if sinceId > id {
+		http.Error(w, "since is later than the snapshot", http.StatusBadRequest)
+		return
+	}
+
+	if bytes := s.invoker.getDelta(sinceId, id); bytes != nil {
+		if err := writeSnapshot(w, s.hmacKey, bytes); err != nil {
+			p.Logf("write snapshot delta error: %v", err)
+		}
+		return
+	}
+
+	previous := s.invoker.getSnapshot(sinceId)
+	if previous == "" {
+		http.Error(w, fmt.Sprintf("snapshot %d is no longer available", sinceId), http.StatusGone)
+		return
+	}
+
+	var from, to watt.Snapshot
+	if err := json.Unmarshal([]byte(previous), &from); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal([]byte(snapshot), &to); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	delta := watt.Diff(from, to)
+	delta.Since = sinceId
+	delta.Id = id
+	bytes, err := encodeSnapshot(delta, s.compact)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.invoker.storeDelta(sinceId, id, bytes)
+
+	if err := writeSnapshot(w, s.hmacKey, bytes); err != nil {
+		p.Logf("write snapshot delta error: %v", err)
+	}
+}
+
 func (s *apiServer) index() string {
 	var result strings.Builder
 
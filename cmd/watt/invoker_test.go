@@ -0,0 +1,79 @@
+package watt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+	"github.com/datawire/ambassador/pkg/watt"
+)
+
+func TestServeDelta(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	invoker := NewInvoker(0, nil)
+	server := &apiServer{invoker: invoker, compact: true}
+	processes := make(chan *supervisor.Process)
+	sup := supervisor.WithContext(ctx)
+	sup.Supervise(&supervisor.Worker{
+		Name: "delta",
+		Work: func(p *supervisor.Process) error {
+			processes <- p
+			<-p.Shutdown()
+			return nil
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		sup.Run()
+		close(done)
+	}()
+	defer func() {
+		sup.Shutdown()
+		<-done
+	}()
+	p := <-processes
+	invoker.process = p
+
+	get := func(since string, id int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.serveDelta(w, p, since, id, invoker.getSnapshot(id))
+		return w
+	}
+
+	first := invoker.storeSnapshot(`{"Kubernetes": {"service": [{"kind": "Service", "metadata": {"name": "foo"}}]}}`)
+	second := invoker.storeSnapshot(`{"Kubernetes": {"service": [{"kind": "Service", "metadata": {"name": "bar"}}]}}`)
+
+	w := get("1", second)
+	require.Equal(t, 200, w.Code)
+	var delta watt.SnapshotDelta
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &delta))
+	require.Equal(t, first, delta.Since)
+	require.Equal(t, second, delta.Id)
+	require.Equal(t, "bar", delta.Kubernetes.Added["service"][0].Name())
+	require.Equal(t, "foo", delta.Kubernetes.Deleted["service"][0].Name())
+	require.Nil(t, delta.Consul)
+	require.Equal(t, snapshotDigest(w.Body.Bytes()), w.Header().Get(digestHeader))
+
+	// the delta is worked out once
+	require.Equal(t, w.Body.Bytes(), invoker.getDelta(first, second))
+	again := get("1", second)
+	require.Equal(t, w.Body.Bytes(), again.Body.Bytes())
+	require.Equal(t, w.Header().Get(digestHeader), again.Header().Get(digestHeader))
+
+	require.Equal(t, 400, get("x", second).Code)
+	require.Equal(t, 400, get("3", second).Code)
+
+	// deltas go with the earlier snapshot
+	for i := 0; i < 10; i++ {
+		invoker.storeSnapshot(`{}`)
+	}
+	require.Nil(t, invoker.getDelta(first, second))
+	require.Equal(t, 410, get("1", second+10).Code)
+}
@@ -0,0 +1,136 @@
+package watt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// journal records every snapshot the invoker hands to the notify receivers
+// in a directory, one file per snapshot, so that they can be looked at after
+// the fact or replayed with `watt replay`. The oldest snapshots are removed
+// once the journal gets bigger than maxSize bytes or older than maxAge; zero
+// means no limit.
+type journal struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+}
+
+// journalEntry is one snapshot in a journal. Files are named after the time
+// the snapshot was recorded and its id, so that they sort in order.
+type journalEntry struct {
+	path string
+	time time.Time
+	id   int
+	size int64
+}
+
+// newJournal makes a journal in a directory that only we may read, since
+// snapshots have the data of Kubernetes Secrets in them. A directory made by
+// an earlier version is locked down too.
+func newJournal(dir string, maxSize int64, maxAge time.Duration) (*journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &journal{dir: dir, maxSize: maxSize, maxAge: maxAge}, nil
+}
+
+// record writes a snapshot to the journal and applies the retention limits.
+func (j *journal) record(id int, snapshot string, now time.Time) error {
+	name := filepath.Join(j.dir, fmt.Sprintf("%019d-%d.json", now.UnixNano(), id))
+
+	// write to a temporary file first so that a crash never leaves a
+	// partial snapshot behind; one left behind by a crash is removed, as
+	// WriteFile keeps the mode of a file that exists
+	tmp := filepath.Join(j.dir, "."+filepath.Base(name))
+	os.Remove(tmp)
+	if err := ioutil.WriteFile(tmp, []byte(snapshot), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return j.prune(now)
+}
+
+// prune removes the oldest snapshots until the journal is within its limits.
+// The latest snapshot is always kept.
+func (j *journal) prune(now time.Time) error {
+	entries, err := readJournal(j.dir)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, e := range entries {
+		size += e.size
+	}
+
+	for len(entries) > 1 {
+		e := entries[0]
+		tooBig := j.maxSize > 0 && size > j.maxSize
+		tooOld := j.maxAge > 0 && now.Sub(e.time) > j.maxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			return err
+		}
+		size -= e.size
+		entries = entries[1:]
+	}
+
+	return nil
+}
+
+// readJournal lists the snapshots in a journal directory, oldest first.
+func readJournal(dir string) ([]journalEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSuffix(name, ".json"), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, journalEntry{
+			path: filepath.Join(dir, name),
+			time: time.Unix(0, nanos),
+			id:   id,
+			size: info.Size(),
+		})
+	}
+
+	sort.Slice(entries, func(i, k int) bool {
+		return entries[i].time.Before(entries[k].time)
+	})
+
+	return entries, nil
+}
@@ -0,0 +1,81 @@
+package watt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func journalIds(t *testing.T, dir string) (result []int) {
+	entries, err := readJournal(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		result = append(result, e.id)
+	}
+	return
+}
+
+func TestJournalMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := newJournal(dir, 25, 0)
+	require.NoError(t, err)
+
+	now := time.Now()
+	for id := 1; id <= 5; id++ {
+		require.NoError(t, j.record(id, "0123456789", now.Add(time.Duration(id)*time.Second)))
+	}
+	require.Equal(t, []int{4, 5}, journalIds(t, dir))
+
+	// the latest snapshot is kept even if it's too big on its own
+	require.NoError(t, j.record(6, "0123456789012345678901234567890", now.Add(6*time.Second)))
+	require.Equal(t, []int{6}, journalIds(t, dir))
+}
+
+func TestJournalMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := newJournal(dir, 0, time.Minute)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, j.record(1, "{}", now))
+	require.NoError(t, j.record(2, "{}", now.Add(30*time.Second)))
+	require.Equal(t, []int{1, 2}, journalIds(t, dir))
+
+	require.NoError(t, j.record(3, "{}", now.Add(90*time.Second)))
+	require.Equal(t, []int{2, 3}, journalIds(t, dir))
+
+	entries, err := readJournal(dir)
+	require.NoError(t, err)
+	snapshot, err := ioutil.ReadFile(entries[1].path)
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(snapshot))
+}
+
+func TestJournalMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Chmod(dir, 0755))
+
+	j, err := newJournal(dir, 0, 0)
+	require.NoError(t, err)
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	require.NoError(t, j.record(1, "{}", time.Now()))
+	entries, err := readJournal(dir)
+	require.NoError(t, err)
+	info, err = os.Stat(entries[0].path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -1,7 +1,13 @@
 package watt
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 
 	"github.com/datawire/ambassador/pkg/k8s"
 	"github.com/datawire/ambassador/pkg/supervisor"
@@ -13,6 +19,9 @@ type k8sEvent struct {
 	kind      string
 	resources []k8s.Resource
 	errors    []watt.Error
+	// partial is set when some of the namespaces of a watch couldn't be
+	// watched, so that their errors stick around
+	partial bool
 }
 
 // makeErrorEvent returns a k8sEvent that contains one error entry for each
@@ -25,36 +34,103 @@ func makeErrorEvent(source string, messages ...string) k8sEvent {
 	return k8sEvent{errors: errors}
 }
 
+// makeWatchErrorEvent returns a k8sEvent with the error of a watch.
+func makeWatchErrorEvent(source, watchId string, err error) k8sEvent {
+	kError := watt.NewError(source, err.Error())
+	kError.WatchId = watchId
+	kError.Class = classifyKubernetesError(err)
+	return k8sEvent{watchId: watchId, errors: []watt.Error{kError}}
+}
+
+// classifyKubernetesError works out the class of a watch error.
+func classifyKubernetesError(err error) string {
+	var netErr net.Error
+	switch {
+	case apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err):
+		return watt.ErrorForbidden
+	case meta.IsNoMatchError(err) || strings.HasPrefix(err.Error(), "the server doesn't have a resource type"):
+		// k8s.Client.ResolveResourceType turns no match errors into
+		// the latter
+		return watt.ErrorUnknownKind
+	case apierrors.IsServiceUnavailable(err) || apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err) ||
+		apierrors.IsTooManyRequests(err) || apierrors.IsInternalError(err) || errors.As(err, &netErr):
+		return watt.ErrorUnavailable
+	default:
+		return watt.ErrorOther
+	}
+}
+
+// startWatcher starts a watcher. Watchers panic when they fail to list what
+// they watch, which we'd rather report.
+func startWatcher(watcher *k8s.Watcher) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if rErr, ok := r.(error); ok {
+				err = rErr
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	watcher.Start()
+	return nil
+}
+
 type KubernetesWatchMaker struct {
 	kubeAPI *k8s.Client
 	notify  chan<- k8sEvent
 }
 
 func (m *KubernetesWatchMaker) MakeKubernetesWatch(spec KubernetesWatchSpec) (*supervisor.Worker, error) {
+	if m.kubeAPI == nil {
+		return nil, fmt.Errorf("not watching Kubernetes, no initial sources were configured")
+	}
+
 	var worker *supervisor.Worker
-	var err error
+
+	projection, err := newProjection(spec)
+	if err != nil {
+		return nil, err
+	}
 
 	worker = &supervisor.Worker{
 		Name: fmt.Sprintf("kubernetes:%s", spec.WatchId()),
 		Work: func(p *supervisor.Process) error {
+			send := func(resources []k8s.Resource, partial bool) {
+				if projection != nil {
+					for idx, r := range resources {
+						resources[idx] = projection.apply(r)
+					}
+				}
+				m.notify <- k8sEvent{watchId: spec.WatchId(), kind: spec.Kind, resources: resources, partial: partial}
+				p.Logf("sent %q to receivers", spec.Kind)
+			}
+
+			if spec.isNamespaced() {
+				return m.watchNamespaces(p, spec, send)
+			}
+
 			watcher := m.kubeAPI.Watcher()
-			watchFunc := func(watchId, ns, kind string) func(watcher *k8s.Watcher) {
+			watchFunc := func(ns, kind string) func(watcher *k8s.Watcher) {
 				return func(watcher *k8s.Watcher) {
 					resources := watcher.List(kind)
 					p.Logf("found %d %q in namespace %q", len(resources), kind, fmtNamespace(ns))
-					m.notify <- k8sEvent{watchId: watchId, kind: kind, resources: resources}
-					p.Logf("sent %q to receivers", kind)
+					send(resources, false)
 				}
 			}
 
 			watcherErr := watcher.SelectiveWatch(spec.Namespace, spec.Kind, spec.FieldSelector, spec.LabelSelector,
-				watchFunc(spec.WatchId(), spec.Namespace, spec.Kind))
+				watchFunc(spec.Namespace, spec.Kind))
+			if watcherErr == nil {
+				watcherErr = startWatcher(watcher)
+			}
 
 			if watcherErr != nil {
+				// we get retried, and the aggregator counts the retries
+				m.notify <- makeWatchErrorEvent("kubernetes", spec.WatchId(), watcherErr)
 				return watcherErr
 			}
 
-			watcher.Start()
 			<-p.Shutdown()
 			watcher.Stop()
 			return nil
@@ -66,6 +142,31 @@ func (m *KubernetesWatchMaker) MakeKubernetesWatch(spec KubernetesWatchSpec) (*s
 	return worker, err
 }
 
+// watchNamespaces runs a watch on a set of namespaces.
+func (m *KubernetesWatchMaker) watchNamespaces(p *supervisor.Process, spec KubernetesWatchSpec,
+	send func(resources []k8s.Resource, partial bool)) error {
+	watch := &namespacedWatch{
+		client:        m.kubeAPI,
+		kind:          spec.Kind,
+		fieldSelector: spec.FieldSelector,
+		labelSelector: spec.LabelSelector,
+		namespaces:    append([]string{spec.Namespace}, spec.Namespaces...),
+		selector:      spec.NamespaceSelector,
+		send: func(resources []k8s.Resource, partial bool) {
+			p.Logf("found %d %q in the watched namespaces", len(resources), spec.Kind)
+			send(resources, partial)
+		},
+		fail: func(err error) {
+			m.notify <- makeWatchErrorEvent("kubernetes", spec.WatchId(), err)
+		},
+	}
+	if err := watch.Work(p); err != nil {
+		m.notify <- makeWatchErrorEvent("kubernetes", spec.WatchId(), err)
+		return err
+	}
+	return nil
+}
+
 type kubewatchman struct {
 	WatchMaker IKubernetesWatchMaker
 	watched    map[string]*supervisor.Worker
@@ -116,12 +217,15 @@ func (w *kubewatchman) Work(p *supervisor.Process) error {
 }
 
 type kubebootstrap struct {
-	namespace      string
-	kinds          []string
-	fieldSelector  string
-	labelSelector  string
-	notify         []chan<- k8sEvent
-	kubeAPIWatcher *k8s.Watcher
+	// namespaces are the namespaces to watch, all of them if there are
+	// none, and namespaceSelector picks more
+	namespaces        []string
+	namespaceSelector string
+	kinds             []string
+	fieldSelector     string
+	labelSelector     string
+	notify            []chan<- k8sEvent
+	kubeAPIWatcher    *k8s.Watcher
 }
 
 func fmtNamespace(ns string) string {
@@ -140,9 +244,25 @@ func (b *kubebootstrap) SaveError(message string) {
 	}
 }
 
+// saveWatchError emits the error of the kubebootstrap watch.
+func (b *kubebootstrap) saveWatchError(err error) {
+	evt := makeWatchErrorEvent("kubebootstrap", "", err)
+	for _, n := range b.notify {
+		n <- evt
+	}
+}
+
 func (b *kubebootstrap) Work(p *supervisor.Process) error {
+	if len(b.namespaces) > 1 || b.namespaceSelector != "" {
+		return b.workNamespaces(p)
+	}
+
+	namespace := ""
+	if len(b.namespaces) == 1 {
+		namespace = b.namespaces[0]
+	}
 	for _, kind := range b.kinds {
-		p.Logf("adding kubernetes watch for %q in namespace %q", kind, fmtNamespace(kubernetesNamespace))
+		p.Logf("adding kubernetes watch for %q in namespace %q", kind, fmtNamespace(namespace))
 
 		watcherFunc := func(ns, kind string) func(watcher *k8s.Watcher) {
 			return func(watcher *k8s.Watcher) {
@@ -155,14 +275,18 @@ func (b *kubebootstrap) Work(p *supervisor.Process) error {
 			}
 		}
 
-		err := b.kubeAPIWatcher.SelectiveWatch(b.namespace, kind, b.fieldSelector, b.labelSelector, watcherFunc(b.namespace, kind))
+		err := b.kubeAPIWatcher.SelectiveWatch(namespace, kind, b.fieldSelector, b.labelSelector, watcherFunc(namespace, kind))
 
 		if err != nil {
+			b.saveWatchError(err)
 			return err
 		}
 	}
 
-	b.kubeAPIWatcher.Start()
+	if err := startWatcher(b.kubeAPIWatcher); err != nil {
+		b.saveWatchError(err)
+		return err
+	}
 	p.Ready()
 
 	for range p.Shutdown() {
@@ -172,3 +296,43 @@ func (b *kubebootstrap) Work(p *supervisor.Process) error {
 
 	return nil
 }
+
+// workNamespaces watches the kinds in a set of namespaces. Every kind gets a
+// worker of its own, which keeps trying the namespaces it can't watch.
+func (b *kubebootstrap) workNamespaces(p *supervisor.Process) error {
+	for _, kind := range b.kinds {
+		kind := kind
+		watch := &namespacedWatch{
+			client:        b.kubeAPIWatcher.Client,
+			kind:          kind,
+			fieldSelector: b.fieldSelector,
+			labelSelector: b.labelSelector,
+			namespaces:    b.namespaces,
+			selector:      b.namespaceSelector,
+			send: func(resources []k8s.Resource, partial bool) {
+				p.Logf("found %d %q in the watched namespaces", len(resources), kind)
+				for _, n := range b.notify {
+					n <- k8sEvent{kind: kind, resources: resources, partial: partial}
+				}
+				p.Logf("sent %q to %d receivers", kind, len(b.notify))
+			},
+			fail: b.saveWatchError,
+		}
+		p.Supervisor().Supervise(&supervisor.Worker{
+			Name: fmt.Sprintf("kubebootstrap:%s", kind),
+			Work: func(p *supervisor.Process) error {
+				err := watch.Work(p)
+				if err != nil {
+					b.saveWatchError(err)
+				}
+				return err
+			},
+			Retry: true,
+		})
+	}
+	p.Ready()
+
+	<-p.Shutdown()
+	p.Logf("shutdown initiated")
+	return nil
+}
@@ -2,13 +2,19 @@ package watt
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/ecodia/golang-awaitility/awaitility"
 	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	"github.com/datawire/ambassador/pkg/supervisor"
+	"github.com/datawire/ambassador/pkg/watt"
 )
 
 func TestAddAndRemoveKubernetesWatchers(t *testing.T) {
@@ -132,3 +138,24 @@ func newKubewatchmanIsolator(t *testing.T) *kubewatchmanIsolator {
 	})
 	return iso
 }
+
+func TestClassifyKubernetesError(t *testing.T) {
+	services := schema.GroupResource{Resource: "services"}
+	refused := &url.Error{Op: "Get", URL: "https://10.0.0.1", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+
+	for err, class := range map[error]string{
+		apierrors.NewForbidden(services, "", errors.New("RBAC")):         watt.ErrorForbidden,
+		errors.New(`the server doesn't have a resource type "mappings"`): watt.ErrorUnknownKind,
+		apierrors.NewServiceUnavailable("try again"):                     watt.ErrorUnavailable,
+		refused: watt.ErrorUnavailable,
+		apierrors.NewBadRequest("bad field selector"): watt.ErrorOther,
+	} {
+		assert.Equal(t, class, classifyKubernetesError(err), err.Error())
+	}
+
+	event := makeWatchErrorEvent("kubernetes", "service|*|*|*", refused)
+	assert.Equal(t, "service|*|*|*", event.watchId)
+	assert.Equal(t, 1, len(event.errors))
+	assert.Equal(t, "service|*|*|*", event.errors[0].WatchId)
+	assert.Equal(t, watt.ErrorUnavailable, event.errors[0].Class)
+}
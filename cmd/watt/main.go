@@ -18,15 +18,25 @@ import (
 // Version holds the version of the code. This is intended to be overridden at build time.
 var Version = "(unknown version)"
 
-var kubernetesNamespace string
+var kubernetesNamespaces = make([]string, 0)
+var kubernetesNamespaceSelector string
 var initialSources = make([]string, 0)
+var initialFiles = make([]string, 0)
 var initialFieldSelector string
 var initialLabelSelector string
 var watchHooks = make([]string, 0)
 var notifyReceivers = make([]string, 0)
 var port int
+var listenOn string
+var hmacKeyFile string
 var interval time.Duration
+var limits = make([]string, 0)
+var maxStaleness time.Duration
 var showVersion bool
+var compact bool
+var journalDir string
+var journalMaxSize int64
+var journalMaxAge time.Duration
 
 var rootCmd = &cobra.Command{
 	Use:              "watt",
@@ -37,16 +47,35 @@ var rootCmd = &cobra.Command{
 }
 
 func init() {
-	rootCmd.Flags().StringVarP(&kubernetesNamespace, "namespace", "n", "", "namespace to watch (default: all)")
+	rootCmd.Flags().StringSliceVarP(&kubernetesNamespaces, "namespace", "n", []string{},
+		"namespace(s) to watch (default: all)")
+	rootCmd.Flags().StringVar(&kubernetesNamespaceSelector, "namespace-selector", "",
+		"also watch the namespaces with labels matching this selector")
 	rootCmd.Flags().StringSliceVarP(&initialSources, "source", "s", []string{}, "configure an initial static source")
+	rootCmd.Flags().StringSliceVar(&initialFiles, "file", []string{},
+		"watch the resources in a YAML file, or in the YAML files in a directory")
 	rootCmd.Flags().StringVar(&initialFieldSelector, "fields", "", "configure an initial field selector string")
 	rootCmd.Flags().StringVar(&initialLabelSelector, "labels", "", "configure an initial label selector string")
-	rootCmd.Flags().StringSliceVarP(&watchHooks, "watch", "w", []string{}, "configure watch hook(s)")
+	rootCmd.Flags().StringSliceVarP(&watchHooks, "watch", "w", []string{}, "configure watch hook(s): a command, an http(s) URL, or go:NAME")
 	rootCmd.Flags().StringSliceVar(&notifyReceivers, "notify", []string{},
 		"invoke the program with the given arguments as a receiver")
 	rootCmd.Flags().IntVarP(&port, "port", "p", 7000, "configure the snapshot server port")
+	rootCmd.Flags().StringVar(&listenOn, "listen", "",
+		"serve snapshots on this host only, e.g. localhost, or on a Unix socket, e.g. unix:/run/watt.sock (not with --notify)")
+	rootCmd.Flags().StringVar(&hmacKeyFile, "hmac-key-file", "",
+		"sign snapshots with the HMAC-SHA256 key in this file, in the "+signatureHeader+" header")
 	rootCmd.Flags().DurationVarP(&interval, "interval", "i", 250*time.Millisecond,
 		"configure the rate limit interval")
+	rootCmd.Flags().StringSliceVar(&limits, "limit", []string{},
+		"rate limit a source or kind on its own, e.g. kubernetes/endpoints=2s, consul=quiet:500ms or kubernetes/mapping=0")
+	rootCmd.Flags().DurationVar(&maxStaleness, "max-staleness", 0,
+		"never hold back a change for longer than this, whatever the limits (0: no bound)")
+	rootCmd.Flags().BoolVar(&compact, "compact", false, "encode snapshots without indentation")
+	rootCmd.Flags().StringVar(&journalDir, "journal", "", "record every snapshot in this directory")
+	rootCmd.Flags().Int64Var(&journalMaxSize, "journal-max-size", 100<<20,
+		"remove the oldest recorded snapshots once the journal is bigger than this many bytes (0: no limit)")
+	rootCmd.Flags().DurationVar(&journalMaxAge, "journal-max-age", 0,
+		"remove recorded snapshots older than this (0: no limit)")
 	rootCmd.Flags().BoolVarP(&showVersion, "version", "", false, "display version information")
 }
 
@@ -60,18 +89,25 @@ func _runWatt(cmd *cobra.Command, args []string) int {
 		return 0
 	}
 
-	if len(initialSources) == 0 {
+	if len(initialSources) == 0 && len(initialFiles) == 0 {
 		log.Println("no initial sources configured")
 		return 1
 	}
 
-	// XXX: we don't need to create this here anymore
-	client, err := k8s.NewClient(nil)
-	if err != nil {
-		log.Println(err)
-		return 1
+	// Without initial sources we don't talk to Kubernetes at all, so
+	// that watt runs outside of it.
+	var client *k8s.Client
+	var kubeAPIWatcher *k8s.Watcher
+	var err error
+	if len(initialSources) > 0 {
+		// XXX: we don't need to create this here anymore
+		client, err = k8s.NewClient(nil)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		kubeAPIWatcher = client.Watcher()
 	}
-	kubeAPIWatcher := client.Watcher()
 	/*for idx := range initialSources {
 		initialSources[idx] = kubeAPIWatcher.Canonical(initialSources[idx])
 	}*/
@@ -86,22 +122,61 @@ func _runWatt(cmd *cobra.Command, args []string) int {
 	// kubernetes watch manager.
 	aggregatorToKubewatchmanCh := make(chan []KubernetesWatchSpec, 100)
 
+	// The aggregator sends the current file and DNS watch sets to
+	// their watch managers.
+	aggregatorToFilewatchmanCh := make(chan []WatchSpec, 100)
+	aggregatorToDNSwatchmanCh := make(chan []WatchSpec, 100)
+	aggregatorToConnectwatchmanCh := make(chan []WatchSpec, 100)
+
+	apiServer, err := newAPIServer()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
 	invoker := NewInvoker(port, notifyReceivers)
-	limiter := limiter.NewComposite(limiter.NewUnlimited(), limiter.NewInterval(interval), interval)
+	invoker.apiServerListen = listenOn
+	if journalDir != "" {
+		invoker.journal, err = newJournal(journalDir, journalMaxSize, journalMaxAge)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	limiters, err := newLimiters(limits, maxStaleness)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	watchHook, err := NewWatchHook(watchHooks)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
 	aggregator := NewAggregator(invoker.Snapshots, aggregatorToKubewatchmanCh, aggregatorToConsulwatchmanCh,
-		initialSources, ExecWatchHook(watchHooks), limiter)
+		initialSources, watchHook, newIntervalLimiter())
+	aggregator.limiters = limiters
+	aggregator.compact = compact
+	aggregator.fileWatches = aggregatorToFilewatchmanCh
+	aggregator.dnsWatches = aggregatorToDNSwatchmanCh
+	aggregator.connectWatches = aggregatorToConnectwatchmanCh
+	for _, path := range initialFiles {
+		aggregator.staticWatches.FileWatches = append(aggregator.staticWatches.FileWatches, FileWatchSpec{Path: path})
+	}
 
 	kubebootstrap := kubebootstrap{
-		namespace:      kubernetesNamespace,
-		kinds:          initialSources,
-		fieldSelector:  initialFieldSelector,
-		labelSelector:  initialLabelSelector,
-		kubeAPIWatcher: kubeAPIWatcher,
-		notify:         []chan<- k8sEvent{aggregator.KubernetesEvents},
+		namespaces:        kubernetesNamespaces,
+		namespaceSelector: kubernetesNamespaceSelector,
+		kinds:             initialSources,
+		fieldSelector:     initialFieldSelector,
+		labelSelector:     initialLabelSelector,
+		kubeAPIWatcher:    kubeAPIWatcher,
+		notify:            []chan<- k8sEvent{aggregator.KubernetesEvents},
 	}
 
+	consulWatchMaker := &ConsulWatchMaker{aggregatorCh: aggregator.ConsulEvents}
 	consulwatchman := consulwatchman{
-		WatchMaker: &ConsulWatchMaker{aggregatorCh: aggregator.ConsulEvents},
+		WatchMaker: consulWatchMaker,
 		watchesCh:  aggregatorToConsulwatchmanCh,
 		watched:    make(map[string]*supervisor.Worker),
 	}
@@ -111,18 +186,37 @@ func _runWatt(cmd *cobra.Command, args []string) int {
 		in:         aggregatorToKubewatchmanCh,
 	}
 
-	apiServer := &apiServer{
-		port:    port,
-		invoker: invoker,
+	filewatchman := watchman{
+		source:     "file",
+		WatchMaker: &FileWatchMaker{aggregatorCh: aggregator.FileEvents},
+		in:         aggregatorToFilewatchmanCh,
+	}
+
+	dnswatchman := watchman{
+		source:     "dns",
+		WatchMaker: &DNSWatchMaker{aggregatorCh: aggregator.DNSEvents},
+		in:         aggregatorToDNSwatchmanCh,
 	}
 
+	connectwatchman := watchman{
+		source:     "connect",
+		WatchMaker: &ConnectWatchMaker{aggregatorCh: aggregator.ConnectEvents, clients: &consulWatchMaker.clients},
+		in:         aggregatorToConnectwatchmanCh,
+	}
+
+	apiServer.invoker = invoker
+	apiServer.compact = compact
+	apiServer.status = aggregator.status
+
 	ctx := context.Background()
 	s := supervisor.WithContext(ctx)
 
-	s.Supervise(&supervisor.Worker{
-		Name: "kubebootstrap",
-		Work: kubebootstrap.Work,
-	})
+	if kubeAPIWatcher != nil {
+		s.Supervise(&supervisor.Worker{
+			Name: "kubebootstrap",
+			Work: kubebootstrap.Work,
+		})
+	}
 
 	s.Supervise(&supervisor.Worker{
 		Name: "consulwatchman",
@@ -134,6 +228,21 @@ func _runWatt(cmd *cobra.Command, args []string) int {
 		Work: kubewatchman.Work,
 	})
 
+	s.Supervise(&supervisor.Worker{
+		Name: "filewatchman",
+		Work: filewatchman.Work,
+	})
+
+	s.Supervise(&supervisor.Worker{
+		Name: "dnswatchman",
+		Work: dnswatchman.Work,
+	})
+
+	s.Supervise(&supervisor.Worker{
+		Name: "connectwatchman",
+		Work: connectwatchman.Work,
+	})
+
 	s.Supervise(&supervisor.Worker{
 		Name: "aggregator",
 		Work: aggregator.Work,
@@ -161,6 +270,68 @@ func _runWatt(cmd *cobra.Command, args []string) int {
 	return 0
 }
 
+// newIntervalLimiter makes the --interval limiter.
+func newIntervalLimiter() limiter.Limiter {
+	return limiter.NewComposite(limiter.NewUnlimited(), limiter.NewInterval(interval), interval)
+}
+
+// newLimiters makes the limiters of the sources and kinds. Everything that
+// doesn't have a --limit of its own gets the --interval limiter. Without
+// any --limit or --max-staleness there are none, and the one --interval
+// limiter limits everything together, as it always has.
+func newLimiters(limits []string, maxStaleness time.Duration) (*limiter.Keyed, error) {
+	if len(limits) == 0 && maxStaleness == 0 {
+		return nil, nil
+	}
+
+	policies := make(map[string]limiter.Policy)
+	for _, limit := range limits {
+		parts := strings.SplitN(limit, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad --limit %q, expected KEY=POLICY", limit)
+		}
+		policy, err := limiter.ParsePolicy(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		policies[strings.ToLower(parts[0])] = policy
+	}
+
+	fallback := limiter.Policy(newIntervalLimiter)
+
+	if maxStaleness > 0 {
+		for key, policy := range policies {
+			policies[key] = withMaxStaleness(policy, maxStaleness)
+		}
+		fallback = withMaxStaleness(fallback, maxStaleness)
+	}
+
+	return limiter.NewKeyed(policies, fallback), nil
+}
+
+// newAPIServer makes the snapshot server from the --port, --listen and
+// --hmac-key-file flags.
+func newAPIServer() (*apiServer, error) {
+	if err := checkListen(listenOn, notifyReceivers); err != nil {
+		return nil, err
+	}
+	server := &apiServer{port: port, listen: listenOn}
+	if hmacKeyFile != "" {
+		key, err := readHMACKey(hmacKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.hmacKey = key
+	}
+	return server, nil
+}
+
+func withMaxStaleness(policy limiter.Policy, max time.Duration) limiter.Policy {
+	return func() limiter.Limiter {
+		return limiter.NewMaxStaleness(policy(), max)
+	}
+}
+
 func Main() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Println(err)
@@ -0,0 +1,314 @@
+package watt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/datawire/ambassador/pkg/k8s"
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+// namespaceRetryMin and namespaceRetryMax bound how long a namespace that
+// couldn't be watched waits before it's tried again. The wait doubles with
+// every try that fails.
+const (
+	namespaceRetryMin = time.Second
+	namespaceRetryMax = time.Minute
+)
+
+// namespaceWatcher watches a kind in one namespace. It's a k8s.Watcher,
+// other than in tests.
+type namespaceWatcher interface {
+	Start() error
+	Stop()
+}
+
+// kubeNamespaceWatcher is a k8s.Watcher that says when it fails to start.
+type kubeNamespaceWatcher struct {
+	*k8s.Watcher
+}
+
+func (w kubeNamespaceWatcher) Start() error {
+	return startWatcher(w.Watcher)
+}
+
+// namespacedWatch watches a kind in a list of namespaces, and in the
+// namespaces picked by a label selector, which is itself watched. A
+// k8s.Watcher watches a kind in a single namespace, so every namespace gets
+// a watcher of its own, and what they all find is sent as one list. This is
+// for when we may only look at some namespaces, not at the whole cluster.
+//
+// A namespace that can't be watched doesn't stop the others, it's tried
+// again until it can be. Meanwhile, what's sent is partial.
+type namespacedWatch struct {
+	client        *k8s.Client
+	kind          string
+	fieldSelector string
+	labelSelector string
+	namespaces    []string
+	selector      string
+
+	// send gets the resources of all the namespaces whenever any of them
+	// change, and whether some namespaces are missing.
+	send func(resources []k8s.Resource, partial bool)
+	// fail gets the errors of the namespaces that can't be watched, which
+	// can't fail the whole watch.
+	fail func(err error)
+	// newWatcher makes the unstarted watcher of a namespace, which calls
+	// found with everything in the namespace whenever it changes. It's
+	// newKubeWatcher if not set.
+	newWatcher func(ns string, found func(watcher namespaceWatcher, resources []k8s.Resource)) (namespaceWatcher, error)
+
+	// setMux makes one set of namespaces start at a time
+	setMux sync.Mutex
+
+	mux       sync.Mutex
+	watchers  map[string]namespaceWatcher
+	resources map[string][]k8s.Resource
+	// starting holds back sends while a set of namespaces starts
+	starting bool
+	// wanted is the last set of namespaces, and failed the ones of them
+	// that couldn't be watched, which are retried after retryDelay
+	wanted     []string
+	failed     map[string]bool
+	retry      *time.Timer
+	retryDelay time.Duration
+	stopped    bool
+}
+
+func (w *namespacedWatch) init() {
+	w.watchers = make(map[string]namespaceWatcher)
+	w.resources = make(map[string][]k8s.Resource)
+	w.failed = make(map[string]bool)
+	if w.newWatcher == nil {
+		w.newWatcher = w.newKubeWatcher
+	}
+}
+
+func (w *namespacedWatch) Work(p *supervisor.Process) error {
+	w.init()
+	defer w.stop()
+
+	if w.selector == "" {
+		w.setNamespaces(p, mergeNamespaces(w.namespaces))
+	} else {
+		nsWatcher := w.client.Watcher()
+		err := nsWatcher.SelectiveWatch("", "namespaces", "", w.selector, func(watcher *k8s.Watcher) {
+			selected := namespaceNames(watcher.List("namespaces"))
+			w.setNamespaces(p, mergeNamespaces(w.namespaces, selected))
+		})
+		if err == nil {
+			err = startWatcher(nsWatcher)
+		}
+		if err != nil {
+			return err
+		}
+		defer nsWatcher.Stop()
+	}
+
+	p.Ready()
+	<-p.Shutdown()
+	return nil
+}
+
+// setNamespaces starts watching the namespaces that are new, stops
+// watching the ones that are gone, and sends what's left. The new
+// namespaces that fail are reported, and tried again later.
+func (w *namespacedWatch) setNamespaces(p *supervisor.Process, namespaces []string) {
+	w.setMux.Lock()
+	defer w.setMux.Unlock()
+
+	wanted := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		wanted[ns] = true
+	}
+
+	w.mux.Lock()
+	if w.stopped {
+		w.mux.Unlock()
+		return
+	}
+	w.wanted = namespaces
+	w.starting = true
+	for ns, watcher := range w.watchers {
+		if !wanted[ns] {
+			p.Logf("stop watching %q in namespace %q", w.kind, ns)
+			watcher.Stop()
+			delete(w.watchers, ns)
+			delete(w.resources, ns)
+		}
+	}
+	for ns := range w.failed {
+		if !wanted[ns] {
+			delete(w.failed, ns)
+		}
+	}
+	w.mux.Unlock()
+
+	var errs []error
+	for _, ns := range namespaces {
+		w.mux.Lock()
+		_, ok := w.watchers[ns]
+		w.mux.Unlock()
+		if ok {
+			continue
+		}
+		p.Logf("adding kubernetes watch for %q in namespace %q", w.kind, ns)
+		err := w.watch(ns)
+		w.mux.Lock()
+		if err != nil {
+			w.failed[ns] = true
+			errs = append(errs, fmt.Errorf("namespace %q: %w", ns, err))
+		} else {
+			delete(w.failed, ns)
+		}
+		w.mux.Unlock()
+	}
+
+	// the errors go first, so that the resources don't look like the
+	// watch is fine
+	for _, err := range errs {
+		w.fail(err)
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.starting = false
+	w.sendLocked()
+	w.retryLocked(p)
+}
+
+// retryLocked tries the namespaces that failed again later, waiting longer
+// every time they fail.
+func (w *namespacedWatch) retryLocked(p *supervisor.Process) {
+	if len(w.failed) == 0 {
+		w.retryDelay = 0
+		return
+	}
+	if w.retry != nil || w.stopped {
+		return
+	}
+	w.retryDelay *= 2
+	if w.retryDelay < namespaceRetryMin {
+		w.retryDelay = namespaceRetryMin
+	}
+	if w.retryDelay > namespaceRetryMax {
+		w.retryDelay = namespaceRetryMax
+	}
+	p.Logf("retrying %d namespace(s) for %q in %v", len(w.failed), w.kind, w.retryDelay)
+	w.retry = time.AfterFunc(w.retryDelay, func() {
+		w.mux.Lock()
+		w.retry = nil
+		namespaces := w.wanted
+		w.mux.Unlock()
+		w.setNamespaces(p, namespaces)
+	})
+}
+
+// newKubeWatcher makes a k8s.Watcher for a namespace.
+func (w *namespacedWatch) newKubeWatcher(ns string, found func(namespaceWatcher, []k8s.Resource)) (namespaceWatcher, error) {
+	watcher := kubeNamespaceWatcher{w.client.Watcher()}
+	err := watcher.SelectiveWatch(ns, w.kind, w.fieldSelector, w.labelSelector, func(kw *k8s.Watcher) {
+		found(watcher, kw.List(w.kind))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// watch starts the watcher of a namespace.
+func (w *namespacedWatch) watch(ns string) error {
+	watcher, err := w.newWatcher(ns, func(watcher namespaceWatcher, resources []k8s.Resource) {
+		w.found(ns, watcher, resources)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the watcher reports its namespace as soon as it starts
+	w.mux.Lock()
+	w.watchers[ns] = watcher
+	w.mux.Unlock()
+	if err := watcher.Start(); err != nil {
+		w.mux.Lock()
+		delete(w.watchers, ns)
+		delete(w.resources, ns)
+		w.mux.Unlock()
+		watcher.Stop()
+		return err
+	}
+	return nil
+}
+
+// found takes what a watcher found in its namespace.
+func (w *namespacedWatch) found(ns string, watcher namespaceWatcher, resources []k8s.Resource) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	// a watcher we've stopped may still have one last go
+	if w.watchers[ns] != watcher {
+		return
+	}
+	w.resources[ns] = resources
+	if !w.starting {
+		w.sendLocked()
+	}
+}
+
+// sendLocked sends the resources of all the namespaces, in the order of
+// the namespaces.
+func (w *namespacedWatch) sendLocked() {
+	namespaces := make([]string, 0, len(w.resources))
+	for ns := range w.resources {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	resources := make([]k8s.Resource, 0)
+	for _, ns := range namespaces {
+		resources = append(resources, w.resources[ns]...)
+	}
+	w.send(resources, len(w.failed) > 0)
+}
+
+func (w *namespacedWatch) stop() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.stopped = true
+	if w.retry != nil {
+		w.retry.Stop()
+		w.retry = nil
+	}
+	for ns, watcher := range w.watchers {
+		watcher.Stop()
+		delete(w.watchers, ns)
+	}
+}
+
+// namespaceNames returns the names of namespace resources.
+func namespaceNames(namespaces []k8s.Resource) []string {
+	result := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		result = append(result, ns.Name())
+	}
+	return result
+}
+
+// mergeNamespaces returns the namespaces in any of the lists, sorted and
+// without duplicates.
+func mergeNamespaces(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, list := range lists {
+		for _, ns := range list {
+			if ns != "" && !seen[ns] {
+				seen[ns] = true
+				result = append(result, ns)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
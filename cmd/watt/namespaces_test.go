@@ -0,0 +1,258 @@
+package watt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/k8s"
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+func TestMergeNamespaces(t *testing.T) {
+	require.Equal(t, []string{}, mergeNamespaces())
+	require.Equal(t, []string{}, mergeNamespaces([]string{""}))
+	require.Equal(t, []string{"a", "b", "c"}, mergeNamespaces([]string{"", "c", "a"}, []string{"b", "a"}))
+}
+
+func TestNamespacedWatchId(t *testing.T) {
+	spec := KubernetesWatchSpec{Kind: "service", Namespace: "a"}
+	require.Equal(t, "service|a|*|*", spec.WatchId())
+
+	spec.Namespaces = []string{"b", "c"}
+	listed := spec.WatchId()
+	require.Equal(t, "service|a|*|*|ns=b,c|nssel=", listed)
+
+	spec.NamespaceSelector = "team=blue"
+	require.NotEqual(t, listed, spec.WatchId())
+}
+
+func TestNamespacedWatchSend(t *testing.T) {
+	resource := func(ns, name string) k8s.Resource {
+		return k8s.Resource{
+			"kind":     "Service",
+			"metadata": map[string]interface{}{"namespace": ns, "name": name},
+		}
+	}
+
+	var sent []k8s.Resource
+	w := &namespacedWatch{
+		kind: "service",
+		send: func(resources []k8s.Resource, partial bool) { sent = resources },
+		resources: map[string][]k8s.Resource{
+			"b": {resource("b", "foo")},
+			"a": {resource("a", "foo"), resource("a", "bar")},
+			"c": nil,
+		},
+	}
+
+	w.sendLocked()
+	require.Equal(t, []k8s.Resource{resource("a", "foo"), resource("a", "bar"), resource("b", "foo")}, sent)
+
+	// no namespaces is no resources, which still bootstraps the kind
+	w.resources = map[string][]k8s.Resource{}
+	w.sendLocked()
+	require.NotNil(t, sent)
+	require.Empty(t, sent)
+}
+
+func TestNamespaceNames(t *testing.T) {
+	namespaces := []k8s.Resource{
+		{"kind": "Namespace", "metadata": map[string]interface{}{"name": "default"}},
+		{"kind": "Namespace", "metadata": map[string]interface{}{"name": "team-blue"}},
+	}
+	require.Equal(t, []string{"default", "team-blue"}, namespaceNames(namespaces))
+}
+
+// fakeNamespaces stands in for the cluster: it makes watchers that find a
+// service named after their namespace as they start, or fail to.
+type fakeNamespaces struct {
+	mux      sync.Mutex
+	failing  map[string]bool
+	watchers map[string]*fakeWatcher
+}
+
+type fakeWatcher struct {
+	ns      string
+	found   func(namespaceWatcher, []k8s.Resource)
+	fail    bool
+	stopped bool
+}
+
+func (f *fakeWatcher) Start() error {
+	if f.fail {
+		return errors.New("forbidden")
+	}
+	f.found(f, []k8s.Resource{namespacedService(f.ns)})
+	return nil
+}
+
+func (f *fakeWatcher) Stop() {
+	f.stopped = true
+}
+
+func (f *fakeNamespaces) newWatcher(ns string, found func(namespaceWatcher, []k8s.Resource)) (namespaceWatcher, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	watcher := &fakeWatcher{ns: ns, found: found, fail: f.failing[ns]}
+	f.watchers[ns] = watcher
+	return watcher, nil
+}
+
+func (f *fakeNamespaces) setFailing(ns string, failing bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.failing[ns] = failing
+}
+
+func namespacedService(ns string) k8s.Resource {
+	return k8s.Resource{
+		"kind":     "Service",
+		"metadata": map[string]interface{}{"namespace": ns, "name": "svc"},
+	}
+}
+
+type namespacedSend struct {
+	namespaces []string
+	partial    bool
+}
+
+// startNamespacedWatch returns a watch on fake namespaces, with what it
+// sends and the errors it reports, and a process to run it with.
+func startNamespacedWatch(t *testing.T) (*namespacedWatch, *fakeNamespaces, chan namespacedSend, chan error, *supervisor.Process, func()) {
+	fake := &fakeNamespaces{failing: make(map[string]bool), watchers: make(map[string]*fakeWatcher)}
+	sends := make(chan namespacedSend, 100)
+	fails := make(chan error, 100)
+	w := &namespacedWatch{
+		kind: "service",
+		send: func(resources []k8s.Resource, partial bool) {
+			var namespaces []string
+			for _, r := range resources {
+				namespaces = append(namespaces, r.Namespace())
+			}
+			sends <- namespacedSend{namespaces, partial}
+		},
+		fail:       func(err error) { fails <- err },
+		newWatcher: fake.newWatcher,
+	}
+	w.init()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	processes := make(chan *supervisor.Process)
+	sup := supervisor.WithContext(ctx)
+	sup.Supervise(&supervisor.Worker{
+		Name: "namespaces",
+		Work: func(p *supervisor.Process) error {
+			processes <- p
+			<-p.Shutdown()
+			return nil
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		sup.Run()
+		close(done)
+	}()
+	return w, fake, sends, fails, <-processes, func() {
+		w.stop()
+		sup.Shutdown()
+		<-done
+		cancel()
+	}
+}
+
+func TestNamespacedWatchSetNamespaces(t *testing.T) {
+	w, fake, sends, fails, p, stop := startNamespacedWatch(t)
+	defer stop()
+
+	// the namespaces report as they start, but only one send goes out
+	w.setNamespaces(p, []string{"a", "b"})
+	require.Equal(t, namespacedSend{[]string{"a", "b"}, false}, <-sends)
+	require.Empty(t, sends)
+
+	old := fake.watchers["a"]
+	w.setNamespaces(p, []string{"b", "c"})
+	require.Equal(t, namespacedSend{[]string{"b", "c"}, false}, <-sends)
+	require.True(t, old.stopped)
+	require.False(t, fake.watchers["b"].stopped)
+
+	// the watcher of a namespace that's gone may have one last go, which
+	// is ignored
+	old.found(old, []k8s.Resource{namespacedService("a")})
+	require.Empty(t, sends)
+	require.NotContains(t, w.resources, "a")
+
+	// a namespace that comes back gets a new watcher
+	w.setNamespaces(p, []string{"a", "b", "c"})
+	require.Equal(t, namespacedSend{[]string{"a", "b", "c"}, false}, <-sends)
+	require.NotEqual(t, old, fake.watchers["a"])
+
+	// once started, changes are sent as they come
+	fake.watchers["c"].found(fake.watchers["c"], nil)
+	require.Equal(t, namespacedSend{[]string{"a", "b"}, false}, <-sends)
+	require.Empty(t, fails)
+}
+
+func TestNamespacedWatchRetry(t *testing.T) {
+	w, fake, sends, fails, p, stop := startNamespacedWatch(t)
+	defer stop()
+
+	// a namespace we can't watch doesn't hold the others back, but what's
+	// sent is partial
+	fake.setFailing("b", true)
+	w.setNamespaces(p, []string{"a", "b"})
+	require.Contains(t, (<-fails).Error(), `namespace "b"`)
+	require.Equal(t, namespacedSend{[]string{"a"}, true}, <-sends)
+
+	// it's tried again, later every time
+	select {
+	case err := <-fails:
+		require.Contains(t, err.Error(), `namespace "b"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("namespace b wasn't retried")
+	}
+	require.Equal(t, namespacedSend{[]string{"a"}, true}, <-sends)
+	w.mux.Lock()
+	require.Equal(t, 2*namespaceRetryMin, w.retryDelay)
+	w.mux.Unlock()
+
+	fake.setFailing("b", false)
+	select {
+	case send := <-sends:
+		require.Equal(t, namespacedSend{[]string{"a", "b"}, false}, send)
+	case <-time.After(5 * time.Second):
+		t.Fatal("namespace b wasn't retried")
+	}
+	w.mux.Lock()
+	require.Empty(t, w.failed)
+	require.Equal(t, time.Duration(0), w.retryDelay)
+	w.mux.Unlock()
+
+	// a namespace that failed and is gone isn't tried again
+	fake.setFailing("c", true)
+	w.setNamespaces(p, []string{"a", "b", "c"})
+	<-fails
+	require.Equal(t, namespacedSend{[]string{"a", "b"}, true}, <-sends)
+	w.setNamespaces(p, []string{"a", "b"})
+	require.Equal(t, namespacedSend{[]string{"a", "b"}, false}, <-sends)
+	w.mux.Lock()
+	require.Empty(t, w.failed)
+	w.mux.Unlock()
+}
+
+func TestPartialKeepsErrors(t *testing.T) {
+	a := NewAggregator(nil, nil, nil, nil, nil, nil)
+	watchId := "service|a|*|*|ns=b|nssel="
+	a.setKubernetesResources(makeWatchErrorEvent("kubernetes", watchId, errors.New(`namespace "b": forbidden`)))
+
+	a.setKubernetesResources(k8sEvent{watchId: watchId, kind: "service", resources: SERVICES, partial: true})
+	require.Len(t, a.errors[watchId], 1)
+	require.Equal(t, SERVICES, a.kubernetesResources[watchId]["service"])
+
+	a.setKubernetesResources(k8sEvent{watchId: watchId, kind: "service", resources: SERVICES})
+	require.Empty(t, a.errors[watchId])
+}
@@ -0,0 +1,267 @@
+package watt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/datawire/ambassador/pkg/k8s"
+)
+
+// A projection trims the resources of a Kubernetes watch down to what the
+// watch asked for, so that snapshots stay small and don't carry what nobody
+// needs, like managedFields or the contents of unrelated Secrets.
+//
+// Paths are JSONPath-ish: field names separated by dots, with an optional
+// leading "$" or ".", "[*]" for every item of a list, and "\." for a dot in
+// a field name. For example ".metadata.managedFields", ".spec.ports[*].port"
+// or ".metadata.annotations.kubectl\.kubernetes\.io/last-applied-configuration".
+//
+// Include, if set, keeps only the given fields, plus the ones that identify
+// the resource (apiVersion, kind, and metadata.name and namespace). Exclude
+// then removes fields. Annotations, if set, removes every annotation but the
+// ones listed; an entry ending in "*" matches every annotation starting with
+// what comes before it.
+type projection struct {
+	include     [][]pathSegment
+	exclude     [][]pathSegment
+	annotations []string
+}
+
+// pathSegment is a field name, or every item of a list.
+type pathSegment struct {
+	name string
+	all  bool
+}
+
+// identity are the fields always kept by an include.
+var identity = []string{".apiVersion", ".kind", ".metadata.name", ".metadata.namespace"}
+
+func newProjection(spec KubernetesWatchSpec) (*projection, error) {
+	if len(spec.Include) == 0 && len(spec.Exclude) == 0 && len(spec.Annotations) == 0 {
+		return nil, nil
+	}
+
+	p := &projection{annotations: spec.Annotations}
+	if len(spec.Include) > 0 {
+		paths := append(append([]string{}, identity...), spec.Include...)
+		for _, path := range paths {
+			segments, err := parsePath(path)
+			if err != nil {
+				return nil, err
+			}
+			p.include = append(p.include, segments)
+		}
+	}
+	for _, path := range spec.Exclude {
+		segments, err := parsePath(path)
+		if err != nil {
+			return nil, err
+		}
+		if segments[len(segments)-1].all {
+			return nil, fmt.Errorf("%q: can't exclude list items, exclude the list", path)
+		}
+		p.exclude = append(p.exclude, segments)
+	}
+	return p, nil
+}
+
+func parsePath(path string) ([]pathSegment, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+
+	var segments []pathSegment
+	var name strings.Builder
+	named := false
+	flush := func() {
+		if named {
+			segments = append(segments, pathSegment{name: name.String()})
+		}
+		name.Reset()
+		named = false
+	}
+
+	for i := 0; i < len(rest); i++ {
+		switch {
+		case rest[i] == '\\' && i+1 < len(rest):
+			i++
+			name.WriteByte(rest[i])
+			named = true
+		case rest[i] == '.':
+			if !named && (len(segments) == 0 || !segments[len(segments)-1].all) {
+				return nil, fmt.Errorf("%q: empty field name", path)
+			}
+			flush()
+		case strings.HasPrefix(rest[i:], "[*]"):
+			flush()
+			if len(segments) == 0 {
+				return nil, fmt.Errorf("%q: [*] must follow a field", path)
+			}
+			segments = append(segments, pathSegment{all: true})
+			i += 2
+		default:
+			name.WriteByte(rest[i])
+			named = true
+		}
+	}
+	flush()
+
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%q: empty path", path)
+	}
+	return segments, nil
+}
+
+// apply returns a projected copy of a resource. The resource itself is left
+// alone, since the watcher hangs on to it.
+func (p *projection) apply(r k8s.Resource) k8s.Resource {
+	var obj interface{} = deepCopy(map[string]interface{}(r))
+
+	if len(p.include) > 0 {
+		var included interface{} = map[string]interface{}{}
+		for _, path := range p.include {
+			if v, ok := includePath(obj, path); ok {
+				included = merge(included, v)
+			}
+		}
+		obj = included
+	}
+
+	for _, path := range p.exclude {
+		excludePath(obj, path)
+	}
+
+	m := obj.(map[string]interface{})
+	if len(p.annotations) > 0 {
+		if metadata, ok := m["metadata"].(map[string]interface{}); ok {
+			if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+				for key := range annotations {
+					if !p.allowAnnotation(key) {
+						delete(annotations, key)
+					}
+				}
+			}
+		}
+	}
+
+	return k8s.Resource(m)
+}
+
+func (p *projection) allowAnnotation(key string) bool {
+	for _, allowed := range p.annotations {
+		if strings.HasSuffix(allowed, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(allowed, "*")) {
+				return true
+			}
+		} else if key == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			result[key] = deepCopy(value)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for idx, value := range v {
+			result[idx] = deepCopy(value)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// includePath returns the part of v at path, in the shape of v: a map with
+// just that field, or a list with just that part of every item.
+func includePath(v interface{}, path []pathSegment) (interface{}, bool) {
+	if len(path) == 0 {
+		return v, true
+	}
+
+	if path[0].all {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, false
+		}
+		// items without the field stay in as empty maps, so that the
+		// items of two includes line up when they are merged
+		result := make([]interface{}, len(list))
+		for idx, item := range list {
+			if sub, ok := includePath(item, path[1:]); ok {
+				result[idx] = sub
+			} else {
+				result[idx] = map[string]interface{}{}
+			}
+		}
+		return result, true
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	field, ok := m[path[0].name]
+	if !ok {
+		return nil, false
+	}
+	sub, ok := includePath(field, path[1:])
+	if !ok {
+		return nil, false
+	}
+	return map[string]interface{}{path[0].name: sub}, true
+}
+
+// merge merges two partial copies of the same value.
+func merge(a, b interface{}) interface{} {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			for key, value := range b {
+				if existing, ok := a[key]; ok {
+					a[key] = merge(existing, value)
+				} else {
+					a[key] = value
+				}
+			}
+			return a
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok && len(a) == len(b) {
+			for idx := range a {
+				a[idx] = merge(a[idx], b[idx])
+			}
+			return a
+		}
+	}
+	return b
+}
+
+// excludePath removes the field at path from v.
+func excludePath(v interface{}, path []pathSegment) {
+	if path[0].all {
+		if list, ok := v.([]interface{}); ok {
+			for _, item := range list {
+				excludePath(item, path[1:])
+			}
+		}
+		return
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		delete(m, path[0].name)
+		return
+	}
+	if field, ok := m[path[0].name]; ok {
+		excludePath(field, path[1:])
+	}
+}
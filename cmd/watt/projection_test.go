@@ -0,0 +1,103 @@
+package watt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/k8s"
+)
+
+func TestParsePath(t *testing.T) {
+	segments, err := parsePath(`$.metadata.annotations.kubectl\.kubernetes\.io/last-applied-configuration`)
+	require.NoError(t, err)
+	require.Equal(t, []pathSegment{
+		{name: "metadata"},
+		{name: "annotations"},
+		{name: "kubectl.kubernetes.io/last-applied-configuration"},
+	}, segments)
+
+	segments, err = parsePath(".spec.ports[*].port")
+	require.NoError(t, err)
+	require.Equal(t, []pathSegment{{name: "spec"}, {name: "ports"}, {all: true}, {name: "port"}}, segments)
+
+	for _, path := range []string{"", ".", "a..b", "[*].a"} {
+		_, err = parsePath(path)
+		require.Error(t, err, path)
+	}
+}
+
+func secret() k8s.Resource {
+	return k8s.Resource{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":      "foo",
+			"namespace": "default",
+			"annotations": map[string]interface{}{
+				"getambassador.io/config":                          "---",
+				"getambassador.io/other":                           "x",
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+			},
+			"managedFields": []interface{}{map[string]interface{}{"manager": "kubectl"}},
+		},
+		"type": "kubernetes.io/tls",
+		"data": map[string]interface{}{"tls.crt": "abc", "tls.key": "def"},
+		"spec": map[string]interface{}{
+			"ports": []interface{}{
+				map[string]interface{}{"name": "http", "port": 80},
+				map[string]interface{}{"port": 443},
+			},
+		},
+	}
+}
+
+func TestProjection(t *testing.T) {
+	p, err := newProjection(KubernetesWatchSpec{Kind: "secret"})
+	require.NoError(t, err)
+	require.Nil(t, p)
+
+	_, err = newProjection(KubernetesWatchSpec{Exclude: []string{".spec.ports[*]"}})
+	require.Error(t, err)
+
+	original := secret()
+
+	p, err = newProjection(KubernetesWatchSpec{
+		Exclude:     []string{".metadata.managedFields", ".data"},
+		Annotations: []string{"getambassador.io/config"},
+	})
+	require.NoError(t, err)
+	projected := p.apply(original)
+	require.Nil(t, projected["data"])
+	require.Equal(t, "kubernetes.io/tls", projected["type"])
+	metadata := projected["metadata"].(map[string]interface{})
+	require.Nil(t, metadata["managedFields"])
+	require.Equal(t, map[string]interface{}{"getambassador.io/config": "---"}, metadata["annotations"])
+
+	p, err = newProjection(KubernetesWatchSpec{
+		Include:     []string{".spec.ports[*].port", ".metadata.annotations"},
+		Annotations: []string{"getambassador.io/*"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, k8s.Resource{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":      "foo",
+			"namespace": "default",
+			"annotations": map[string]interface{}{
+				"getambassador.io/config": "---",
+				"getambassador.io/other":  "x",
+			},
+		},
+		"spec": map[string]interface{}{
+			"ports": []interface{}{
+				map[string]interface{}{"port": 80},
+				map[string]interface{}{"port": 443},
+			},
+		},
+	}, p.apply(original))
+
+	// the watcher's copy is left alone
+	require.Equal(t, secret(), original)
+}
@@ -0,0 +1,122 @@
+package watt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+var replaySpeed float64
+
+var replayCmd = &cobra.Command{
+	Use:   "replay JOURNAL_DIR",
+	Short: "feed the snapshots recorded in a journal to the notify receivers",
+	Long: "replay feeds the snapshots recorded with --journal to the --notify receivers, in order,\n" +
+		"with the timing they were recorded with, sped up by --speed.",
+	Args: cobra.ExactArgs(1),
+	Run:  runReplay,
+}
+
+func init() {
+	replayCmd.Flags().StringSliceVar(&notifyReceivers, "notify", []string{},
+		"invoke the program with the given arguments as a receiver")
+	replayCmd.Flags().IntVarP(&port, "port", "p", 7000, "configure the snapshot server port")
+	replayCmd.Flags().StringVar(&listenOn, "listen", "",
+		"serve snapshots on this host only, e.g. localhost, or on a Unix socket, e.g. unix:/run/watt.sock")
+	replayCmd.Flags().StringVar(&hmacKeyFile, "hmac-key-file", "",
+		"sign snapshots with the HMAC-SHA256 key in this file, in the "+signatureHeader+" header")
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1,
+		"replay this many times faster than the snapshots were recorded (0: as fast as the receivers go)")
+	rootCmd.AddCommand(replayCmd)
+}
+
+func runReplay(cmd *cobra.Command, args []string) {
+	os.Exit(_runReplay(args[0]))
+}
+
+func _runReplay(dir string) int {
+	entries, err := readJournal(dir)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if len(entries) == 0 {
+		log.Printf("no snapshots in %s", dir)
+		return 1
+	}
+
+	apiServer, err := newAPIServer()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	invoker := NewInvoker(port, notifyReceivers)
+	invoker.apiServerListen = listenOn
+	apiServer.invoker = invoker
+
+	s := supervisor.WithContext(context.Background())
+
+	s.Supervise(&supervisor.Worker{
+		Name: "api",
+		Work: apiServer.Work,
+	})
+
+	s.Supervise(&supervisor.Worker{
+		Name:     "replay",
+		Requires: []string{"api"},
+		Work: func(p *supervisor.Process) error {
+			defer p.Supervisor().Shutdown()
+			return replay(p, invoker, entries, replaySpeed)
+		},
+	})
+
+	if errs := s.Run(); len(errs) > 0 {
+		msgs := []string{}
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		log.Printf("ERROR(s): %s", strings.Join(msgs, "\n    "))
+		return 1
+	}
+
+	return 0
+}
+
+// replay invokes the receivers with every snapshot in a journal, waiting
+// between snapshots as long as the recording did divided by speed. Every
+// snapshot is invoked, even if the receivers are slower than the recording.
+func replay(p *supervisor.Process, invoker *invoker, entries []journalEntry, speed float64) error {
+	invoker.process = p
+	p.Ready()
+
+	start := time.Now()
+	for _, e := range entries {
+		if speed > 0 {
+			offset := time.Duration(float64(e.time.Sub(entries[0].time)) / speed)
+			select {
+			case <-time.After(time.Until(start.Add(offset))):
+			case <-p.Shutdown():
+				return nil
+			}
+		}
+
+		snapshot, err := ioutil.ReadFile(e.path)
+		if err != nil {
+			return fmt.Errorf("reading snapshot: %v", err)
+		}
+		p.Logf("replaying snapshot %d recorded at %s", e.id, e.time.Format(time.RFC3339Nano))
+		invoker.latestSnapshot = string(snapshot)
+		invoker.invoke()
+	}
+
+	p.Logf("replayed %d snapshots", len(entries))
+	return nil
+}
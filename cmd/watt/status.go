@@ -0,0 +1,169 @@
+package watt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+type watchState string
+
+const (
+	// a watch is pending until we've heard from it for the first time
+	watchPending  watchState = "pending"
+	watchSynced   watchState = "synced"
+	watchErroring watchState = "erroring"
+)
+
+// the source of the watch on the initial --source kinds
+const bootstrapSource = "kubebootstrap"
+
+// WatchStatus is what the /watches endpoint reports about a watch.
+type WatchStatus struct {
+	Source    string     `json:"source"`
+	Id        string     `json:"id"`
+	State     watchState `json:"state"`
+	Resources int        `json:"resources"`
+	LastEvent *time.Time `json:"last-event,omitempty"`
+	LastError string     `json:"last-error,omitempty"`
+}
+
+// statusBoard keeps track of how the watches are doing, for the health
+// endpoints. The aggregator updates it, and the API server reads it.
+type statusBoard struct {
+	mux          sync.Mutex
+	watches      map[string]*WatchStatus
+	bootstrapped bool
+}
+
+func newStatusBoard() *statusBoard {
+	return &statusBoard{watches: make(map[string]*WatchStatus)}
+}
+
+func statusKey(source, id string) string {
+	return source + " " + id
+}
+
+// setWatches sets the watches of a source: new ones start out pending,
+// and the ones that are gone are forgotten.
+func (b *statusBoard) setWatches(source string, ids []string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		key := statusKey(source, id)
+		wanted[key] = true
+		if _, ok := b.watches[key]; !ok {
+			b.watches[key] = &WatchStatus{Source: source, Id: id, State: watchPending}
+		}
+	}
+	for key, w := range b.watches {
+		if w.Source == source && !wanted[key] {
+			delete(b.watches, key)
+		}
+	}
+}
+
+// synced records that a watch has sent us its resources. Events from
+// watches we've already forgotten are ignored.
+func (b *statusBoard) synced(source, id string, resources int, now time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if w, ok := b.watches[statusKey(source, id)]; ok {
+		w.State = watchSynced
+		w.Resources = resources
+		w.LastEvent = &now
+	}
+}
+
+// failed records that a watch ran into an error. The last error sticks
+// around after the watch recovers.
+func (b *statusBoard) failed(source, id, message string, now time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if w, ok := b.watches[statusKey(source, id)]; ok {
+		w.State = watchErroring
+		w.LastError = message
+		w.LastEvent = &now
+	}
+}
+
+func (b *statusBoard) setBootstrapped() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.bootstrapped = true
+}
+
+// list returns the watches, ordered by source and id.
+func (b *statusBoard) list() []WatchStatus {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	result := make([]WatchStatus, 0, len(b.watches))
+	for _, w := range b.watches {
+		result = append(result, *w)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Source != result[j].Source {
+			return result[i].Source < result[j].Source
+		}
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+// ready returns whether we're bootstrapped, and if not, the watches we're
+// still waiting for.
+func (b *statusBoard) ready() (bool, []string) {
+	b.mux.Lock()
+	bootstrapped := b.bootstrapped
+	b.mux.Unlock()
+	if bootstrapped {
+		return true, nil
+	}
+
+	var pending []string
+	for _, w := range b.list() {
+		if w.State != watchSynced {
+			pending = append(pending, fmt.Sprintf("%s watch %s: %s", w.Source, w.Id, w.State))
+		}
+	}
+	return false, pending
+}
+
+// handle adds the /healthz, /readyz and /watches endpoints.
+func (b *statusBoard) handle(p *supervisor.Process) {
+	// we're alive as long as we can answer
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, pending := b.ready()
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(fmt.Sprintf("not bootstrapped, waiting for:\n  %s\n", strings.Join(pending, "\n  "))))
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	http.HandleFunc("/watches", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := json.MarshalIndent(b.list(), "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		if _, err := w.Write(bytes); err != nil {
+			p.Logf("write watches error: %v", err)
+		}
+	})
+}
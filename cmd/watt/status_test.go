@@ -0,0 +1,54 @@
+package watt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusBoard(t *testing.T) {
+	b := newStatusBoard()
+	now := time.Now()
+
+	b.setWatches("kubernetes", []string{"service|*|*|*", "secret|*|*|*"})
+	b.setWatches("consul", []string{"127.0.0.1:8500|dc1|bar"})
+	// events from unknown watches are ignored
+	b.synced("consul", "127.0.0.1:8500|dc1|foo", 3, now)
+
+	ready, pending := b.ready()
+	require.False(t, ready)
+	require.Equal(t, []string{
+		"consul watch 127.0.0.1:8500|dc1|bar: pending",
+		"kubernetes watch secret|*|*|*: pending",
+		"kubernetes watch service|*|*|*: pending",
+	}, pending)
+
+	b.synced("kubernetes", "service|*|*|*", 2, now)
+	b.failed("consul", "127.0.0.1:8500|dc1|bar", "connection refused", now)
+	watches := b.list()
+	require.Equal(t, 3, len(watches))
+	require.Equal(t, WatchStatus{
+		Source:    "consul",
+		Id:        "127.0.0.1:8500|dc1|bar",
+		State:     watchErroring,
+		LastEvent: &now,
+		LastError: "connection refused",
+	}, watches[0])
+	require.Equal(t, watchPending, watches[1].State)
+	require.Equal(t, watchSynced, watches[2].State)
+	require.Equal(t, 2, watches[2].Resources)
+
+	// recovering keeps the last error around
+	b.synced("consul", "127.0.0.1:8500|dc1|bar", 1, now)
+	require.Equal(t, watchSynced, b.list()[0].State)
+	require.Equal(t, "connection refused", b.list()[0].LastError)
+
+	b.setWatches("kubernetes", []string{"service|*|*|*"})
+	require.Equal(t, 2, len(b.list()))
+
+	b.setBootstrapped()
+	ready, pending = b.ready()
+	require.True(t, ready)
+	require.Empty(t, pending)
+}
@@ -0,0 +1,173 @@
+package watt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+// The snapshot stream pushes snapshots to receivers as server-sent events,
+// rather than running a --notify command per snapshot and having it fetch
+// the snapshot back. Each event is:
+//
+//   id: 7
+//   event: snapshot
+//   data: {"id": 7, "digest": "SHA-256=...", "signature": "...", "snapshot": "{...}"}
+//
+// where the snapshot is only there for ?body=true, and the signature only
+// with an --hmac-key-file. The snapshot is a string of exactly the bytes
+// that the digest and the signature are of, which are the bytes that
+// /snapshots/7 serves. A receiver that reconnects with a Last-Event-ID
+// doesn't get that snapshot again.
+
+// streamKeepalive is how often an idle stream gets a comment, so that
+// proxies don't take it for dead.
+const streamKeepalive = 30 * time.Second
+
+// subscriber is a snapshot stream. It has room for one snapshot id: a
+// subscriber that's slow to take it gets the newer one instead, as with the
+// invoker, which only ever invokes the latest snapshot.
+type subscriber struct {
+	ids chan int
+}
+
+// subscribers are the snapshot streams. Publishing never waits for them.
+type subscribers struct {
+	mux    sync.Mutex
+	subs   map[*subscriber]bool
+	latest int
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{subs: make(map[*subscriber]bool)}
+}
+
+// subscribe returns a new subscriber, and the id of the latest snapshot,
+// which it won't be sent.
+func (s *subscribers) subscribe() (*subscriber, int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sub := &subscriber{ids: make(chan int, 1)}
+	s.subs[sub] = true
+	return sub, s.latest
+}
+
+func (s *subscribers) unsubscribe(sub *subscriber) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.subs, sub)
+}
+
+func (s *subscribers) publish(id int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.latest = id
+	for sub := range s.subs {
+		// we're the only sender, so once the id they haven't taken is
+		// dropped, there's room
+		select {
+		case <-sub.ids:
+		default:
+		}
+		sub.ids <- id
+	}
+}
+
+// streamEvent is the data of a snapshot event.
+type streamEvent struct {
+	Id        int    `json:"id"`
+	Digest    string `json:"digest"`
+	Signature string `json:"signature,omitempty"`
+	Snapshot  string `json:"snapshot,omitempty"`
+}
+
+// serveStream serves the snapshot stream, starting with the latest
+// snapshot.
+func (s *apiServer) serveStream(w http.ResponseWriter, r *http.Request, p *supervisor.Process) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	withBody := false
+	if body := r.URL.Query().Get("body"); body != "" {
+		var err error
+		if withBody, err = strconv.ParseBool(body); err != nil {
+			http.Error(w, "body is not a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+	// a receiver that reconnects has seen this one
+	last, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+
+	sub, latest := s.invoker.subscribers.subscribe()
+	defer s.invoker.subscribers.unsubscribe(sub)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(id int) error {
+		if id == last {
+			return nil
+		}
+		// old snapshots are garbage collected, but a subscriber only
+		// ever has the latest one to take
+		snapshot := s.invoker.getSnapshot(id)
+		if snapshot == "" {
+			return nil
+		}
+		event := streamEvent{Id: id, Digest: snapshotDigest([]byte(snapshot))}
+		if s.hmacKey != nil {
+			event.Signature = snapshotSignature(s.hmacKey, []byte(snapshot))
+		}
+		if withBody {
+			event.Snapshot = snapshot
+		}
+		// newlines are escaped, so the event is on one line
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: snapshot\ndata: %s\n\n", id, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		last = id
+		return nil
+	}
+
+	if latest > 0 {
+		if err := send(latest); err != nil {
+			p.Logf("write snapshot stream error: %v", err)
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case id := <-sub.ids:
+			if err := send(id); err != nil {
+				p.Logf("write snapshot stream error: %v", err)
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-p.Shutdown():
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package watt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+func TestSubscribersCoalesce(t *testing.T) {
+	subs := newSubscribers()
+	sub, latest := subs.subscribe()
+	require.Equal(t, 0, latest)
+
+	// a slow subscriber only gets the latest snapshot
+	subs.publish(1)
+	subs.publish(2)
+	subs.publish(3)
+	require.Equal(t, 3, <-sub.ids)
+	select {
+	case id := <-sub.ids:
+		t.Fatalf("got snapshot %d twice", id)
+	default:
+	}
+
+	late, latest := subs.subscribe()
+	require.Equal(t, 3, latest)
+	subs.publish(4)
+	require.Equal(t, 4, <-sub.ids)
+	require.Equal(t, 4, <-late.ids)
+
+	subs.unsubscribe(sub)
+	subs.publish(5)
+	require.Empty(t, sub.ids)
+	require.Equal(t, 5, <-late.ids)
+}
+
+// readEvent reads the next server-sent event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	event := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(event) > 0 {
+				return event
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		require.Len(t, parts, 2)
+		event[parts[0]] = parts[1]
+	}
+}
+
+func TestSnapshotStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	invoker := NewInvoker(0, nil)
+	server := &apiServer{invoker: invoker, hmacKey: []byte("sekrit")}
+	urls := make(chan string, 1)
+	sup := supervisor.WithContext(ctx)
+	sup.Supervise(&supervisor.Worker{
+		Name: "stream",
+		Work: func(p *supervisor.Process) error {
+			invoker.process = p
+			httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				server.serveStream(w, r, p)
+			}))
+			urls <- httpServer.URL
+			<-p.Shutdown()
+			httpServer.Close()
+			return nil
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		sup.Run()
+		close(done)
+	}()
+	url := <-urls
+
+	publish := func(snapshot string) int {
+		id := invoker.storeSnapshot(snapshot)
+		invoker.subscribers.publish(id)
+		return id
+	}
+	publish("{\n    \"Kubernetes\": {}\n}")
+
+	get := func(url string, lastEventId string) *bufio.Reader {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		require.NoError(t, err)
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/event-stream", resp.Header.Get("content-type"))
+		return bufio.NewReader(resp.Body)
+	}
+
+	// the latest snapshot comes first, with its body if asked for
+	stream := get(url+"?body=true", "")
+	event := readEvent(t, stream)
+	require.Equal(t, "1", event["id"])
+	require.Equal(t, "snapshot", event["event"])
+	var data streamEvent
+	require.NoError(t, json.Unmarshal([]byte(event["data"]), &data))
+	require.Equal(t, 1, data.Id)
+	// the snapshot is what the digest and the signature are of
+	require.Equal(t, "{\n    \"Kubernetes\": {}\n}", data.Snapshot)
+	require.Equal(t, snapshotDigest([]byte(data.Snapshot)), data.Digest)
+	require.Equal(t, snapshotSignature([]byte("sekrit"), []byte(data.Snapshot)), data.Signature)
+
+	publish(`{"Kubernetes": {"service": []}}`)
+	event = readEvent(t, stream)
+	require.Equal(t, "2", event["id"])
+
+	// without the body, and without what we've seen already
+	stream = get(url, "2")
+	publish(`{"Kubernetes": {"service": [{}]}}`)
+	event = readEvent(t, stream)
+	require.Equal(t, "3", event["id"])
+	data = streamEvent{}
+	require.NoError(t, json.Unmarshal([]byte(event["data"]), &data))
+	require.Equal(t, 3, data.Id)
+	require.Empty(t, data.Snapshot)
+
+	sup.Shutdown()
+	<-done
+}
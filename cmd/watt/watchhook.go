@@ -0,0 +1,175 @@
+package watt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+// Watch hooks are given every snapshot, and tell us what to watch next. A
+// --watch hook is one of:
+//
+//  - go:NAME, a hook registered in-process with RegisterWatchHook,
+//  - an http:// or https:// URL, which the snapshot is POSTed to, or
+//  - anything else, which is run with `sh -c` with the snapshot on stdin.
+//
+// The HTTP and exec hooks answer with a WatchSet in JSON. A hook that fails
+// shows up in the snapshot errors under watchHookErrorSource.
+
+const watchHookErrorSource = "watch-hook"
+
+var (
+	watchHooksMu         sync.Mutex
+	registeredWatchHooks = make(map[string]WatchHook)
+
+	// hookClient is used by HTTP watch hooks, which mustn't hang watt
+	// forever
+	hookClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// RegisterWatchHook makes a Go watch hook available as go:NAME. It must be
+// called before watt starts.
+func RegisterWatchHook(name string, hook WatchHook) {
+	watchHooksMu.Lock()
+	defer watchHooksMu.Unlock()
+	registeredWatchHooks[name] = hook
+}
+
+// NewWatchHook returns the watch hook that runs all the given hooks and
+// merges their watches.
+func NewWatchHook(hooks []string) (WatchHook, error) {
+	watchHooksMu.Lock()
+	defer watchHooksMu.Unlock()
+
+	var resolved []WatchHook
+	for _, hook := range hooks {
+		switch {
+		case strings.HasPrefix(hook, "go:"):
+			h, ok := registeredWatchHooks[strings.TrimPrefix(hook, "go:")]
+			if !ok {
+				return nil, fmt.Errorf("no watch hook registered as %q", hook)
+			}
+			resolved = append(resolved, h)
+		case strings.HasPrefix(hook, "http://"), strings.HasPrefix(hook, "https://"):
+			resolved = append(resolved, HTTPWatchHook(hook))
+		default:
+			resolved = append(resolved, execWatchHook(hook))
+		}
+	}
+
+	return combineWatchHooks(hooks, resolved), nil
+}
+
+// ExecWatchHook returns the watch hook that runs all the given commands.
+func ExecWatchHook(watchHooks []string) WatchHook {
+	hooks := make([]WatchHook, len(watchHooks))
+	for idx, hook := range watchHooks {
+		hooks[idx] = execWatchHook(hook)
+	}
+	return combineWatchHooks(watchHooks, hooks)
+}
+
+// combineWatchHooks runs hooks one after another. The watches of the hooks
+// that fail are left out, and their errors are reported together.
+func combineWatchHooks(names []string, hooks []WatchHook) WatchHook {
+	return func(p *supervisor.Process, snapshot string) (WatchSet, error) {
+		result := WatchSet{}
+		var failures []string
+
+		for idx, hook := range hooks {
+			ws, err := hook(p, snapshot)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", names[idx], err))
+				continue
+			}
+			result.KubernetesWatches = append(result.KubernetesWatches, ws.KubernetesWatches...)
+			result.ConsulWatches = append(result.ConsulWatches, ws.ConsulWatches...)
+			result.FileWatches = append(result.FileWatches, ws.FileWatches...)
+			result.DNSWatches = append(result.DNSWatches, ws.DNSWatches...)
+			result.ConnectWatches = append(result.ConnectWatches, ws.ConnectWatches...)
+		}
+
+		if len(failures) > 0 {
+			return result, fmt.Errorf("%s", strings.Join(failures, "; "))
+		}
+		return result, nil
+	}
+}
+
+func lines(st string) []string {
+	return strings.Split(st, "\n")
+}
+
+// decodeWatchSet decodes the WatchSet a hook answered with.
+func decodeWatchSet(p *supervisor.Process, encoded string) (WatchSet, error) {
+	decoder := json.NewDecoder(strings.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	result := WatchSet{}
+	err := decoder.Decode(&result)
+	if err != nil {
+		for _, line := range lines(encoded) {
+			p.Logf("watch hook: %s", line)
+		}
+		return WatchSet{}, fmt.Errorf("watchset decode failed: %v", err)
+	}
+
+	return result, nil
+}
+
+func execWatchHook(hook string) WatchHook {
+	return func(p *supervisor.Process, snapshot string) (WatchSet, error) {
+		cmd := exec.Command("sh", "-c", hook)
+		cmd.Stdin = strings.NewReader(snapshot)
+		var watches, errors strings.Builder
+		cmd.Stdout = &watches
+		cmd.Stderr = &errors
+		err := cmd.Run()
+		stderr := errors.String()
+		if stderr != "" {
+			for _, line := range lines(stderr) {
+				p.Logf("watch hook stderr: %s", line)
+			}
+		}
+		if err != nil {
+			return WatchSet{}, err
+		}
+
+		return decodeWatchSet(p, watches.String())
+	}
+}
+
+// HTTPWatchHook returns a watch hook that POSTs the snapshot to a URL, and
+// reads the WatchSet from the response.
+func HTTPWatchHook(url string) WatchHook {
+	return func(p *supervisor.Process, snapshot string) (WatchSet, error) {
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(snapshot))
+		if err != nil {
+			return WatchSet{}, err
+		}
+		req = req.WithContext(p.Context())
+		req.Header.Set("content-type", "application/json")
+
+		res, err := hookClient.Do(req)
+		if err != nil {
+			return WatchSet{}, err
+		}
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return WatchSet{}, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return WatchSet{}, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+		}
+
+		return decodeWatchSet(p, string(body))
+	}
+}
@@ -0,0 +1,56 @@
+package watt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+func runWatchHook(t *testing.T, hooks []string, snapshot string) (result WatchSet, err error) {
+	hook, err := NewWatchHook(hooks)
+	require.NoError(t, err)
+	supervisor.MustRun("watch-hook", func(p *supervisor.Process) error {
+		result, err = hook(p, snapshot)
+		return nil
+	})
+	return
+}
+
+func TestWatchHooks(t *testing.T) {
+	RegisterWatchHook("test", func(p *supervisor.Process, snapshot string) (WatchSet, error) {
+		return WatchSet{ConsulWatches: []ConsulWatchSpec{{ServiceName: snapshot}}}, nil
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"kubernetes-watches": [{"kind": %q}]}`, body)
+	}))
+	defer srv.Close()
+
+	result, err := runWatchHook(t, []string{"go:test", srv.URL, `echo '{"consul-watches": [{"service-name": "exec"}]}'`}, "foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo", "exec"}, []string{result.ConsulWatches[0].ServiceName, result.ConsulWatches[1].ServiceName})
+	require.Equal(t, "foo", result.KubernetesWatches[0].Kind)
+}
+
+func TestWatchHookErrors(t *testing.T) {
+	_, err := NewWatchHook([]string{"go:missing"})
+	require.Error(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	result, err := runWatchHook(t, []string{srv.URL, "echo bogus", `echo '{"consul-watches": [{"service-name": "ok"}]}'`}, "{}")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "500 Internal Server Error: nope")
+	require.Contains(t, err.Error(), "echo bogus: watchset decode failed")
+	require.Equal(t, 1, len(result.ConsulWatches))
+}
@@ -3,6 +3,7 @@ package watt
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/datawire/ambassador/pkg/supervisor"
 )
@@ -10,6 +11,9 @@ import (
 type WatchSet struct {
 	KubernetesWatches []KubernetesWatchSpec `json:"kubernetes-watches"`
 	ConsulWatches     []ConsulWatchSpec     `json:"consul-watches"`
+	FileWatches       []FileWatchSpec       `json:"file-watches"`
+	DNSWatches        []DNSWatchSpec        `json:"dns-watches"`
+	ConnectWatches    []ConnectWatchSpec    `json:"connect-watches"`
 }
 
 // Interpolate values into specific watches in specific places. This is not a generic method but could be made one
@@ -20,17 +24,22 @@ type WatchSet struct {
 // 	- https://github.com/datawire/ambassador/issues/110
 //	- https://github.com/datawire/ambassador/issues/1508
 func (w *WatchSet) interpolate() WatchSet {
-	result := WatchSet{KubernetesWatches: w.KubernetesWatches}
+	result := WatchSet{
+		KubernetesWatches: w.KubernetesWatches,
+		FileWatches:       w.FileWatches,
+		DNSWatches:        w.DNSWatches,
+	}
+
+	for _, s := range w.ConnectWatches {
+		s.ConsulAddress = os.ExpandEnv(s.ConsulAddress)
+		result.ConnectWatches = append(result.ConnectWatches, s)
+	}
 
 	if w.ConsulWatches != nil {
 		modifiedConsulWatchSpecs := make([]ConsulWatchSpec, 0)
 		for _, s := range w.ConsulWatches {
-			modifiedConsulWatchSpecs = append(modifiedConsulWatchSpecs, ConsulWatchSpec{
-				Id:            s.Id,
-				ServiceName:   s.ServiceName,
-				Datacenter:    s.Datacenter,
-				ConsulAddress: os.ExpandEnv(s.ConsulAddress),
-			})
+			s.ConsulAddress = os.ExpandEnv(s.ConsulAddress)
+			modifiedConsulWatchSpecs = append(modifiedConsulWatchSpecs, s)
 		}
 
 		result.ConsulWatches = modifiedConsulWatchSpecs
@@ -39,11 +48,56 @@ func (w *WatchSet) interpolate() WatchSet {
 	return result
 }
 
+// fileSpecs returns the file watches as WatchSpecs.
+func (w *WatchSet) fileSpecs() []WatchSpec {
+	result := make([]WatchSpec, len(w.FileWatches))
+	for idx, spec := range w.FileWatches {
+		result[idx] = spec
+	}
+	return result
+}
+
+// dnsSpecs returns the DNS watches as WatchSpecs.
+func (w *WatchSet) dnsSpecs() []WatchSpec {
+	result := make([]WatchSpec, len(w.DNSWatches))
+	for idx, spec := range w.DNSWatches {
+		result[idx] = spec
+	}
+	return result
+}
+
+// connectSpecs returns the Consul Connect watches as WatchSpecs.
+func (w *WatchSet) connectSpecs() []WatchSpec {
+	result := make([]WatchSpec, len(w.ConnectWatches))
+	for idx, spec := range w.ConnectWatches {
+		result[idx] = spec
+	}
+	return result
+}
+
+// sourceWatches returns the watches on all the pluggable sources.
+func (w *WatchSet) sourceWatches() []WatchSpec {
+	return append(append(w.fileSpecs(), w.dnsSpecs()...), w.connectSpecs()...)
+}
+
 type KubernetesWatchSpec struct {
 	Kind          string `json:"kind"`
 	Namespace     string `json:"namespace"`
 	FieldSelector string `json:"field-selector"`
 	LabelSelector string `json:"label-selector"`
+
+	// Namespaces and NamespaceSelector watch the kind in a set of
+	// namespaces rather than in one or in all of them: the ones listed,
+	// along with Namespace, and the ones whose labels match the selector.
+	// See namespaces.go.
+	Namespaces        []string `json:"namespaces,omitempty"`
+	NamespaceSelector string   `json:"namespace-selector,omitempty"`
+
+	// Include, Exclude and Annotations trim down the resources before
+	// they go in the snapshot. See projection.go.
+	Include     []string `json:"include,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
 }
 
 func star(s string) string {
@@ -55,7 +109,22 @@ func star(s string) string {
 }
 
 func (k KubernetesWatchSpec) WatchId() string {
-	return fmt.Sprintf("%s|%s|%s|%s", k.Kind, star(k.Namespace), star(k.FieldSelector), star(k.LabelSelector))
+	id := fmt.Sprintf("%s|%s|%s|%s", k.Kind, star(k.Namespace), star(k.FieldSelector), star(k.LabelSelector))
+	if k.isNamespaced() {
+		id += fmt.Sprintf("|ns=%s|nssel=%s", strings.Join(k.Namespaces, ","), k.NamespaceSelector)
+	}
+	// watches that only differ in what they keep of the resources
+	// are different watches
+	if len(k.Include) > 0 || len(k.Exclude) > 0 || len(k.Annotations) > 0 {
+		id += fmt.Sprintf("|%s|%s|%s", strings.Join(k.Include, ","), strings.Join(k.Exclude, ","),
+			strings.Join(k.Annotations, ","))
+	}
+	return id
+}
+
+// isNamespaced returns whether the watch is on a set of namespaces.
+func (k KubernetesWatchSpec) isNamespaced() bool {
+	return len(k.Namespaces) > 0 || k.NamespaceSelector != ""
 }
 
 type ConsulWatchSpec struct {
@@ -63,10 +132,92 @@ type ConsulWatchSpec struct {
 	ConsulAddress string `json:"consul-address"`
 	Datacenter    string `json:"datacenter"`
 	ServiceName   string `json:"service-name"`
+	// Consul, if set, is how to talk to the Consul at ConsulAddress.
+	Consul *ConsulConfig `json:"consul,omitempty"`
+	// IncludeUnhealthy includes the endpoints whose health isn't passing.
+	// Their health is in the endpoint.
+	IncludeUnhealthy bool `json:"include-unhealthy,omitempty"`
 }
 
 func (c ConsulWatchSpec) WatchId() string {
-	return fmt.Sprintf("%s|%s|%s", c.ConsulAddress, c.Datacenter, c.ServiceName)
+	id := fmt.Sprintf("%s|%s|%s", c.ConsulAddress, c.Datacenter, c.ServiceName)
+	if c.IncludeUnhealthy {
+		id += "|all"
+	}
+	// a new token or certificate means a new watch
+	if c.Consul != nil {
+		id += "|" + c.Consul.key()
+	}
+	return id
+}
+
+// WatchSpec is a watch on one of the pluggable sources, that is all of them
+// but Kubernetes and Consul. Every source has its own spec type, and a watch
+// maker that turns its specs into workers. The workers send what they find to
+// the aggregator, which puts it in its own section of the snapshot.
+type WatchSpec interface {
+	WatchId() string
+}
+
+// FileWatchSpec watches the Kubernetes-style YAML (or JSON) resources in a
+// file, or in the files in a directory.
+type FileWatchSpec struct {
+	Path string `json:"path"`
+}
+
+func (f FileWatchSpec) WatchId() string {
+	return fmt.Sprintf("file|%s", f.Path)
+}
+
+// DNSWatchSpec watches the SRV records of _service._proto.domain, or of
+// just the domain if there's no service. Proto defaults to tcp. Resolver is the
+// address of the DNS server to ask (default: the system resolver), and
+// Interval how often to ask (default: 30s).
+type DNSWatchSpec struct {
+	Id       string `json:"id"`
+	Service  string `json:"service"`
+	Proto    string `json:"proto"`
+	Domain   string `json:"domain"`
+	Resolver string `json:"resolver"`
+	Interval string `json:"interval"`
+}
+
+// Name returns the name to look up.
+func (d DNSWatchSpec) Name() string {
+	if d.Service == "" {
+		return d.Domain
+	}
+	proto := d.Proto
+	if proto == "" {
+		proto = "tcp"
+	}
+	return fmt.Sprintf("_%s._%s.%s", d.Service, proto, d.Domain)
+}
+
+func (d DNSWatchSpec) WatchId() string {
+	return fmt.Sprintf("dns|%s|%s", d.Name(), star(d.Resolver))
+}
+
+// ConnectWatchSpec watches the Consul Connect leaf certificate of a service,
+// and the Connect CA roots, on the Consul at ConsulAddress.
+type ConnectWatchSpec struct {
+	Id            string        `json:"id"`
+	ConsulAddress string        `json:"consul-address"`
+	ServiceName   string        `json:"service-name"`
+	Consul        *ConsulConfig `json:"consul,omitempty"`
+}
+
+func (c ConnectWatchSpec) WatchId() string {
+	id := fmt.Sprintf("connect|%s|%s", c.ConsulAddress, c.ServiceName)
+	if c.Consul != nil {
+		id += "|" + c.Consul.key()
+	}
+	return id
+}
+
+// IWatchMaker is an interface for the watch makers of the pluggable sources.
+type IWatchMaker interface {
+	MakeWatch(spec WatchSpec) (*supervisor.Worker, error)
 }
 
 // IKubernetesWatchMaker is an interface for KubernetesWatchMaker implementations. It mostly exists to facilitate the
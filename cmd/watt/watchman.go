@@ -0,0 +1,58 @@
+package watt
+
+import (
+	"github.com/datawire/ambassador/pkg/supervisor"
+)
+
+// watchman runs the watches of one of the pluggable sources: it starts a
+// worker for every spec it is sent that it isn't running yet, and stops the
+// ones that are no longer wanted.
+type watchman struct {
+	source     string
+	WatchMaker IWatchMaker
+	in         <-chan []WatchSpec
+	watched    map[string]*supervisor.Worker
+}
+
+func (w *watchman) Work(p *supervisor.Process) error {
+	p.Ready()
+
+	w.watched = make(map[string]*supervisor.Worker)
+
+	for {
+		select {
+		case watches := <-w.in:
+			found := make(map[string]*supervisor.Worker)
+			p.Logf("processing %d %s watch specs", len(watches), w.source)
+			for _, spec := range watches {
+				worker, err := w.WatchMaker.MakeWatch(spec)
+				if err != nil {
+					p.Logf("failed to create %s watch: %v", w.source, err)
+					continue
+				}
+
+				if _, exists := w.watched[worker.Name]; exists {
+					found[worker.Name] = w.watched[worker.Name]
+				} else {
+					p.Logf("add %s watcher %s\n", w.source, worker.Name)
+					p.Supervisor().Supervise(worker)
+					w.watched[worker.Name] = worker
+					found[worker.Name] = worker
+				}
+			}
+
+			for workerName, worker := range w.watched {
+				if _, exists := found[workerName]; !exists {
+					p.Logf("remove %s watcher %s\n", w.source, workerName)
+					worker.Shutdown()
+					worker.Wait()
+				}
+			}
+
+			w.watched = found
+		case <-p.Shutdown():
+			p.Logf("shutdown initiated")
+			return nil
+		}
+	}
+}
@@ -65,13 +65,27 @@ func (w *ServiceWatcher) Watch(handler func(endpoints Endpoints, err error)) {
 				tags = item.Service.Tags
 			}
 
+			address := item.Service.Address
+			if address == "" {
+				address = item.Node.Address
+			}
+
 			endpoints.Endpoints = append(endpoints.Endpoints, Endpoint{
-				Service:  item.Service.Service,
-				SystemID: fmt.Sprintf("consul::%s", item.Node.ID),
-				ID:       item.Service.ID,
-				Address:  item.Service.Address,
-				Port:     item.Service.Port,
-				Tags:     tags,
+				Service:     item.Service.Service,
+				SystemID:    fmt.Sprintf("consul::%s", item.Node.ID),
+				ID:          item.Service.ID,
+				Address:     address,
+				Port:        item.Service.Port,
+				Tags:        tags,
+				Meta:        item.Service.Meta,
+				Node:        item.Node.Node,
+				NodeAddress: item.Node.Address,
+				Datacenter:  item.Node.Datacenter,
+				Health:      item.Checks.AggregatedStatus(),
+				Weights: Weights{
+					Passing: item.Service.Weights.Passing,
+					Warning: item.Service.Weights.Warning,
+				},
 			})
 		}
 
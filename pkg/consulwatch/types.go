@@ -35,6 +35,26 @@ type Endpoint struct {
 	Address  string   `json:""`
 	Port     int      `json:""`
 	Tags     []string `json:""`
+	// Meta is the service metadata.
+	Meta map[string]string `json:",omitempty"`
+	// Node, NodeAddress and Datacenter are where the service runs. Address
+	// is NodeAddress when the service doesn't register an address of its
+	// own.
+	Node        string `json:",omitempty"`
+	NodeAddress string `json:",omitempty"`
+	Datacenter  string `json:",omitempty"`
+	// Health is the aggregated status of the health checks: "passing",
+	// "warning", "critical" or "maintenance". Only passing endpoints are
+	// watched, unless asked otherwise.
+	Health  string  `json:",omitempty"`
+	Weights Weights `json:""`
+}
+
+// Weights are the load balancing weights of an endpoint when its health is
+// passing or warning.
+type Weights struct {
+	Passing int `json:""`
+	Warning int `json:""`
 }
 
 type Certificate struct {
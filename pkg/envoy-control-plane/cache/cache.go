@@ -45,6 +45,7 @@ type ConfigWatcher interface {
 // Cache is a generic config cache with a watcher.
 type Cache interface {
 	ConfigWatcher
+	DeltaConfigWatcher
 
 	// Fetch implements the polling method of the config cache using a non-empty request.
 	Fetch(context.Context, Request) (*Response, error)
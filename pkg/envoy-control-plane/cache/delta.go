@@ -0,0 +1,180 @@
+// Copyright 2018 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/gogo/protobuf/jsonpb"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+)
+
+// DeltaRequest is an alias for the incremental discovery request type.
+type DeltaRequest = v2.DeltaDiscoveryRequest
+
+// DeltaResponse is a pre-serialized incremental xDS response.
+type DeltaResponse struct {
+	// Request is the original request.
+	Request DeltaRequest
+
+	// SystemVersion is the version of the snapshot the response was built
+	// from. It is informational only; incremental xDS tracks versions per
+	// resource.
+	SystemVersion string
+
+	// Resources are the added or modified resources.
+	Resources []Resource
+
+	// ResourceVersions are the versions of the resources in Resources,
+	// indexed by resource name.
+	ResourceVersions map[string]string
+
+	// RemovedResources are the names of resources the proxy has that are
+	// gone from the snapshot.
+	RemovedResources []string
+}
+
+// StreamState is the state of a single resource type on an incremental xDS
+// stream: which resources the proxy subscribed to, and which version of each
+// resource it has been sent.
+type StreamState struct {
+	// Wildcard is set when the proxy subscribed to all resources of the
+	// type, which is what it does for CDS and LDS.
+	Wildcard bool
+
+	// SubscribedResourceNames is the set of resource names the proxy
+	// explicitly subscribed to.
+	SubscribedResourceNames map[string]bool
+
+	// ResourceVersions are the versions of the resources the proxy has,
+	// indexed by resource name.
+	ResourceVersions map[string]string
+
+	// First is set until the first response is sent for the type, since
+	// the proxy expects a response to its initial request even if there is
+	// nothing to send.
+	First bool
+}
+
+// NewStreamState initializes the state for a resource type from the first
+// request for it on a stream.
+func NewStreamState(wildcard bool, initialResourceVersions map[string]string) StreamState {
+	state := StreamState{
+		Wildcard:                wildcard,
+		SubscribedResourceNames: make(map[string]bool),
+		ResourceVersions:        make(map[string]string, len(initialResourceVersions)),
+		First:                   true,
+	}
+	for name, version := range initialResourceVersions {
+		state.ResourceVersions[name] = version
+	}
+	return state
+}
+
+// IsSubscribed checks whether the proxy wants a resource.
+func (state StreamState) IsSubscribed(name string) bool {
+	return state.Wildcard || state.SubscribedResourceNames[name]
+}
+
+// Clone returns a deep copy of the state, so that a watch can hold on to it
+// while the stream goes on updating its own copy.
+func (state StreamState) Clone() StreamState {
+	out := state
+	out.SubscribedResourceNames = make(map[string]bool, len(state.SubscribedResourceNames))
+	for name := range state.SubscribedResourceNames {
+		out.SubscribedResourceNames[name] = true
+	}
+	out.ResourceVersions = make(map[string]string, len(state.ResourceVersions))
+	for name, version := range state.ResourceVersions {
+		out.ResourceVersions[name] = version
+	}
+	return out
+}
+
+// DeltaConfigWatcher requests watches for incremental configuration updates.
+// DeltaConfigWatcher implementation must be thread-safe.
+type DeltaConfigWatcher interface {
+	// CreateDeltaWatch returns a new open incremental watch for a request
+	// and the current state of the stream.
+	//
+	// Value channel produces the resources that differ from the stream
+	// state, once there are any. The same rules as for CreateWatch apply to
+	// closing the channel and to cancel.
+	CreateDeltaWatch(DeltaRequest, StreamState) (value chan DeltaResponse, cancel func())
+}
+
+// HashResource computes the version of a single resource from its content,
+// so that unchanged resources keep their version across snapshots. The
+// generated binary marshalers don't order map fields (which Struct configs are
+// full of), so we hash the JSON form instead, which does.
+func HashResource(resource Resource) (string, error) {
+	h := sha256.New()
+	if err := (&jsonpb.Marshaler{}).Marshal(h, resource); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashResources computes the versions of a group of resources, indexed by
+// resource name.
+func hashResources(resources map[string]Resource) (map[string]string, error) {
+	out := make(map[string]string, len(resources))
+	for name, resource := range resources {
+		version, err := HashResource(resource)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = version
+	}
+	return out, nil
+}
+
+// createDeltaResponse computes the difference between the resources and the
+// stream state. It returns false if there is no difference to send.
+func createDeltaResponse(request DeltaRequest, state StreamState, resources map[string]Resource,
+	versions map[string]string, systemVersion string) (DeltaResponse, bool) {
+	out := DeltaResponse{
+		Request:          request,
+		SystemVersion:    systemVersion,
+		ResourceVersions: make(map[string]string),
+	}
+
+	for name, resource := range resources {
+		if !state.IsSubscribed(name) {
+			continue
+		}
+		version := versions[name]
+		if prev, ok := state.ResourceVersions[name]; ok && prev == version {
+			continue
+		}
+		out.Resources = append(out.Resources, resource)
+		out.ResourceVersions[name] = version
+	}
+
+	for name := range state.ResourceVersions {
+		if _, ok := resources[name]; !ok {
+			out.RemovedResources = append(out.RemovedResources, name)
+		}
+	}
+	sort.Strings(out.RemovedResources)
+
+	if len(out.Resources) == 0 && len(out.RemovedResources) == 0 && !state.First {
+		return out, false
+	}
+	return out, true
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/test/resource"
+)
+
+func receiveDelta(t *testing.T, value chan cache.DeltaResponse) cache.DeltaResponse {
+	t.Helper()
+	select {
+	case out := <-value:
+		return out
+	case <-time.After(time.Second):
+		t.Fatal("failed to receive delta response")
+	}
+	return cache.DeltaResponse{}
+}
+
+func TestSnapshotCacheDeltaWatch(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+
+	// without a snapshot the watch stays open
+	state := cache.NewStreamState(true, nil)
+	value, _ := c.CreateDeltaWatch(v2.DeltaDiscoveryRequest{TypeUrl: cache.ClusterType}, state)
+	select {
+	case out := <-value:
+		t.Errorf("watch without snapshot => got %v, want none", out)
+	case <-time.After(time.Second / 4):
+	}
+
+	if err := c.SetSnapshot(key, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	out := receiveDelta(t, value)
+	if !reflect.DeepEqual(cache.IndexResourcesByName(out.Resources), snapshot.GetResources(cache.ClusterType)) {
+		t.Errorf("get resources %v, want %v", out.Resources, snapshot.GetResources(cache.ClusterType))
+	}
+	if len(out.RemovedResources) != 0 {
+		t.Errorf("got removed resources %v, want none", out.RemovedResources)
+	}
+	if out.SystemVersion != version {
+		t.Errorf("got system version %q, want %q", out.SystemVersion, version)
+	}
+
+	// once the proxy has everything, there is nothing to send
+	state.First = false
+	state.ResourceVersions = out.ResourceVersions
+	value, cancel := c.CreateDeltaWatch(v2.DeltaDiscoveryRequest{TypeUrl: cache.ClusterType}, state)
+	if got := c.GetStatusInfo(key).GetNumDeltaWatches(); got != 1 {
+		t.Errorf("got %d delta watches, want 1", got)
+	}
+
+	// a new snapshot with the same cluster does not trigger the watch
+	if err := c.SetSnapshot(key, cache.NewSnapshot(version2, nil, []cache.Resource{cluster}, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case out := <-value:
+		t.Errorf("watch for unchanged resources => got %v, want none", out)
+	case <-time.After(time.Second / 4):
+	}
+
+	// replacing the cluster sends the new one and removes the old one
+	other := resource.MakeCluster(resource.Ads, "cluster1")
+	if err := c.SetSnapshot(key, cache.NewSnapshot(version2, nil, []cache.Resource{other}, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	out = receiveDelta(t, value)
+	if len(out.Resources) != 1 || cache.GetResourceName(out.Resources[0]) != "cluster1" {
+		t.Errorf("got resources %v, want cluster1", out.Resources)
+	}
+	if want := []string{clusterName}; !reflect.DeepEqual(out.RemovedResources, want) {
+		t.Errorf("got removed resources %v, want %v", out.RemovedResources, want)
+	}
+	if got := c.GetStatusInfo(key).GetNumDeltaWatches(); got != 0 {
+		t.Errorf("got %d delta watches, want 0", got)
+	}
+	cancel()
+}
+
+func TestSnapshotCacheDeltaWatchSubscribed(t *testing.T) {
+	c := cache.NewSnapshotCache(true, group{}, logger{t: t})
+	if err := c.SetSnapshot(key, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// only subscribed resources are sent
+	state := cache.NewStreamState(false, nil)
+	state.SubscribedResourceNames["none"] = true
+	out := receiveDelta(t, mustDeltaWatch(c, cache.EndpointType, state))
+	if len(out.Resources) != 0 {
+		t.Errorf("got resources %v, want none", out.Resources)
+	}
+
+	state.SubscribedResourceNames[clusterName] = true
+	out = receiveDelta(t, mustDeltaWatch(c, cache.EndpointType, state))
+	if !reflect.DeepEqual(cache.IndexResourcesByName(out.Resources), snapshot.GetResources(cache.EndpointType)) {
+		t.Errorf("get resources %v, want %v", out.Resources, snapshot.GetResources(cache.EndpointType))
+	}
+
+	// resource versions from a previous stream are honored
+	version, err := cache.HashResource(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state = cache.NewStreamState(false, map[string]string{clusterName: version})
+	state.SubscribedResourceNames[clusterName] = true
+	state.First = false
+	value, cancel := c.CreateDeltaWatch(v2.DeltaDiscoveryRequest{TypeUrl: cache.EndpointType}, state)
+	defer cancel()
+	select {
+	case out := <-value:
+		t.Errorf("watch for up to date resources => got %v, want none", out)
+	case <-time.After(time.Second / 4):
+	}
+}
+
+func mustDeltaWatch(c cache.SnapshotCache, typeURL string, state cache.StreamState) chan cache.DeltaResponse {
+	value, _ := c.CreateDeltaWatch(v2.DeltaDiscoveryRequest{TypeUrl: typeURL}, state)
+	return value
+}
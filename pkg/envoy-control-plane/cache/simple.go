@@ -62,6 +62,11 @@ type snapshotCache struct {
 	// snapshots are cached resources indexed by node IDs
 	snapshots map[string]Snapshot
 
+	// versions are the per-resource versions used for incremental xDS,
+	// indexed by node ID, type URL and resource name. They are computed on
+	// first use and dropped whenever the node's snapshot changes.
+	versions map[string]map[string]map[string]string
+
 	// status information for all nodes indexed by node IDs
 	status map[string]*statusInfo
 
@@ -90,6 +95,7 @@ func NewSnapshotCache(ads bool, hash NodeHash, logger log.Logger) SnapshotCache
 		log:       logger,
 		ads:       ads,
 		snapshots: make(map[string]Snapshot),
+		versions:  make(map[string]map[string]map[string]string),
 		status:    make(map[string]*statusInfo),
 		hash:      hash,
 	}
@@ -102,6 +108,7 @@ func (cache *snapshotCache) SetSnapshot(node string, snapshot Snapshot) error {
 
 	// update the existing entry
 	cache.snapshots[node] = snapshot
+	delete(cache.versions, node)
 
 	// trigger existing watches for which version changed
 	if info, ok := cache.status[node]; ok {
@@ -118,6 +125,17 @@ func (cache *snapshotCache) SetSnapshot(node string, snapshot Snapshot) error {
 				delete(info.watches, id)
 			}
 		}
+		for id, watch := range info.deltaWatches {
+			if cache.respondDelta(node, snapshot, watch.Request, watch.State, watch.Response) {
+				if cache.log != nil {
+					cache.log.Infof("respond open delta watch %d for %s with new version %q",
+						id, watch.Request.TypeUrl, snapshot.GetVersion(watch.Request.TypeUrl))
+				}
+
+				// discard the watch
+				delete(info.deltaWatches, id)
+			}
+		}
 		info.mu.Unlock()
 	}
 
@@ -142,6 +160,7 @@ func (cache *snapshotCache) ClearSnapshot(node string) {
 	defer cache.mu.Unlock()
 
 	delete(cache.snapshots, node)
+	delete(cache.versions, node)
 	delete(cache.status, node)
 }
 
@@ -272,6 +291,104 @@ func createResponse(request Request, resources map[string]Resource, version stri
 	}
 }
 
+// CreateDeltaWatch returns an incremental watch for an xDS request. The watch
+// is responded as soon as the snapshot for the node differs from the stream
+// state.
+func (cache *snapshotCache) CreateDeltaWatch(request DeltaRequest, state StreamState) (chan DeltaResponse, func()) {
+	nodeID := cache.hash.ID(request.Node)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	info, ok := cache.status[nodeID]
+	if !ok {
+		info = newStatusInfo(request.Node)
+		cache.status[nodeID] = info
+	}
+
+	// update last watch request time
+	info.mu.Lock()
+	info.lastWatchRequestTime = time.Now()
+	info.mu.Unlock()
+
+	// allocate capacity 1 to allow one-time non-blocking use
+	value := make(chan DeltaResponse, 1)
+
+	snapshot, exists := cache.snapshots[nodeID]
+	if exists && cache.respondDelta(nodeID, snapshot, request, state, value) {
+		return value, nil
+	}
+
+	// nothing to send yet, leave an open watch
+	watchID := cache.nextWatchID()
+	if cache.log != nil {
+		cache.log.Infof("open delta watch %d for %s from nodeID %q", watchID, request.TypeUrl, nodeID)
+	}
+	info.mu.Lock()
+	info.deltaWatches[watchID] = DeltaResponseWatch{Request: request, State: state, Response: value}
+	info.mu.Unlock()
+	return value, cache.cancelDeltaWatch(nodeID, watchID)
+}
+
+// cancellation function for cleaning stale incremental watches
+func (cache *snapshotCache) cancelDeltaWatch(nodeID string, watchID int64) func() {
+	return func() {
+		// uses the cache mutex
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		if info, ok := cache.status[nodeID]; ok {
+			info.mu.Lock()
+			delete(info.deltaWatches, watchID)
+			info.mu.Unlock()
+		}
+	}
+}
+
+// respondDelta responds to an incremental watch with the difference between
+// the snapshot and the stream state, if there is one. It returns whether it
+// responded. The cache mutex must be held.
+func (cache *snapshotCache) respondDelta(nodeID string, snapshot Snapshot, request DeltaRequest, state StreamState, value chan DeltaResponse) bool {
+	resources := snapshot.GetResources(request.TypeUrl)
+	versions, err := cache.resourceVersions(nodeID, request.TypeUrl, resources)
+	if err != nil {
+		if cache.log != nil {
+			cache.log.Errorf("failed to compute resource versions for %s: %v", request.TypeUrl, err)
+		}
+		return false
+	}
+
+	out, changed := createDeltaResponse(request, state, resources, versions, snapshot.GetVersion(request.TypeUrl))
+	if !changed {
+		return false
+	}
+	if cache.log != nil {
+		cache.log.Infof("respond delta %s with %d resources and %d removed",
+			request.TypeUrl, len(out.Resources), len(out.RemovedResources))
+	}
+
+	value <- out
+	return true
+}
+
+// resourceVersions returns the per-resource versions for a node and type,
+// computing them if needed. The cache mutex must be held.
+func (cache *snapshotCache) resourceVersions(nodeID, typeURL string, resources map[string]Resource) (map[string]string, error) {
+	byType, ok := cache.versions[nodeID]
+	if !ok {
+		byType = make(map[string]map[string]string)
+		cache.versions[nodeID] = byType
+	}
+	if versions, ok := byType[typeURL]; ok {
+		return versions, nil
+	}
+	versions, err := hashResources(resources)
+	if err != nil {
+		return nil, err
+	}
+	byType[typeURL] = versions
+	return versions, nil
+}
+
 // Fetch implements the cache fetch function.
 // Fetch is called on multiple streams, so responding to individual names with the same version works.
 func (cache *snapshotCache) Fetch(ctx context.Context, request Request) (*Response, error) {
@@ -49,6 +49,9 @@ type StatusInfo interface {
 	// GetNumWatches returns the number of open watches.
 	GetNumWatches() int
 
+	// GetNumDeltaWatches returns the number of open incremental watches.
+	GetNumDeltaWatches() int
+
 	// GetLastWatchRequestTime returns the timestamp of the last discovery watch request.
 	GetLastWatchRequestTime() time.Time
 }
@@ -60,6 +63,10 @@ type statusInfo struct {
 	// watches are indexed channels for the response watches and the original requests.
 	watches map[int64]ResponseWatch
 
+	// deltaWatches are indexed channels for the incremental response watches,
+	// along with the original requests and stream states.
+	deltaWatches map[int64]DeltaResponseWatch
+
 	// the timestamp of the last watch request
 	lastWatchRequestTime time.Time
 
@@ -77,11 +84,25 @@ type ResponseWatch struct {
 	Response chan Response
 }
 
+// DeltaResponseWatch is an incremental watch record keeping the request, the
+// stream state at the time of the request, and an open channel for the response.
+type DeltaResponseWatch struct {
+	// Request is the original request for the watch.
+	Request DeltaRequest
+
+	// State is the stream state the response is computed against.
+	State StreamState
+
+	// Response is the channel to push the response to.
+	Response chan DeltaResponse
+}
+
 // newStatusInfo initializes a status info data structure.
 func newStatusInfo(node *core.Node) *statusInfo {
 	out := statusInfo{
-		node:    node,
-		watches: make(map[int64]ResponseWatch),
+		node:         node,
+		watches:      make(map[int64]ResponseWatch),
+		deltaWatches: make(map[int64]DeltaResponseWatch),
 	}
 	return &out
 }
@@ -98,6 +119,12 @@ func (info *statusInfo) GetNumWatches() int {
 	return len(info.watches)
 }
 
+func (info *statusInfo) GetNumDeltaWatches() int {
+	info.mu.RLock()
+	defer info.mu.RUnlock()
+	return len(info.deltaWatches)
+}
+
 func (info *statusInfo) GetLastWatchRequestTime() time.Time {
 	info.mu.RLock()
 	defer info.mu.RUnlock()
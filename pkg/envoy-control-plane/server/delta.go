@@ -0,0 +1,298 @@
+// Copyright 2018 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gogo/protobuf/proto"
+	any "github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+	core "github.com/datawire/ambassador/pkg/api/envoy/api/v2/core"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+)
+
+// DeltaCallbacks is an optional extension of Callbacks for incremental xDS
+// streams. OnStreamOpen and OnStreamClosed are shared with state-of-the-world
+// streams.
+type DeltaCallbacks interface {
+	// OnStreamDeltaRequest is called once an incremental request is received on a stream.
+	// Returning an error will end processing and close the stream. OnStreamClosed will still be called.
+	OnStreamDeltaRequest(int64, *v2.DeltaDiscoveryRequest) error
+	// OnStreamDeltaResponse is called immediately prior to sending an incremental response on a stream.
+	OnStreamDeltaResponse(int64, *v2.DeltaDiscoveryRequest, *v2.DeltaDiscoveryResponse)
+}
+
+type deltaStream interface {
+	grpc.ServerStream
+
+	Send(*v2.DeltaDiscoveryResponse) error
+	Recv() (*v2.DeltaDiscoveryRequest, error)
+}
+
+// deltaWatch is the incremental watch for a single resource type on a stream,
+// along with what the proxy has for that type.
+type deltaWatch struct {
+	responses chan cache.DeltaResponse
+	cancel    func()
+
+	// nonce of the last response sent for the type
+	nonce string
+
+	state cache.StreamState
+}
+
+// Cancel the watch, if any
+func (w *deltaWatch) Cancel() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.responses = nil
+	w.cancel = nil
+}
+
+func createDeltaResponse(resp *cache.DeltaResponse, typeURL string) (*v2.DeltaDiscoveryResponse, error) {
+	if resp == nil {
+		return nil, errors.New("missing response")
+	}
+	resources := make([]*v2.Resource, len(resp.Resources))
+	for i := 0; i < len(resp.Resources); i++ {
+		// Envoy relies on serialized protobuf bytes for detecting changes to the resources.
+		// This requires deterministic serialization.
+		b := proto.NewBuffer(nil)
+		err := b.Marshal(resp.Resources[i])
+		if err != nil {
+			return nil, err
+		}
+		name := cache.GetResourceName(resp.Resources[i])
+		resources[i] = &v2.Resource{
+			Name:    name,
+			Version: resp.ResourceVersions[name],
+			Resource: &any.Any{
+				TypeUrl: typeURL,
+				Value:   b.Bytes(),
+			},
+		}
+	}
+	out := &v2.DeltaDiscoveryResponse{
+		SystemVersionInfo: resp.SystemVersion,
+		Resources:         resources,
+		RemovedResources:  resp.RemovedResources,
+		TypeUrl:           typeURL,
+	}
+	return out, nil
+}
+
+// updateSubscriptions applies the subscription changes of a request to the
+// stream state, and reports whether anything changed.
+func updateSubscriptions(state *cache.StreamState, req *v2.DeltaDiscoveryRequest) bool {
+	changed := false
+	for _, name := range req.ResourceNamesSubscribe {
+		if !state.SubscribedResourceNames[name] {
+			state.SubscribedResourceNames[name] = true
+			changed = true
+		}
+	}
+	for _, name := range req.ResourceNamesUnsubscribe {
+		if state.SubscribedResourceNames[name] {
+			delete(state.SubscribedResourceNames, name)
+			changed = true
+		}
+		// the proxy forgets about resources it unsubscribed from
+		delete(state.ResourceVersions, name)
+	}
+	return changed
+}
+
+// processDelta handles a bi-di incremental stream request
+func (s *server) processDelta(stream deltaStream, reqCh <-chan *v2.DeltaDiscoveryRequest, defaultTypeURL string) error {
+	// increment stream count
+	streamID := atomic.AddInt64(&s.streamCount, 1)
+
+	// unique nonce generator for req-resp pairs per xDS stream; the server
+	// ignores stale nonces. nonce is only modified within send() function.
+	var streamNonce int64
+
+	deltaCallbacks, _ := s.callbacks.(DeltaCallbacks)
+
+	// a watch per requested type
+	watches := make(map[string]*deltaWatch)
+	defer func() {
+		for _, w := range watches {
+			w.Cancel()
+		}
+		if s.callbacks != nil {
+			s.callbacks.OnStreamClosed(streamID)
+		}
+	}()
+
+	// sends a response by serializing to protobuf Any
+	send := func(resp cache.DeltaResponse, typeURL string) (string, error) {
+		out, err := createDeltaResponse(&resp, typeURL)
+		if err != nil {
+			return "", err
+		}
+
+		// increment nonce
+		streamNonce = streamNonce + 1
+		out.Nonce = strconv.FormatInt(streamNonce, 10)
+		if deltaCallbacks != nil {
+			deltaCallbacks.OnStreamDeltaResponse(streamID, &resp.Request, out)
+		}
+		return out.Nonce, stream.Send(out)
+	}
+
+	if s.callbacks != nil {
+		if err := s.callbacks.OnStreamOpen(stream.Context(), streamID, defaultTypeURL); err != nil {
+			return err
+		}
+	}
+
+	// node may only be set on the first discovery request
+	var node = &core.Node{}
+
+	for {
+		// the set of open watches changes as requests come in, so we
+		// can't use a plain select
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(reqCh)}}
+		typeURLs := []string{""}
+		for typeURL, w := range watches {
+			if w.responses == nil {
+				continue
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.responses)})
+			typeURLs = append(typeURLs, typeURL)
+		}
+
+		chosen, value, more := reflect.Select(cases)
+
+		if chosen > 0 {
+			// config watcher can send the requested resources types in any order
+			typeURL := typeURLs[chosen]
+			w := watches[typeURL]
+			if !more {
+				return status.Errorf(codes.Unavailable, "%s watch failed", typeURL)
+			}
+			resp := value.Interface().(cache.DeltaResponse)
+			nonce, err := send(resp, typeURL)
+			if err != nil {
+				return err
+			}
+
+			// the watch is used up; the next one is created once the
+			// proxy ACKs or NACKs this response
+			w.responses, w.cancel = nil, nil
+			w.nonce = nonce
+
+			// the proxy now has what we just sent it; on NACK it keeps
+			// those versions around too, so we don't resend them until
+			// they change
+			for name, version := range resp.ResourceVersions {
+				w.state.ResourceVersions[name] = version
+			}
+			for _, name := range resp.RemovedResources {
+				delete(w.state.ResourceVersions, name)
+			}
+			w.state.First = false
+			continue
+		}
+
+		// input stream ended or errored out
+		if !more {
+			return nil
+		}
+		req := value.Interface().(*v2.DeltaDiscoveryRequest)
+		if req == nil {
+			return status.Errorf(codes.Unavailable, "empty request")
+		}
+
+		// node field in discovery request is delta-compressed
+		if req.Node != nil {
+			node = req.Node
+		} else {
+			req.Node = node
+		}
+
+		// type URL is required for ADS but is implicit for xDS
+		if defaultTypeURL == cache.AnyType {
+			if req.TypeUrl == "" {
+				return status.Errorf(codes.InvalidArgument, "type URL is required for ADS")
+			}
+		} else if req.TypeUrl == "" {
+			req.TypeUrl = defaultTypeURL
+		}
+
+		if deltaCallbacks != nil {
+			if err := deltaCallbacks.OnStreamDeltaRequest(streamID, req); err != nil {
+				return err
+			}
+		}
+
+		w, ok := watches[req.TypeUrl]
+		if !ok {
+			// a first request without names subscribes to everything
+			w = &deltaWatch{
+				state: cache.NewStreamState(len(req.ResourceNamesSubscribe) == 0, req.InitialResourceVersions),
+			}
+			watches[req.TypeUrl] = w
+		}
+		changed := updateSubscriptions(&w.state, req)
+
+		// ACKs and NACKs for anything but the last response are stale,
+		// but subscription changes still have to be acted upon
+		nonce := req.GetResponseNonce()
+		if nonce != "" && nonce != w.nonce && !changed {
+			continue
+		}
+
+		// cancel the existing watch to (re-)request a newer version
+		w.Cancel()
+		w.responses, w.cancel = s.cache.CreateDeltaWatch(*req, w.state.Clone())
+	}
+}
+
+// deltaHandler converts a blocking read call to channels and initiates stream processing
+func (s *server) deltaHandler(stream deltaStream, typeURL string) error {
+	// a channel for receiving incoming requests
+	reqCh := make(chan *v2.DeltaDiscoveryRequest)
+	reqStop := int32(0)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if atomic.LoadInt32(&reqStop) != 0 {
+				return
+			}
+			if err != nil {
+				close(reqCh)
+				return
+			}
+			reqCh <- req
+		}
+	}()
+
+	err := s.processDelta(stream, reqCh, typeURL)
+
+	// prevents writing to a closed channel if send failed on blocked recv
+	atomic.StoreInt32(&reqStop, 1)
+
+	return err
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package server_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	rpc "istio.io/gogo-genproto/googleapis/google/rpc"
+
+	v2 "github.com/datawire/ambassador/pkg/api/envoy/api/v2"
+	discovery "github.com/datawire/ambassador/pkg/api/envoy/service/discovery/v2"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/cache"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/server"
+	"github.com/datawire/ambassador/pkg/envoy-control-plane/test/resource"
+)
+
+type deltaCallbacks struct {
+	callbacks
+
+	mu    sync.Mutex
+	nacks []string
+}
+
+func (c *deltaCallbacks) OnStreamDeltaRequest(_ int64, req *v2.DeltaDiscoveryRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req.ErrorDetail != nil {
+		c.nacks = append(c.nacks, req.ErrorDetail.Message)
+	}
+	return nil
+}
+
+func (c *deltaCallbacks) OnStreamDeltaResponse(int64, *v2.DeltaDiscoveryRequest, *v2.DeltaDiscoveryResponse) {
+}
+
+// startDeltaServer runs an in-process gRPC server and returns an ADS client
+// connected to it.
+func startDeltaServer(t *testing.T, config cache.Cache, cb server.Callbacks) (discovery.AggregatedDiscoveryServiceClient, func()) {
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, server.NewServer(config, cb))
+	go func() {
+		_ = grpcServer.Serve(lis)
+	}()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return discovery.NewAggregatedDiscoveryServiceClient(conn), func() {
+		conn.Close()
+		grpcServer.Stop()
+	}
+}
+
+func recvDelta(t *testing.T, stream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesClient) *v2.DeltaDiscoveryResponse {
+	t.Helper()
+	ch := make(chan *v2.DeltaDiscoveryResponse, 1)
+	go func() {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- resp
+	}()
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			t.FailNow()
+		}
+		return resp
+	case <-time.After(time.Second):
+		t.Fatal("got no delta response")
+	}
+	return nil
+}
+
+func resourceNames(resp *v2.DeltaDiscoveryResponse) []string {
+	var names []string
+	for _, res := range resp.Resources {
+		names = append(names, res.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDeltaAggregatedResources(t *testing.T) {
+	config := cache.NewSnapshotCache(true, cache.IDHash{}, nil)
+	cb := &deltaCallbacks{}
+	client, stop := startDeltaServer(t, config, cb)
+	defer stop()
+
+	cluster1 := resource.MakeCluster(resource.Ads, "cluster1")
+	endpoint1 := resource.MakeEndpoint("cluster1", 8081)
+	if err := config.SetSnapshot(node.Id, cache.NewSnapshot("1",
+		[]cache.Resource{endpoint}, []cache.Resource{cluster}, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.DeltaAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a wildcard subscription gets everything
+	if err := stream.Send(&v2.DeltaDiscoveryRequest{Node: node, TypeUrl: cache.ClusterType}); err != nil {
+		t.Fatal(err)
+	}
+	resp := recvDelta(t, stream)
+	if want := []string{clusterName}; !reflect.DeepEqual(resourceNames(resp), want) {
+		t.Errorf("got resources %v, want %v", resourceNames(resp), want)
+	}
+	if resp.Resources[0].Version == "" {
+		t.Error("got no resource version")
+	}
+	if resp.SystemVersionInfo != "1" || resp.Nonce != "1" {
+		t.Errorf("got version %q nonce %q, want 1 and 1", resp.SystemVersionInfo, resp.Nonce)
+	}
+
+	// ACK, and change the clusters: only the difference is sent
+	if err := stream.Send(&v2.DeltaDiscoveryRequest{TypeUrl: cache.ClusterType, ResponseNonce: resp.Nonce}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SetSnapshot(node.Id, cache.NewSnapshot("2",
+		[]cache.Resource{endpoint1}, []cache.Resource{cluster1}, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	resp = recvDelta(t, stream)
+	if want := []string{"cluster1"}; !reflect.DeepEqual(resourceNames(resp), want) {
+		t.Errorf("got resources %v, want %v", resourceNames(resp), want)
+	}
+	if want := []string{clusterName}; !reflect.DeepEqual(resp.RemovedResources, want) {
+		t.Errorf("got removed resources %v, want %v", resp.RemovedResources, want)
+	}
+
+	// NACK: the rejected resources are not resent until they change
+	if err := stream.Send(&v2.DeltaDiscoveryRequest{
+		TypeUrl:       cache.ClusterType,
+		ResponseNonce: resp.Nonce,
+		ErrorDetail:   &rpc.Status{Message: "bad cluster"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// subscribe to endpoints by name: the cluster watch must stay quiet
+	if err := stream.Send(&v2.DeltaDiscoveryRequest{
+		TypeUrl:                cache.EndpointType,
+		ResourceNamesSubscribe: []string{"cluster1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp = recvDelta(t, stream)
+	if resp.TypeUrl != cache.EndpointType {
+		t.Fatalf("got response for %s, want %s", resp.TypeUrl, cache.EndpointType)
+	}
+	if want := []string{"cluster1"}; !reflect.DeepEqual(resourceNames(resp), want) {
+		t.Errorf("got resources %v, want %v", resourceNames(resp), want)
+	}
+
+	cb.mu.Lock()
+	if want := []string{"bad cluster"}; !reflect.DeepEqual(cb.nacks, want) {
+		t.Errorf("got NACKs %v, want %v", cb.nacks, want)
+	}
+	cb.mu.Unlock()
+}
+
+func TestDeltaStaleNonce(t *testing.T) {
+	config := cache.NewSnapshotCache(false, cache.IDHash{}, nil)
+	client, stop := startDeltaServer(t, config, &callbacks{})
+	defer stop()
+
+	if err := config.SetSnapshot(node.Id, cache.NewSnapshot("1", nil, []cache.Resource{cluster}, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.DeltaAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stream.Send(&v2.DeltaDiscoveryRequest{Node: node, TypeUrl: cache.ClusterType}); err != nil {
+		t.Fatal(err)
+	}
+	resp := recvDelta(t, stream)
+
+	// an ACK for a nonce we never sent does not open a new watch, so the
+	// next snapshot is only sent after the real ACK
+	if err := stream.Send(&v2.DeltaDiscoveryRequest{TypeUrl: cache.ClusterType, ResponseNonce: "42"}); err != nil {
+		t.Fatal(err)
+	}
+	cluster1 := resource.MakeCluster(resource.Ads, "cluster1")
+	if err := config.SetSnapshot(node.Id, cache.NewSnapshot("2", nil, []cache.Resource{cluster, cluster1}, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second / 4)
+	if got := config.GetStatusInfo(node.Id).GetNumDeltaWatches(); got != 0 {
+		t.Errorf("got %d delta watches after stale ACK, want 0", got)
+	}
+
+	if err := stream.Send(&v2.DeltaDiscoveryRequest{TypeUrl: cache.ClusterType, ResponseNonce: resp.Nonce}); err != nil {
+		t.Fatal(err)
+	}
+	resp = recvDelta(t, stream)
+	if want := []string{"cluster1"}; !reflect.DeepEqual(resourceNames(resp), want) {
+		t.Errorf("got resources %v, want %v", resourceNames(resp), want)
+	}
+}
@@ -425,26 +425,26 @@ func (s *server) FetchSecrets(ctx context.Context, req *v2.DiscoveryRequest) (*v
 	return s.Fetch(ctx, req)
 }
 
-func (s *server) DeltaAggregatedResources(_ discoverygrpc.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
-	return errors.New("not implemented")
+func (s *server) DeltaAggregatedResources(stream discoverygrpc.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return s.deltaHandler(stream, cache.AnyType)
 }
 
-func (s *server) DeltaEndpoints(_ v2grpc.EndpointDiscoveryService_DeltaEndpointsServer) error {
-	return errors.New("not implemented")
+func (s *server) DeltaEndpoints(stream v2grpc.EndpointDiscoveryService_DeltaEndpointsServer) error {
+	return s.deltaHandler(stream, cache.EndpointType)
 }
 
-func (s *server) DeltaClusters(_ v2grpc.ClusterDiscoveryService_DeltaClustersServer) error {
-	return errors.New("not implemented")
+func (s *server) DeltaClusters(stream v2grpc.ClusterDiscoveryService_DeltaClustersServer) error {
+	return s.deltaHandler(stream, cache.ClusterType)
 }
 
-func (s *server) DeltaRoutes(_ v2grpc.RouteDiscoveryService_DeltaRoutesServer) error {
-	return errors.New("not implemented")
+func (s *server) DeltaRoutes(stream v2grpc.RouteDiscoveryService_DeltaRoutesServer) error {
+	return s.deltaHandler(stream, cache.RouteType)
 }
 
-func (s *server) DeltaListeners(_ v2grpc.ListenerDiscoveryService_DeltaListenersServer) error {
-	return errors.New("not implemented")
+func (s *server) DeltaListeners(stream v2grpc.ListenerDiscoveryService_DeltaListenersServer) error {
+	return s.deltaHandler(stream, cache.ListenerType)
 }
 
-func (s *server) DeltaSecrets(_ discoverygrpc.SecretDiscoveryService_DeltaSecretsServer) error {
-	return errors.New("not implemented")
+func (s *server) DeltaSecrets(stream discoverygrpc.SecretDiscoveryService_DeltaSecretsServer) error {
+	return s.deltaHandler(stream, cache.SecretType)
 }
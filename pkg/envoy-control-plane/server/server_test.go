@@ -49,6 +49,10 @@ func (config *mockConfigWatcher) CreateWatch(req v2.DiscoveryRequest) (chan cach
 	return out, func() {}
 }
 
+func (config *mockConfigWatcher) CreateDeltaWatch(req v2.DeltaDiscoveryRequest, state cache.StreamState) (chan cache.DeltaResponse, func()) {
+	return make(chan cache.DeltaResponse, 1), func() {}
+}
+
 func (config *mockConfigWatcher) Fetch(ctx context.Context, req v2.DiscoveryRequest) (*cache.Response, error) {
 	if len(config.responses[req.TypeUrl]) > 0 {
 		out := config.responses[req.TypeUrl][0]
@@ -4,6 +4,8 @@ import (
 	"strconv"
 	"testing"
 
+	corev1 "k8s.io/api/core/v1"
+
 	"github.com/datawire/ambassador/pkg/k8s"
 )
 
@@ -41,3 +43,47 @@ func TestQKind(t *testing.T) {
 		}(testcase))
 	}
 }
+
+func TestDecode(t *testing.T) {
+	resources := []k8s.Resource{
+		{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]interface{}{"name": "foo", "namespace": "default"},
+			"spec": map[string]interface{}{
+				"ports": []interface{}{map[string]interface{}{"port": int64(80)}},
+			},
+		},
+	}
+
+	var services []corev1.Service
+	if err := k8s.Decode(resources, &services); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Name != "foo" || services[0].Spec.Ports[0].Port != 80 {
+		t.Errorf("fail: decoded %#v", services)
+	}
+
+	// a struct of our own
+	var ports []*struct {
+		Spec struct {
+			Ports []struct {
+				Port int
+			}
+		}
+	}
+	if err := k8s.Decode(resources, &ports); err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 1 || ports[0].Spec.Ports[0].Port != 80 {
+		t.Errorf("fail: decoded %#v", ports)
+	}
+
+	if err := k8s.Decode(resources, services); err == nil {
+		t.Error("fail: decoded into a slice rather than a pointer to one")
+	}
+	var names []string
+	if err := k8s.Decode(resources, &names); err == nil {
+		t.Error("fail: decoded into strings")
+	}
+}
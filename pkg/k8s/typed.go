@@ -0,0 +1,193 @@
+package k8s
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EventHandler gets the resources of a watch that are added, updated and
+// deleted, one at a time, where a listener only hears that something
+// changed. Any of the funcs may be nil. The resources that are there when
+// the watcher starts are added. Like List, the resources belong to the
+// watcher and mustn't be modified.
+type EventHandler struct {
+	OnAdd    func(w *Watcher, r Resource)
+	OnUpdate func(w *Watcher, old, new Resource)
+	OnDelete func(w *Watcher, r Resource)
+}
+
+// the indexes of every watch
+const (
+	labelIndex = "label"
+	ownerIndex = "owner"
+)
+
+var indexers = cache.Indexers{
+	labelIndex: labelIndexFunc,
+	ownerIndex: ownerIndexFunc,
+}
+
+// labelIndexFunc indexes resources by their labels, as key=value.
+func labelIndexFunc(obj interface{}) ([]string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	labels := accessor.GetLabels()
+	result := make([]string, 0, len(labels))
+	for key, value := range labels {
+		result = append(result, key+"="+value)
+	}
+	return result, nil
+}
+
+// ownerIndexFunc indexes resources by the UIDs of their owners.
+func ownerIndexFunc(obj interface{}) ([]string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	refs := accessor.GetOwnerReferences()
+	result := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		result = append(result, string(ref.UID))
+	}
+	return result, nil
+}
+
+// resourceOf returns the resource of an object in a store, or of a
+// tombstone left by a delete we missed.
+func resourceOf(obj interface{}) Resource {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if uns, ok := obj.(*unstructured.Unstructured); ok {
+		return uns.UnstructuredContent()
+	}
+	return nil
+}
+
+func resourcesOf(objs []interface{}) []Resource {
+	result := make([]Resource, len(objs))
+	for idx, obj := range objs {
+		result[idx] = resourceOf(obj)
+	}
+	return result
+}
+
+// sliceOf checks that `into` points to a slice of structs, or of pointers
+// to structs, and returns the slice and the struct type.
+func sliceOf(into interface{}) (reflect.Value, reflect.Type, error) {
+	ptr := reflect.ValueOf(into)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() || ptr.Elem().Kind() != reflect.Slice {
+		return reflect.Value{}, nil, fmt.Errorf("expected a pointer to a slice, got %T", into)
+	}
+	slice := ptr.Elem()
+	elem := slice.Type().Elem()
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		return reflect.Value{}, nil, fmt.Errorf("expected a slice of structs, got %T", into)
+	}
+	return slice, elem, nil
+}
+
+// Decode decodes resources into `into`, which points to a slice of
+// client-go types, such as a []corev1.Service or a []*corev1.Service, or
+// of any structs with json tags.
+func Decode(resources []Resource, into interface{}) error {
+	return decode(nil, resources, into)
+}
+
+// decode decodes resources, with the decoded resources cached in `typed`,
+// if it isn't nil.
+func decode(typed *typedCache, resources []Resource, into interface{}) error {
+	slice, elem, err := sliceOf(into)
+	if err != nil {
+		return err
+	}
+	pointers := slice.Type().Elem().Kind() == reflect.Ptr
+
+	result := reflect.MakeSlice(slice.Type(), 0, len(resources))
+	for _, resource := range resources {
+		value, ok := typed.get(elem, resource)
+		if !ok {
+			value = reflect.New(elem)
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(resource, value.Interface()); err != nil {
+				return fmt.Errorf("%s: %v", resource.QName(), err)
+			}
+			typed.put(elem, resource, value)
+		}
+		if pointers {
+			result = reflect.Append(result, value)
+		} else {
+			result = reflect.Append(result, value.Elem())
+		}
+	}
+	slice.Set(result)
+	return nil
+}
+
+// typedCache keeps the resources of a watch decoded, by type, until they
+// change. The zero value is ready to use, and nil doesn't cache.
+type typedCache struct {
+	mux     sync.Mutex
+	entries map[reflect.Type]map[string]typedEntry
+}
+
+type typedEntry struct {
+	version string
+	// a pointer to the decoded resource
+	value reflect.Value
+}
+
+func typedKey(resource Resource) string {
+	return resource.Namespace() + "/" + resource.Name()
+}
+
+func (c *typedCache) get(t reflect.Type, resource Resource) (reflect.Value, bool) {
+	version := resource.ResourceVersion()
+	if c == nil || version == "" {
+		return reflect.Value{}, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, ok := c.entries[t][typedKey(resource)]
+	if !ok || entry.version != version {
+		return reflect.Value{}, false
+	}
+	return entry.value, true
+}
+
+func (c *typedCache) put(t reflect.Type, resource Resource, value reflect.Value) {
+	version := resource.ResourceVersion()
+	if c == nil || version == "" {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[reflect.Type]map[string]typedEntry)
+	}
+	if c.entries[t] == nil {
+		c.entries[t] = make(map[string]typedEntry)
+	}
+	c.entries[t][typedKey(resource)] = typedEntry{version: version, value: value}
+}
+
+// forget drops a resource that's been deleted.
+func (c *typedCache) forget(resource Resource) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	key := typedKey(resource)
+	for _, entries := range c.entries {
+		delete(entries, key)
+	}
+}
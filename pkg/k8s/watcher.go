@@ -40,7 +40,7 @@ func (lw listWatchAdapter) Watch(options v1.ListOptions) (pwatch.Interface, erro
 // Watcher is a kubernetes watcher that can watch multiple queries simultaneously
 type Watcher struct {
 	Client  *Client
-	watches map[ResourceType]watch
+	watches map[ResourceType]*watch
 	stop    chan struct{}
 	wg      sync.WaitGroup
 	mutex   sync.Mutex
@@ -52,9 +52,37 @@ type Watcher struct {
 type watch struct {
 	query    Query
 	resource dynamic.NamespaceableResourceInterface
-	store    cache.Store
-	invoke   func()
+	store    cache.Indexer
+	// invoke calls the event, if any, and then the listener
+	invoke   func(event func())
 	runner   func()
+	handlers []EventHandler
+	typed    *typedCache
+}
+
+func (wt *watch) added(w *Watcher, r Resource) {
+	for _, h := range wt.handlers {
+		if h.OnAdd != nil {
+			h.OnAdd(w, r)
+		}
+	}
+}
+
+func (wt *watch) updated(w *Watcher, old, new Resource) {
+	for _, h := range wt.handlers {
+		if h.OnUpdate != nil {
+			h.OnUpdate(w, old, new)
+		}
+	}
+}
+
+func (wt *watch) deleted(w *Watcher, r Resource) {
+	wt.typed.forget(r)
+	for _, h := range wt.handlers {
+		if h.OnDelete != nil {
+			h.OnDelete(w, r)
+		}
+	}
 }
 
 // MustNewWatcher returns a Kubernetes watcher for the specified
@@ -80,7 +108,7 @@ func NewWatcher(info *KubeInfo) (*Watcher, error) {
 func (c *Client) Watcher() *Watcher {
 	w := &Watcher{
 		Client:  c,
-		watches: make(map[ResourceType]watch),
+		watches: make(map[ResourceType]*watch),
 		stop:    make(chan struct{}),
 	}
 
@@ -106,7 +134,8 @@ func (w *Watcher) SelectiveWatch(namespace, resources, fieldSelector, labelSelec
 }
 
 // WatchQuery watches the set of resources identified by the supplied
-// query and invokes the supplied listener whenever they change.
+// query and invokes the supplied listener whenever they change. The
+// listener may be nil for watches that only have event handlers.
 func (w *Watcher) WatchQuery(query Query, listener func(*Watcher)) error {
 	err := query.resolve(w.Client)
 	if err != nil {
@@ -132,19 +161,30 @@ func (w *Watcher) WatchQuery(query Query, listener func(*Watcher)) error {
 		watched = resource
 	}
 
-	invoke := func() {
+	wt := &watch{
+		query:    query,
+		resource: resource,
+		typed:    &typedCache{},
+	}
+
+	invoke := func(event func()) {
 		w.mutex.Lock()
 		defer w.mutex.Unlock()
-		listener(w)
+		if event != nil {
+			event()
+		}
+		if listener != nil {
+			listener(w)
+		}
 	}
 
-	store, controller := cache.NewInformer(
+	store, controller := cache.NewIndexerInformer(
 		listWatchAdapter{watched, query.FieldSelector, query.LabelSelector},
 		nil,
 		5*time.Minute,
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				invoke()
+				invoke(func() { wt.added(w, resourceOf(obj)) })
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
 				oldUn := oldObj.(*unstructured.Unstructured)
@@ -166,13 +206,14 @@ func (w *Watcher) WatchQuery(query Query, listener func(*Watcher)) error {
 						newUn.GetNamespace() == "kube-system" {
 						return
 					}
-					invoke()
+					invoke(func() { wt.updated(w, oldUn.UnstructuredContent(), newUn.UnstructuredContent()) })
 				}
 			},
 			DeleteFunc: func(obj interface{}) {
-				invoke()
+				invoke(func() { wt.deleted(w, resourceOf(obj)) })
 			},
 		},
+		indexers,
 	)
 
 	runner := func() {
@@ -180,13 +221,10 @@ func (w *Watcher) WatchQuery(query Query, listener func(*Watcher)) error {
 		w.wg.Done()
 	}
 
-	w.watches[ri] = watch{
-		query:    query,
-		resource: resource,
-		store:    store,
-		invoke:   invoke,
-		runner:   runner,
-	}
+	wt.store = store
+	wt.invoke = invoke
+	wt.runner = runner
+	w.watches[ri] = wt
 
 	return nil
 }
@@ -206,7 +244,12 @@ func (w *Watcher) Start() {
 	}
 
 	for _, watch := range w.watches {
-		watch.invoke()
+		watch := watch
+		watch.invoke(func() {
+			for _, obj := range watch.store.List() {
+				watch.added(w, resourceOf(obj))
+			}
+		})
 	}
 
 	w.wg.Add(len(w.watches))
@@ -239,17 +282,85 @@ func (w *Watcher) List(kind string) []Resource {
 	}
 	watch, ok := w.watches[ri]
 	if ok {
-		objs := watch.store.List()
-		result := make([]Resource, len(objs))
-		for idx, obj := range objs {
-			result[idx] = obj.(*unstructured.Unstructured).UnstructuredContent()
-		}
-		return result
+		return resourcesOf(watch.store.List())
 	} else {
 		return nil
 	}
 }
 
+// ListInto decodes the resources with kind `kind` into `into`, as Decode
+// does. Decoded resources are kept until they change, so they are shared
+// with other callers and mustn't be modified.
+func (w *Watcher) ListInto(kind string, into interface{}) error {
+	return w.DecodeInto(kind, w.List(kind), into)
+}
+
+// DecodeInto decodes resources with kind `kind`, e.g. from ByLabel, into
+// `into`, as ListInto does.
+func (w *Watcher) DecodeInto(kind string, resources []Resource, into interface{}) error {
+	watch, err := w.watchOf(kind)
+	if err != nil {
+		return err
+	}
+	return decode(watch.typed, resources, into)
+}
+
+// ByLabel lists the resources with kind `kind` that have the label `key`
+// set to `value`.
+func (w *Watcher) ByLabel(kind, key, value string) []Resource {
+	return w.byIndex(kind, labelIndex, key+"="+value)
+}
+
+// ByOwner lists the resources with kind `kind` that are owned by the
+// resource with the UID `ownerUID`.
+func (w *Watcher) ByOwner(kind, ownerUID string) []Resource {
+	return w.byIndex(kind, ownerIndex, ownerUID)
+}
+
+func (w *Watcher) byIndex(kind, index, value string) []Resource {
+	ri, err := w.Client.ResolveResourceType(kind)
+	if err != nil {
+		panic(err)
+	}
+	watch, ok := w.watches[ri]
+	if !ok {
+		return nil
+	}
+	objs, err := watch.store.ByIndex(index, value)
+	if err != nil {
+		panic(err)
+	}
+	return resourcesOf(objs)
+}
+
+// Handle adds a handler for the resources with kind `kind`, which must be
+// watched already. Handlers are added before the watcher starts.
+func (w *Watcher) Handle(kind string, handler EventHandler) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.started {
+		return fmt.Errorf("can't add a handler for %s, the watcher has started", kind)
+	}
+	watch, err := w.watchOf(kind)
+	if err != nil {
+		return err
+	}
+	watch.handlers = append(watch.handlers, handler)
+	return nil
+}
+
+func (w *Watcher) watchOf(kind string) (*watch, error) {
+	ri, err := w.Client.ResolveResourceType(kind)
+	if err != nil {
+		return nil, err
+	}
+	watch, ok := w.watches[ri]
+	if !ok {
+		return nil, fmt.Errorf("not watching %s", kind)
+	}
+	return watch, nil
+}
+
 // UpdateStatus updates the status of the `resource` provided
 func (w *Watcher) UpdateStatus(resource Resource) (Resource, error) {
 	ri, err := w.Client.ResolveResourceType(resource.QKind())
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 
 	"github.com/datawire/ambassador/pkg/dtest"
 	"github.com/datawire/ambassador/pkg/k8s"
@@ -118,3 +119,65 @@ func TestWatchQuery(t *testing.T) {
 	w.Wait()
 	require.Equal(t, services, []string{"kubernetes.default"})
 }
+
+func TestListInto(t *testing.T) {
+	w := k8s.MustNewWatcher(info())
+	svc := fetch(w, "services", "kubernetes.default")
+	require.NotNil(t, svc)
+
+	var services []*corev1.Service
+	require.NoError(t, w.ListInto("services", &services))
+	var kubernetes *corev1.Service
+	for _, s := range services {
+		if s.Name == "kubernetes" && s.Namespace == "default" {
+			kubernetes = s
+		}
+	}
+	require.NotNil(t, kubernetes)
+	require.NotEmpty(t, kubernetes.Spec.Ports)
+
+	// unchanged resources are only decoded once
+	var again []*corev1.Service
+	require.NoError(t, w.DecodeInto("services", []k8s.Resource{svc}, &again))
+	require.True(t, kubernetes == again[0])
+
+	require.Error(t, w.ListInto("customs", &services))
+}
+
+func TestByLabel(t *testing.T) {
+	w := k8s.MustNewWatcher(info())
+	require.NotNil(t, fetch(w, "services", "kubernetes.default"))
+
+	found := false
+	for _, r := range w.ByLabel("services", "component", "apiserver") {
+		if r.QName() == "kubernetes.default" {
+			found = true
+		}
+	}
+	require.True(t, found)
+	require.Empty(t, w.ByLabel("services", "component", "nonesuch"))
+	require.Empty(t, w.ByOwner("services", "nonesuch"))
+}
+
+func TestHandle(t *testing.T) {
+	w := k8s.MustNewWatcher(info())
+
+	added := []string{}
+	require.NoError(t, w.WatchQuery(k8s.Query{
+		Kind:          "services",
+		FieldSelector: "metadata.name=kubernetes",
+	}, nil))
+	require.NoError(t, w.Handle("services", k8s.EventHandler{
+		OnAdd: func(w *k8s.Watcher, r k8s.Resource) {
+			added = append(added, r.QName())
+		},
+	}))
+	require.Error(t, w.Handle("customs", k8s.EventHandler{}))
+
+	time.AfterFunc(1*time.Second, func() {
+		w.Stop()
+	})
+	w.Wait()
+	require.Equal(t, []string{"kubernetes.default"}, added)
+	require.Error(t, w.Handle("services", k8s.EventHandler{}))
+}
@@ -1,6 +1,11 @@
 package limiter
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
 
 // A limiter can be used to rate limit and/or coalesce a series of
 // time-based events. This interface captures the logic of deciding
@@ -102,6 +107,182 @@ func (c *composite) Limit(now time.Time) time.Duration {
 	}
 }
 
+type quiet struct {
+	// how long things need to stay quiet before we fire
+	period time.Duration
+	// the longest we delay the first event of a burst
+	max time.Duration
+	// records the first event of the current burst
+	start time.Time
+	// records the point in the future to which we delayed the
+	// current burst
+	deadline time.Time
+}
+
+// Constructs a new limiter that coalesces a burst of events into a
+// single one, fired once no event has occurred for the specified
+// quiet period, or once the first event of the burst has been delayed
+// by max if max is positive.
+//
+// Unlike the other limiters, events are delayed until the end of the
+// burst, which moves with every event: each positive result
+// supersedes any earlier delay that has not elapsed yet. Callers must
+// replace a pending check rather than add another one, e.g. by
+// resetting a single time.Timer.
+func NewQuiet(period, max time.Duration) Limiter {
+	return &quiet{
+		period: period,
+		max:    max,
+	}
+}
+
+func (q *quiet) Limit(now time.Time) time.Duration {
+	if !now.Before(q.deadline) {
+		// the last burst is over, this event starts a new one
+		q.start = now
+	}
+
+	q.deadline = now.Add(q.period)
+	if q.max > 0 {
+		if limit := q.start.Add(q.max); q.deadline.After(limit) {
+			q.deadline = limit
+		}
+	}
+
+	return q.deadline.Sub(now)
+}
+
+type maxStaleness struct {
+	limiter Limiter
+	// the longest we hold back an event
+	max time.Duration
+	// records the first event we haven't acted upon yet
+	first time.Time
+	// records the point in the future to which we delayed it
+	deadline time.Time
+	// records the point in the future to which the wrapped limiter
+	// delayed an event, which may be later than we did
+	innerDeadline time.Time
+}
+
+// Constructs a new limiter that does what the given limiter says, but
+// never delays an event by more than max, so that events that are
+// limited hard still get acted upon eventually. Like the quiet limiter,
+// a positive result supersedes any earlier delay.
+func NewMaxStaleness(l Limiter, max time.Duration) Limiter {
+	return &maxStaleness{
+		limiter: l,
+		max:     max,
+	}
+}
+
+func (s *maxStaleness) Limit(now time.Time) time.Duration {
+	if !now.Before(s.deadline) {
+		// we acted upon everything before this event
+		s.first = now
+	}
+
+	delay := s.limiter.Limit(now)
+	if delay < 0 {
+		if now.Before(s.deadline) {
+			// we already have an event pending
+			return delay
+		}
+		// The wrapped limiter has an event pending, but we cut
+		// its delay short and have acted already, so nothing is
+		// left to act upon this event unless we check back when
+		// the wrapped limiter would have.
+		delay = s.max
+		if s.innerDeadline.After(now) {
+			delay = s.innerDeadline.Sub(now)
+		}
+	} else if delay > 0 {
+		s.innerDeadline = now.Add(delay)
+	}
+
+	if limit := s.first.Add(s.max); now.Add(delay).After(limit) {
+		delay = limit.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+	}
+	s.deadline = now.Add(delay)
+	return delay
+}
+
+// A Policy makes limiters, so that everything that is limited
+// separately gets a limiter of its own.
+type Policy func() Limiter
+
+// ParsePolicy parses a policy: "0" (or "none") doesn't limit at all, a
+// duration like "2s" acts at most once per that interval, and
+// "quiet:DURATION" waits for that long a pause in the events.
+func ParsePolicy(s string) (Policy, error) {
+	if s == "none" {
+		s = "0"
+	}
+
+	quiet := strings.HasPrefix(s, "quiet:")
+	d, err := time.ParseDuration(strings.TrimPrefix(s, "quiet:"))
+	if err != nil {
+		return nil, fmt.Errorf("bad limiter policy %q: %v", s, err)
+	}
+	if d < 0 {
+		return nil, fmt.Errorf("bad limiter policy %q: negative duration", s)
+	}
+
+	switch {
+	case d == 0:
+		return NewUnlimited, nil
+	case quiet:
+		return func() Limiter { return NewQuiet(d, 0) }, nil
+	default:
+		return func() Limiter { return NewInterval(d) }, nil
+	}
+}
+
+// Keyed keeps a limiter for each of a set of keys, like the sources and
+// kinds of changes, so that what happens to one key doesn't hold back
+// the others. Keys look like "source" or "source/kind".
+type Keyed struct {
+	mux      sync.Mutex
+	policies map[string]Policy
+	fallback Policy
+	limiters map[string]Limiter
+}
+
+// Constructs a new set of limiters. The limiter of a key is made by the
+// policy for that key if there is one, otherwise by the policy for its
+// source, otherwise by the fallback.
+func NewKeyed(policies map[string]Policy, fallback Policy) *Keyed {
+	return &Keyed{
+		policies: policies,
+		fallback: fallback,
+		limiters: make(map[string]Limiter),
+	}
+}
+
+// For returns the limiter of a key.
+func (k *Keyed) For(key string) Limiter {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	if l, ok := k.limiters[key]; ok {
+		return l
+	}
+
+	policy, ok := k.policies[key]
+	if !ok {
+		policy, ok = k.policies[strings.SplitN(key, "/", 2)[0]]
+	}
+	if !ok {
+		policy = k.fallback
+	}
+	l := policy()
+	k.limiters[key] = l
+	return l
+}
+
 type unlimited struct{}
 
 func NewUnlimited() Limiter {
@@ -34,3 +34,123 @@ func TestIntervalLimiter(fool *testing.T) {
 	t.expect(-1, l.Limit(start.Add(2999*time.Millisecond)))
 	t.expect(0, l.Limit(start.Add(3000*time.Millisecond)))
 }
+
+func TestQuietLimiter(fool *testing.T) {
+	t := pity(fool)
+	l := NewQuiet(1*time.Second, 3*time.Second)
+	start := time.Now()
+	t.expect(1000*time.Millisecond, l.Limit(start))
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(500*time.Millisecond)))
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(1000*time.Millisecond)))
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(1999*time.Millisecond)))
+	t.expect(500*time.Millisecond, l.Limit(start.Add(2500*time.Millisecond)))
+	t.expect(1*time.Millisecond, l.Limit(start.Add(2999*time.Millisecond)))
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(3000*time.Millisecond)))
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(3500*time.Millisecond)))
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(5000*time.Millisecond)))
+
+	l = NewQuiet(1*time.Second, 0)
+	t.expect(1000*time.Millisecond, l.Limit(start))
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(10*time.Second)))
+}
+
+func TestMaxStalenessLimiter(fool *testing.T) {
+	t := pity(fool)
+	l := NewMaxStaleness(NewQuiet(1*time.Second, 0), 2500*time.Millisecond)
+	start := time.Now()
+	t.expect(1000*time.Millisecond, l.Limit(start))
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(900*time.Millisecond)))
+	// the burst keeps going, but the first event can't wait any longer
+	t.expect(700*time.Millisecond, l.Limit(start.Add(1800*time.Millisecond)))
+	t.expect(100*time.Millisecond, l.Limit(start.Add(2400*time.Millisecond)))
+	// we acted at 2500ms, so this starts over
+	t.expect(1000*time.Millisecond, l.Limit(start.Add(2600*time.Millisecond)))
+
+	// the interval limiter never delays by more than its interval
+	l = NewMaxStaleness(NewInterval(1*time.Second), 500*time.Millisecond)
+	t.expect(0, l.Limit(start))
+	t.expect(500*time.Millisecond, l.Limit(start.Add(1*time.Millisecond)))
+	t.expect(-1, l.Limit(start.Add(200*time.Millisecond)))
+	// we acted at 501ms, but the interval limiter is still waiting for
+	// 1000ms, so this has to be acted upon then
+	t.expect(400*time.Millisecond, l.Limit(start.Add(600*time.Millisecond)))
+	t.expect(-1, l.Limit(start.Add(700*time.Millisecond)))
+}
+
+func TestMaxStalenessShorterThanInterval(fool *testing.T) {
+	t := pity(fool)
+	// --interval 1s --max-staleness 500ms
+	l := NewMaxStaleness(NewInterval(1*time.Second), 500*time.Millisecond)
+	start := time.Now()
+	t.expect(0, l.Limit(start))
+	t.expect(500*time.Millisecond, l.Limit(start.Add(100*time.Millisecond)))
+	// the timer fires at 600ms, and we act
+	// a change right after that still gets acted upon, no later than
+	// when the interval limiter would have
+	t.expect(350*time.Millisecond, l.Limit(start.Add(650*time.Millisecond)))
+	t.expect(-1, l.Limit(start.Add(800*time.Millisecond)))
+	// the timer fires at 1000ms, and we act
+	// a change after the interval limiter's deadline starts over
+	t.expect(0, l.Limit(start.Add(1100*time.Millisecond)))
+}
+
+func TestParsePolicy(fool *testing.T) {
+	t := pity(fool)
+	start := time.Now()
+
+	for _, s := range []string{"0", "none", "0s"} {
+		p, err := ParsePolicy(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.expect(0, p().Limit(start))
+		t.expect(0, p().Limit(start.Add(1*time.Millisecond)))
+	}
+
+	p, err := ParsePolicy("2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := p()
+	t.expect(0, l.Limit(start))
+	t.expect(1999*time.Millisecond, l.Limit(start.Add(1*time.Millisecond)))
+	// every limiter is a new one
+	t.expect(0, p().Limit(start.Add(1*time.Millisecond)))
+
+	p, err = ParsePolicy("quiet:500ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.expect(500*time.Millisecond, p().Limit(start))
+
+	for _, s := range []string{"", "fast", "quiet:", "-1s"} {
+		if _, err := ParsePolicy(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestKeyedLimiter(fool *testing.T) {
+	t := pity(fool)
+	k := NewKeyed(map[string]Policy{
+		"kubernetes/endpoints": func() Limiter { return NewInterval(2 * time.Second) },
+		"consul":               func() Limiter { return NewInterval(1 * time.Second) },
+	}, NewUnlimited)
+	start := time.Now()
+
+	endpoints := k.For("kubernetes/endpoints")
+	t.expect(0, endpoints.Limit(start))
+	t.expect(1999*time.Millisecond, endpoints.Limit(start.Add(1*time.Millisecond)))
+	if k.For("kubernetes/endpoints") != endpoints {
+		t.Errorf("expected the same limiter for the same key")
+	}
+
+	// a busy key doesn't hold back the others
+	t.expect(0, k.For("kubernetes/mapping").Limit(start.Add(2*time.Millisecond)))
+	t.expect(0, k.For("kubernetes/mapping").Limit(start.Add(3*time.Millisecond)))
+
+	// kinds fall back to the policy of their source
+	t.expect(0, k.For("consul/foo").Limit(start))
+	t.expect(999*time.Millisecond, k.For("consul/foo").Limit(start.Add(1*time.Millisecond)))
+	t.expect(0, k.For("consul/bar").Limit(start.Add(1*time.Millisecond)))
+}
@@ -0,0 +1,216 @@
+package watt
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/datawire/ambassador/pkg/consulwatch"
+
+	"github.com/datawire/ambassador/pkg/k8s"
+)
+
+// KubernetesDelta holds the Kubernetes resources (or the resources read from
+// files) that changed between two snapshots, keyed by kind like
+// Snapshot.Kubernetes. Deleted resources are given as they were in the
+// earlier snapshot.
+type KubernetesDelta struct {
+	Added    map[string][]k8s.Resource `json:",omitempty"`
+	Modified map[string][]k8s.Resource `json:",omitempty"`
+	Deleted  map[string][]k8s.Resource `json:",omitempty"`
+}
+
+// ConsulDelta holds the Consul endpoints that changed between two snapshots,
+// keyed by service name. Deleted holds the names of the services that went
+// away.
+type ConsulDelta struct {
+	Added    map[string]consulwatch.Endpoints `json:",omitempty"`
+	Modified map[string]consulwatch.Endpoints `json:",omitempty"`
+	Deleted  []string                         `json:",omitempty"`
+	Connect  *ConnectDelta                    `json:",omitempty"`
+}
+
+// ConnectDelta holds the Consul Connect certificates that changed between two
+// snapshots, keyed like ConsulSnapshot.Connect.
+type ConnectDelta struct {
+	Added    map[string]ConnectCerts `json:",omitempty"`
+	Modified map[string]ConnectCerts `json:",omitempty"`
+	Deleted  []string                `json:",omitempty"`
+}
+
+// DNSDelta holds the DNS records that changed between two snapshots, keyed by
+// the name looked up. Deleted holds the names that are no longer looked up.
+type DNSDelta struct {
+	Added    map[string]DNSRecords `json:",omitempty"`
+	Modified map[string]DNSRecords `json:",omitempty"`
+	Deleted  []string              `json:",omitempty"`
+}
+
+// SnapshotDelta is the difference between two snapshots. The parts that
+// didn't change are nil, so that they're left out. Errors aren't diffed,
+// they are the errors of the later snapshot.
+type SnapshotDelta struct {
+	Since      int
+	Id         int
+	Consul     *ConsulDelta       `json:",omitempty"`
+	Kubernetes *KubernetesDelta   `json:",omitempty"`
+	Files      *KubernetesDelta   `json:",omitempty"`
+	DNS        *DNSDelta          `json:",omitempty"`
+	Errors     map[string][]Error `json:",omitempty"`
+}
+
+func (d *KubernetesDelta) empty() bool {
+	return len(d.Added) == 0 && len(d.Modified) == 0 && len(d.Deleted) == 0
+}
+
+func (d *ConsulDelta) empty() bool {
+	return len(d.Added) == 0 && len(d.Modified) == 0 && len(d.Deleted) == 0 && d.Connect == nil
+}
+
+func (d *ConnectDelta) empty() bool {
+	return len(d.Added) == 0 && len(d.Modified) == 0 && len(d.Deleted) == 0
+}
+
+func (d *DNSDelta) empty() bool {
+	return len(d.Added) == 0 && len(d.Modified) == 0 && len(d.Deleted) == 0
+}
+
+// resourceKey identifies a resource within a kind.
+func resourceKey(r k8s.Resource) string {
+	return r.QKind() + "/" + r.QName()
+}
+
+func appendResource(m *map[string][]k8s.Resource, kind string, r k8s.Resource) {
+	if *m == nil {
+		*m = make(map[string][]k8s.Resource)
+	}
+	(*m)[kind] = append((*m)[kind], r)
+}
+
+// Diff returns the changes that turn snapshot from into snapshot to. Both
+// snapshots should have been decoded the same way, since resources are
+// compared with reflect.DeepEqual.
+func Diff(from, to Snapshot) SnapshotDelta {
+	var delta SnapshotDelta
+	var consul ConsulDelta
+	var connect ConnectDelta
+	var dns DNSDelta
+
+	delta.Kubernetes = diffResources(from.Kubernetes, to.Kubernetes)
+	delta.Files = diffResources(from.Files, to.Files)
+
+	for service, endpoints := range to.Consul.Endpoints {
+		prev, ok := from.Consul.Endpoints[service]
+		switch {
+		case !ok:
+			if consul.Added == nil {
+				consul.Added = make(map[string]consulwatch.Endpoints)
+			}
+			consul.Added[service] = endpoints
+		case !reflect.DeepEqual(prev, endpoints):
+			if consul.Modified == nil {
+				consul.Modified = make(map[string]consulwatch.Endpoints)
+			}
+			consul.Modified[service] = endpoints
+		}
+	}
+	for service := range from.Consul.Endpoints {
+		if _, ok := to.Consul.Endpoints[service]; !ok {
+			consul.Deleted = append(consul.Deleted, service)
+		}
+	}
+	sort.Strings(consul.Deleted)
+
+	for id, certs := range to.Consul.Connect {
+		prev, ok := from.Consul.Connect[id]
+		switch {
+		case !ok:
+			if connect.Added == nil {
+				connect.Added = make(map[string]ConnectCerts)
+			}
+			connect.Added[id] = certs
+		case !reflect.DeepEqual(prev, certs):
+			if connect.Modified == nil {
+				connect.Modified = make(map[string]ConnectCerts)
+			}
+			connect.Modified[id] = certs
+		}
+	}
+	for id := range from.Consul.Connect {
+		if _, ok := to.Consul.Connect[id]; !ok {
+			connect.Deleted = append(connect.Deleted, id)
+		}
+	}
+	sort.Strings(connect.Deleted)
+
+	for name, records := range to.DNS {
+		prev, ok := from.DNS[name]
+		switch {
+		case !ok:
+			if dns.Added == nil {
+				dns.Added = make(map[string]DNSRecords)
+			}
+			dns.Added[name] = records
+		case !reflect.DeepEqual(prev, records):
+			if dns.Modified == nil {
+				dns.Modified = make(map[string]DNSRecords)
+			}
+			dns.Modified[name] = records
+		}
+	}
+	for name := range from.DNS {
+		if _, ok := to.DNS[name]; !ok {
+			dns.Deleted = append(dns.Deleted, name)
+		}
+	}
+	sort.Strings(dns.Deleted)
+
+	if !connect.empty() {
+		consul.Connect = &connect
+	}
+	if !consul.empty() {
+		delta.Consul = &consul
+	}
+	if !dns.empty() {
+		delta.DNS = &dns
+	}
+	delta.Errors = to.Errors
+	return delta
+}
+
+// diffResources diffs two sets of resources keyed by kind, and returns nil
+// if nothing changed.
+func diffResources(from, to map[string][]k8s.Resource) *KubernetesDelta {
+	var delta KubernetesDelta
+
+	for kind, resources := range to {
+		old := make(map[string]k8s.Resource, len(from[kind]))
+		for _, r := range from[kind] {
+			old[resourceKey(r)] = r
+		}
+		for _, r := range resources {
+			prev, ok := old[resourceKey(r)]
+			switch {
+			case !ok:
+				appendResource(&delta.Added, kind, r)
+			case !reflect.DeepEqual(prev, r):
+				appendResource(&delta.Modified, kind, r)
+			}
+		}
+	}
+	for kind, resources := range from {
+		current := make(map[string]bool, len(to[kind]))
+		for _, r := range to[kind] {
+			current[resourceKey(r)] = true
+		}
+		for _, r := range resources {
+			if !current[resourceKey(r)] {
+				appendResource(&delta.Deleted, kind, r)
+			}
+		}
+	}
+
+	if delta.empty() {
+		return nil
+	}
+	return &delta
+}
@@ -0,0 +1,131 @@
+package watt
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/pkg/consulwatch"
+
+	"github.com/datawire/ambassador/pkg/k8s"
+)
+
+func service(name, port string) k8s.Resource {
+	return k8s.Resource{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"spec":       map[string]interface{}{"port": port},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	from := Snapshot{
+		Kubernetes: map[string][]k8s.Resource{
+			"service": {service("foo", "80"), service("bar", "80"), service("baz", "80")},
+		},
+		Consul: ConsulSnapshot{Endpoints: map[string]consulwatch.Endpoints{
+			"a": {Service: "a"},
+			"b": {Service: "b"},
+		}},
+	}
+	to := Snapshot{
+		Kubernetes: map[string][]k8s.Resource{
+			"service": {service("foo", "80"), service("bar", "8080"), service("qux", "80")},
+		},
+		Consul: ConsulSnapshot{Endpoints: map[string]consulwatch.Endpoints{
+			"a": {Service: "a", Endpoints: []consulwatch.Endpoint{{Address: "1.2.3.4"}}},
+			"c": {Service: "c"},
+		}},
+		Errors: map[string][]Error{"x": {{Source: "x", Message: "oops"}}},
+	}
+
+	delta := Diff(from, to)
+	require.Equal(t, map[string][]k8s.Resource{"service": {service("qux", "80")}}, delta.Kubernetes.Added)
+	require.Equal(t, map[string][]k8s.Resource{"service": {service("bar", "8080")}}, delta.Kubernetes.Modified)
+	require.Equal(t, map[string][]k8s.Resource{"service": {service("baz", "80")}}, delta.Kubernetes.Deleted)
+	require.Equal(t, map[string]consulwatch.Endpoints{"c": {Service: "c"}}, delta.Consul.Added)
+	require.Equal(t, []string{"a"}, keys(delta.Consul.Modified))
+	require.Equal(t, []string{"b"}, delta.Consul.Deleted)
+	require.Equal(t, to.Errors, delta.Errors)
+	require.Nil(t, delta.Consul.Connect)
+	require.Nil(t, delta.Files)
+	require.Nil(t, delta.DNS)
+
+	require.Equal(t, SnapshotDelta{}, Diff(from, from))
+}
+
+func TestDiffOmitsUnchanged(t *testing.T) {
+	from := Snapshot{Kubernetes: map[string][]k8s.Resource{"service": {service("foo", "80")}}}
+	to := Snapshot{Kubernetes: map[string][]k8s.Resource{"service": {service("foo", "8080")}}}
+
+	delta := Diff(from, to)
+	delta.Since, delta.Id = 1, 2
+	bytes, err := json.Marshal(delta)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(bytes, &fields))
+	require.Equal(t, []string{"Id", "Kubernetes", "Since"}, sortedKeys(fields))
+
+	bytes, err = json.Marshal(Diff(to, to))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Since": 0, "Id": 0}`, string(bytes))
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func keys(m map[string]consulwatch.Endpoints) (result []string) {
+	for k := range m {
+		result = append(result, k)
+	}
+	return
+}
+
+func TestDiffFilesAndDNS(t *testing.T) {
+	from := Snapshot{
+		Files: map[string][]k8s.Resource{"service": {service("foo", "80")}},
+		DNS: map[string]DNSRecords{
+			"_http._tcp.a": {Service: "_http._tcp.a", Records: []SRV{{Target: "a", Port: 80}}},
+			"_http._tcp.b": {Service: "_http._tcp.b"},
+		},
+	}
+	to := Snapshot{
+		Files: map[string][]k8s.Resource{"service": {service("foo", "8080")}},
+		DNS: map[string]DNSRecords{
+			"_http._tcp.a": {Service: "_http._tcp.a", Records: []SRV{{Target: "a", Port: 8080}}},
+		},
+	}
+
+	delta := Diff(from, to)
+	require.Equal(t, map[string][]k8s.Resource{"service": {service("foo", "8080")}}, delta.Files.Modified)
+	require.Equal(t, to.DNS, delta.DNS.Modified)
+	require.Equal(t, []string{"_http._tcp.b"}, delta.DNS.Deleted)
+	require.Nil(t, delta.DNS.Added)
+}
+
+func TestDiffConnect(t *testing.T) {
+	roots := &consulwatch.CARoots{ActiveRootID: "a"}
+	from := Snapshot{Consul: ConsulSnapshot{Connect: map[string]ConnectCerts{
+		"foo": {Service: "foo", Leaf: &consulwatch.Certificate{SerialNumber: "1"}, Roots: roots},
+		"bar": {Service: "bar", Leaf: &consulwatch.Certificate{SerialNumber: "2"}, Roots: roots},
+	}}}
+	to := Snapshot{Consul: ConsulSnapshot{Connect: map[string]ConnectCerts{
+		// rotated
+		"foo": {Service: "foo", Leaf: &consulwatch.Certificate{SerialNumber: "3"}, Roots: roots},
+		"baz": {Service: "baz", Leaf: &consulwatch.Certificate{SerialNumber: "4"}, Roots: roots},
+	}}}
+
+	delta := Diff(from, to).Consul.Connect
+	require.Equal(t, map[string]ConnectCerts{"baz": to.Consul.Connect["baz"]}, delta.Added)
+	require.Equal(t, map[string]ConnectCerts{"foo": to.Consul.Connect["foo"]}, delta.Modified)
+	require.Equal(t, []string{"bar"}, delta.Deleted)
+}
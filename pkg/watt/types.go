@@ -11,6 +11,18 @@ import (
 
 type ConsulSnapshot struct {
 	Endpoints map[string]consulwatch.Endpoints `json:",omitempty"`
+	// Connect holds the Consul Connect certificates, keyed by the id of
+	// their watch, or by its watch id if it doesn't have one.
+	Connect map[string]ConnectCerts `json:",omitempty"`
+}
+
+// ConnectCerts are the Consul Connect leaf certificate of a service, and the
+// CA roots to check its peers against.
+type ConnectCerts struct {
+	Id      string
+	Service string
+	Leaf    *consulwatch.Certificate `json:",omitempty"`
+	Roots   *consulwatch.CARoots     `json:",omitempty"`
 }
 
 func (s *ConsulSnapshot) DeepCopy() (*ConsulSnapshot, error) {
@@ -29,14 +41,56 @@ type Error struct {
 	Source    string
 	Message   string
 	Timestamp int64
+	// WatchId, Class and Retries are set for the errors of watches: the
+	// watch that failed, what kind of failure it is, and how many more
+	// times it failed the same way. Timestamp is the last time.
+	WatchId string `json:",omitempty"`
+	Class   string `json:",omitempty"`
+	Retries int    `json:",omitempty"`
 }
 
+// The classes of watch errors.
+const (
+	// ErrorForbidden means the watch isn't allowed, e.g. by Kubernetes
+	// RBAC.
+	ErrorForbidden = "forbidden"
+	// ErrorUnknownKind means the watch is on a kind that doesn't exist,
+	// like a CRD that isn't installed.
+	ErrorUnknownKind = "unknown-kind"
+	// ErrorUnavailable means the API server couldn't be reached, or
+	// couldn't answer.
+	ErrorUnavailable = "unavailable"
+	// ErrorOther is everything else.
+	ErrorOther = "other"
+)
+
 func NewError(source, message string) Error {
 	return Error{Source: source, Message: message, Timestamp: time.Now().Unix()}
 }
 
+// SRV is one record of a DNS SRV lookup.
+type SRV struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// DNSRecords are the results of a DNS SRV lookup.
+type DNSRecords struct {
+	Id      string
+	Service string
+	Records []SRV
+}
+
 type Snapshot struct {
 	Consul     ConsulSnapshot            `json:",omitempty"`
 	Kubernetes map[string][]k8s.Resource `json:",omitempty"`
-	Errors     map[string][]Error        `json:",omitempty"`
+	// Files holds the resources read from files, keyed by kind like
+	// Kubernetes.
+	Files map[string][]k8s.Resource `json:",omitempty"`
+	// DNS holds the results of DNS SRV lookups, keyed by the name
+	// looked up.
+	DNS    map[string]DNSRecords `json:",omitempty"`
+	Errors map[string][]Error    `json:",omitempty"`
 }
@@ -308,7 +308,7 @@ fi
 # WORKER: AMBEX                                                                #
 ################################################################################
 if [[ -z "${DIAGD_ONLY}" ]]; then
-    launch "ambex" ambex -ads 8003 "${ENVOY_DIR}"
+    launch "ambex" ambex -ads 8003 -status-file "${snapshot_dir}/ambex-status.json" "${ENVOY_DIR}"
 
     diagd_flags+=('--kick' "kill -HUP $$")
 else